@@ -4,6 +4,7 @@ import (
 	"context"
 	"net/http"
 	"net/http/pprof"
+	"strings"
 	"sync"
 	"sync/atomic"
 
@@ -12,15 +13,20 @@ import (
 	"github.com/pingcap/tidb/util/logutil"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"go.uber.org/zap"
 
+	"github.com/pingcap/br/pkg/backoff"
 	"github.com/pingcap/br/pkg/meta"
+	"github.com/pingcap/br/pkg/utils"
 )
 
 var (
 	initOnce       = sync.Once{}
 	defaultContext context.Context
+	defaultCancel  context.CancelFunc
 	pdAddress      string
+	security       utils.SecurityConfig
 	hasLogFile     uint64
 
 	backerOnce    = sync.Once{}
@@ -46,6 +52,12 @@ const (
 	FlagStatusAddr = "status-addr"
 	// FlagSlowLogFile is the name of slow-log-file flag.
 	FlagSlowLogFile = "slow-log-file"
+	// FlagCrypterMethod is the name of crypter method flag.
+	FlagCrypterMethod = "crypter.method"
+	// FlagCrypterKeyFile is the name of crypter key file flag.
+	FlagCrypterKeyFile = "crypter.key-file"
+	// FlagBackoff is the name of backoff flag.
+	FlagBackoff = "backoff"
 )
 
 // AddFlags adds flags to the given cmd.
@@ -63,6 +75,16 @@ func AddFlags(cmd *cobra.Command) {
 	cmd.PersistentFlags().String(FlagStatusAddr, "",
 		"Set the HTTP listening address for the status report service. Set to empty string to disable")
 
+	cmd.PersistentFlags().String(FlagCrypterMethod, "",
+		"Encrypt files written by br, support aes256-ctr and aes256-gcm. If not set, files are written in plaintext")
+	cmd.PersistentFlags().String(FlagCrypterKeyFile, "",
+		"The file holds a 256 bits crypter key, in raw bytes or hex")
+
+	cmd.PersistentFlags().StringArray(FlagBackoff, nil,
+		`Tune the retry policy of a call site in the form of "site.field=value", eg, "import-file.attempts=32". `+
+			`The fields are attempts, base-delay, max-delay, jitter, deadline and max-sleep. Available sites: `+
+			strings.Join(backoff.Sites(), ", "))
+
 	cmd.PersistentFlags().StringP(FlagSlowLogFile, "", "",
 		"Set the slow log file path. If not set, discard slow logs")
 	_ = cmd.PersistentFlags().MarkHidden(FlagSlowLogFile)
@@ -130,6 +152,29 @@ func Init(cmd *cobra.Command) (err error) {
 			err = e
 			return
 		}
+		// Tune the retry policies.
+		backoffSettings, e := cmd.Flags().GetStringArray(FlagBackoff)
+		if e != nil {
+			err = e
+			return
+		}
+		if e = backoff.Configure(backoffSettings); e != nil {
+			err = e
+			return
+		}
+		// Set the certificates for TLS connections.
+		if security.CA, e = cmd.Flags().GetString(FlagCA); e != nil {
+			err = e
+			return
+		}
+		if security.Cert, e = cmd.Flags().GetString(FlagCert); e != nil {
+			err = e
+			return
+		}
+		if security.Key, e = cmd.Flags().GetString(FlagKey); e != nil {
+			err = e
+			return
+		}
 	})
 	return err
 }
@@ -139,6 +184,64 @@ func HasLogFile() bool {
 	return atomic.LoadUint64(&hasLogFile) != uint64(0)
 }
 
+// CreateStorage creates the ExternalStorage of the url, files written by br
+// are encrypted if a crypter is specified.
+func CreateStorage(flags *pflag.FlagSet, u string) (utils.ExternalStorage, error) {
+	storage, err := utils.CreateStorage(u)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	methodName, err := flags.GetString(FlagCrypterMethod)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	method, err := utils.ParseCrypterMethod(methodName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if method == utils.CrypterPlaintext {
+		return storage, nil
+	}
+	keyFile, err := flags.GetString(FlagCrypterKeyFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if keyFile == "" {
+		return nil, errors.Errorf("--%s is required by --%s", FlagCrypterKeyFile, FlagCrypterMethod)
+	}
+	key, err := utils.LoadCrypterKey(keyFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return utils.NewEncryptedStorage(storage, method, key)
+}
+
+// LockStorage locks the storage for the command, the returned function
+// unlocks it. If the lock is lost, the default context is canceled to stop
+// the command, so that it does not write the storage along with others.
+func LockStorage(cmd *cobra.Command, storage utils.ExternalStorage) (func(), error) {
+	lock, err := utils.LockStorage(
+		GetDefaultContext(), storage, cmd.CommandPath(), utils.DefaultLockTTL)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-lock.Lost():
+			log.Error("stop the command since the storage lock is lost", zap.Error(lock.Err()))
+			defaultCancel()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		if err := lock.Unlock(); err != nil {
+			log.Warn("unlock storage failed", zap.Error(err))
+		}
+	}, nil
+}
+
 // GetDefaultBacker returns the default backer for command line usage.
 func GetDefaultBacker() (*meta.Backer, error) {
 	if pdAddress == "" {
@@ -148,7 +251,7 @@ func GetDefaultBacker() (*meta.Backer, error) {
 	// Lazy initialize and defaultBacker
 	var err error
 	backerOnce.Do(func() {
-		defaultBacker, err = meta.NewBacker(defaultContext, pdAddress)
+		defaultBacker, err = meta.NewBacker(defaultContext, pdAddress, security)
 	})
 	if err != nil {
 		return nil, err
@@ -156,9 +259,14 @@ func GetDefaultBacker() (*meta.Backer, error) {
 	return defaultBacker, nil
 }
 
+// GetSecurityConfig returns the certificates for TLS connections.
+func GetSecurityConfig() utils.SecurityConfig {
+	return security
+}
+
 // SetDefaultContext sets the default context for command line usage.
 func SetDefaultContext(ctx context.Context) {
-	defaultContext = ctx
+	defaultContext, defaultCancel = context.WithCancel(ctx)
 }
 
 // GetDefaultContext returns the default context for command line usage.
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/pingcap/br/pkg/meta"
+	"github.com/pingcap/br/pkg/utils"
+)
+
+// NewListCommand returns a list subcommand.
+func NewListCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "list",
+		Short: "list backups under a storage root",
+		Args:  cobra.NoArgs,
+		PersistentPreRunE: func(c *cobra.Command, args []string) error {
+			if err := Init(c); err != nil {
+				return err
+			}
+			utils.LogBRInfo()
+			utils.LogArguments(c)
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			u, err := cmd.Flags().GetString(FlagStorage)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if u == "" {
+				return errors.New("empty backup store is not allowed")
+			}
+			storage, err := CreateStorage(cmd.Flags(), u)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			entries, err := utils.LoadCatalog(storage)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "PATH\tTYPE\tSTART TS\tEND TS\tEND TIME\tSIZE\tTABLES\tVERIFY")
+			for _, e := range entries {
+				endTime := time.Unix(0, meta.DecodeTs(e.EndVersion).Physical*int64(time.Millisecond))
+				fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\t%d\t%s\n",
+					e.Path, e.Type, e.StartVersion, e.EndVersion,
+					endTime.Format(time.RFC3339), humanize.IBytes(uint64(e.Size)),
+					e.TableCount, e.Verify)
+			}
+			return errors.Trace(w.Flush())
+		},
+	}
+	return command
+}
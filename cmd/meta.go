@@ -5,10 +5,9 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"io"
 
-	"github.com/gogo/protobuf/proto"
 	"github.com/pingcap/errors"
-	"github.com/pingcap/kvproto/pkg/backup"
 	"github.com/pingcap/log"
 	"github.com/pingcap/parser/model"
 	"github.com/spf13/cobra"
@@ -42,17 +41,11 @@ func NewMetaCommand() *cobra.Command {
 			if u == "" {
 				return errors.New("empty backup store is not allowed")
 			}
-			storage, err := utils.CreateStorage(u)
+			storage, err := CreateStorage(cmd.Flags(), u)
 			if err != nil {
 				return errors.Trace(err)
 			}
-			metaData, err := storage.Read(utils.MetaFile)
-			if err != nil {
-				return errors.Trace(err)
-			}
-
-			backupMeta := &backup.BackupMeta{}
-			err = proto.Unmarshal(metaData, backupMeta)
+			backupMeta, err := utils.ReadBackupMeta(storage)
 			if err != nil {
 				return errors.Trace(err)
 			}
@@ -93,14 +86,13 @@ func NewMetaCommand() *cobra.Command {
 						zap.Binary("endKey", file.GetEndKey()),
 					)
 
-					var data []byte
-					data, err = storage.Read(file.Name)
+					var s []byte
+					s, err = fileSha256(storage, file.Name)
 					if err != nil {
 						return errors.Trace(err)
 					}
-					s := sha256.Sum256(data)
 					hexBytes := make([]byte, hex.EncodedLen(len(s)))
-					hex.Encode(hexBytes, s[:])
+					hex.Encode(hexBytes, s)
 					if !bytes.Equal(hexBytes, file.Sha256) {
 						return errors.Errorf(`
 backup data checksum failed: %s may be changed
@@ -124,3 +116,18 @@ origin sha256 is %s`, file.Name, s, file.Sha256)
 	meta.AddCommand(checksumCmd)
 	return meta
 }
+
+// fileSha256 calculates the sha256 of a storage file without loading the
+// whole file into memory.
+func fileSha256(storage utils.ExternalStorage, name string) ([]byte, error) {
+	reader, err := storage.Open(name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer reader.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, reader); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return h.Sum(nil), nil
+}
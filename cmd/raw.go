@@ -2,7 +2,10 @@ package cmd
 
 import (
 	"context"
+	"fmt"
+	"text/tabwriter"
 
+	"github.com/dustin/go-humanize"
 	"github.com/pingcap/errors"
 	"github.com/pingcap/log"
 	"github.com/spf13/cobra"
@@ -11,6 +14,8 @@ import (
 	"github.com/pingcap/br/pkg/utils"
 )
 
+const flagDryRun = "dry-run"
+
 // NewBackupCommand return a full backup subcommand.
 func NewBackupCommand() *cobra.Command {
 	command := &cobra.Command{
@@ -34,16 +39,78 @@ func NewBackupCommand() *cobra.Command {
 		"timeago", "", "",
 		"The history version of the backup task, e.g. 1m, 1h. Do not exceed GCSafePoint")
 
+	command.PersistentFlags().StringP(
+		"backupts", "", "",
+		"The backup ts, a TSO or a datetime, e.g. 415520709034803201, "+
+			"2020-02-20T12:00:00+08:00, tso:415520709034803201 or time:2020-02-20 12:00:00")
+
 	command.PersistentFlags().Uint64P(
 		"ratelimit", "", 0, "The rate limit of the backup task, MB/s per node")
 	command.PersistentFlags().Uint32P(
 		"concurrency", "", 4, "The size of thread pool on each node that execute the backup task")
+	command.PersistentFlags().Uint(
+		"fine-grained-concurrency", 16, "The number of concurrent requests to retry the incomplete ranges")
+	command.PersistentFlags().Uint(
+		"range-concurrency", 8, "The number of ranges backed up concurrently")
+
+	command.PersistentFlags().BoolP("checksum", "", true,
+		"Run admin checksum on the tables and verify the backed up files against it")
+	command.PersistentFlags().Uint(
+		"checksum-concurrency", 4, "The number of tables checksummed concurrently")
+	command.PersistentFlags().Bool(flagDryRun, false,
+		"Print the plan of the backup and exit without backing up any data")
+	return command
+}
 
-	command.PersistentFlags().BoolP("checksum", "", false,
-		"fast checksum backup sst file by calculate all sst file")
+// printBackupPlan prints what the backup would do.
+func printBackupPlan(
+	cmd *cobra.Command, client *raw.BackupClient, ranges []raw.Range, backupTS uint64,
+) error {
+	plan, err := client.PlanBackup(ranges, backupTS)
+	if err != nil {
+		return err
+	}
+	cmd.Printf("Backup TS:    %d\n", plan.BackupTS)
+	cmd.Printf("GC safepoint: %d (%s before the backup ts)\n", plan.SafePoint, plan.GCMargin)
+	cmd.Printf("Tables:       %d (and %d views)\n", len(plan.Tables), plan.Views)
+	for _, table := range plan.Tables {
+		cmd.Printf("  %s\n", table)
+	}
+	cmd.Printf("Regions:      %d\n", plan.Regions)
+	cmd.Printf("Size:         %s\n", humanize.IBytes(uint64(plan.Size)))
+	cmd.Printf("KVs:          %d\n", plan.Kvs)
+	cmd.Println("Storage:      writable")
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "START KEY\tEND KEY\tREGIONS\tSIZE\tKVS")
+	for _, r := range plan.Ranges {
+		fmt.Fprintf(w, "%x\t%x\t%d\t%s\t%d\n", r.StartKey, r.EndKey,
+			r.Regions, humanize.IBytes(uint64(r.Size)), r.Kvs)
+	}
+	if err = w.Flush(); err != nil {
+		return errors.Trace(err)
+	}
+	for _, warning := range plan.Warnings {
+		cmd.Printf("WARNING: %s\n", warning)
+	}
+	return nil
+}
 
-	_ = command.PersistentFlags().MarkHidden("checksum")
-	return command
+func getBackupTS(command *cobra.Command, client *raw.BackupClient) (uint64, error) {
+	timeAgo, err := command.Flags().GetString("timeago")
+	if err != nil {
+		return 0, err
+	}
+	backupTS, err := command.Flags().GetString("backupts")
+	if err != nil {
+		return 0, err
+	}
+	if backupTS != "" {
+		if timeAgo != "" {
+			return 0, errors.New("--backupts and --timeago can not be used together")
+		}
+		return client.GetBackupTS(backupTS)
+	}
+	return client.GetTS(timeAgo)
 }
 
 // newFullBackupCommand return a full backup subcommand.
@@ -69,17 +136,30 @@ func newFullBackupCommand() *cobra.Command {
 				return errors.New("empty backup store is not allowed")
 			}
 
-			err = client.SetStorage(u)
+			storage, err := CreateStorage(command.Flags(), u)
 			if err != nil {
 				return err
 			}
-
-			timeAgo, err := command.Flags().GetString("timeago")
+			dryRun, err := command.Flags().GetBool(flagDryRun)
+			if err != nil {
+				return err
+			}
+			// A dry run writes nothing but a probe file, so it does not lock
+			// the storage.
+			if !dryRun {
+				unlock, err := LockStorage(command, storage)
+				if err != nil {
+					return err
+				}
+				defer unlock()
+			}
+			client.SetDryRun(dryRun)
+			err = client.SetStorage(storage)
 			if err != nil {
 				return err
 			}
 
-			backupTS, err := client.GetTS(timeAgo)
+			backupTS, err := getBackupTS(command, client)
 			if err != nil {
 				return err
 			}
@@ -96,12 +176,49 @@ func newFullBackupCommand() *cobra.Command {
 			if concurrency == 0 {
 				return errors.New("at least one thread required")
 			}
+			fineGrainedConcurrency, err := command.Flags().GetUint("fine-grained-concurrency")
+			if err != nil {
+				return err
+			}
+			if fineGrainedConcurrency == 0 {
+				return errors.New("at least one fine grained request required")
+			}
+			client.SetFineGrainedConcurrency(fineGrainedConcurrency)
+			rangeConcurrency, err := command.Flags().GetUint("range-concurrency")
+			if err != nil {
+				return err
+			}
+			if rangeConcurrency == 0 {
+				return errors.New("at least one range required")
+			}
+			client.SetRangeConcurrency(rangeConcurrency)
+			checksumSwitch, err := command.Flags().GetBool("checksum")
+			if err != nil {
+				return err
+			}
+			client.SetChecksum(checksumSwitch)
+			checksumConcurrency, err := command.Flags().GetUint("checksum-concurrency")
+			if err != nil {
+				return err
+			}
+			if checksumConcurrency == 0 {
+				return errors.New("at least one checksum session required")
+			}
+			client.SetChecksumConcurrency(checksumConcurrency)
 
-			ranges, err := client.PreBackupAllTableRanges(backupTS)
+			systemTables, err := command.Flags().GetStringSlice("system-tables")
 			if err != nil {
 				return err
 			}
 
+			ranges, err := client.PreBackupAllTableRanges(backupTS, systemTables)
+			if err != nil {
+				return err
+			}
+			if dryRun {
+				return printBackupPlan(command, client, ranges, backupTS)
+			}
+
 			// the count of regions need to backup
 			approximateRegions, err := client.GetRangeRegionCount([]byte{}, []byte{})
 			if err != nil {
@@ -125,10 +242,6 @@ func newFullBackupCommand() *cobra.Command {
 				return err
 			}
 
-			checksumSwitch, err := command.Flags().GetBool("checksum")
-			if err != nil {
-				return err
-			}
 			if checksumSwitch {
 				valid, err := client.FastChecksum()
 				if err != nil {
@@ -143,6 +256,8 @@ func newFullBackupCommand() *cobra.Command {
 			return client.SaveBackupMeta(u)
 		},
 	}
+	command.Flags().StringSlice("system-tables", nil,
+		"The system tables in mysql to backup, e.g. user,db,tables_priv,bind_info")
 	return command
 }
 
@@ -169,7 +284,25 @@ func newTableBackupCommand() *cobra.Command {
 				return errors.New("empty backup store is not allowed")
 			}
 
-			err = client.SetStorage(u)
+			storage, err := CreateStorage(command.Flags(), u)
+			if err != nil {
+				return err
+			}
+			dryRun, err := command.Flags().GetBool(flagDryRun)
+			if err != nil {
+				return err
+			}
+			// A dry run writes nothing but a probe file, so it does not lock
+			// the storage.
+			if !dryRun {
+				unlock, err := LockStorage(command, storage)
+				if err != nil {
+					return err
+				}
+				defer unlock()
+			}
+			client.SetDryRun(dryRun)
+			err = client.SetStorage(storage)
 			if err != nil {
 				return err
 			}
@@ -189,12 +322,7 @@ func newTableBackupCommand() *cobra.Command {
 				return errors.Errorf("empty table name is not allowed")
 			}
 
-			timeAgo, err := command.Flags().GetString("timeago")
-			if err != nil {
-				return err
-			}
-
-			backupTS, err := client.GetTS(timeAgo)
+			backupTS, err := getBackupTS(command, client)
 			if err != nil {
 				return err
 			}
@@ -210,12 +338,43 @@ func newTableBackupCommand() *cobra.Command {
 			if concurrency == 0 {
 				return errors.New("at least one thread required")
 			}
+			fineGrainedConcurrency, err := command.Flags().GetUint("fine-grained-concurrency")
+			if err != nil {
+				return err
+			}
+			if fineGrainedConcurrency == 0 {
+				return errors.New("at least one fine grained request required")
+			}
+			client.SetFineGrainedConcurrency(fineGrainedConcurrency)
+			rangeConcurrency, err := command.Flags().GetUint("range-concurrency")
+			if err != nil {
+				return err
+			}
+			if rangeConcurrency == 0 {
+				return errors.New("at least one range required")
+			}
+			client.SetRangeConcurrency(rangeConcurrency)
+			checksumSwitch, err := command.Flags().GetBool("checksum")
+			if err != nil {
+				return err
+			}
+			client.SetChecksum(checksumSwitch)
+			checksumConcurrency, err := command.Flags().GetUint("checksum-concurrency")
+			if err != nil {
+				return err
+			}
+			if checksumConcurrency == 0 {
+				return errors.New("at least one checksum session required")
+			}
+			client.SetChecksumConcurrency(checksumConcurrency)
 
-			// TODO: include admin check in progress bar.
 			ranges, err := client.PreBackupTableRanges(db, table, u, backupTS)
 			if err != nil {
 				return err
 			}
+			if dryRun {
+				return printBackupPlan(command, client, ranges, backupTS)
+			}
 			// the count of regions need to backup
 			approximateRegions := 0
 			for _, r := range ranges {
@@ -244,10 +403,6 @@ func newTableBackupCommand() *cobra.Command {
 				return err
 			}
 
-			checksumSwitch, err := command.Flags().GetBool("checksum")
-			if err != nil {
-				return err
-			}
 			if checksumSwitch {
 				valid, err := client.FastChecksum()
 				if err != nil {
@@ -3,12 +3,7 @@ package cmd
 import (
 	"context"
 
-	"github.com/gogo/protobuf/proto"
 	"github.com/pingcap/errors"
-	"github.com/pingcap/kvproto/pkg/backup"
-	"github.com/pingcap/kvproto/pkg/import_sstpb"
-	"github.com/pingcap/parser/model"
-	restore_util "github.com/pingcap/tidb-tools/pkg/restore-util"
 	"github.com/spf13/cobra"
 	flag "github.com/spf13/pflag"
 
@@ -16,6 +11,12 @@ import (
 	"github.com/pingcap/br/pkg/utils"
 )
 
+const flagEmbeddedSession = "embedded-session"
+
+const embeddedSessionUsage = "create schemas with the session embedded in br instead of tidb, " +
+	"so that no tidb is needed. br runs a DDL worker which may take the DDL owner from tidb, " +
+	"so do not use it while any tidb server is running on the cluster"
+
 // NewRestoreCommand returns a restore subcommand
 func NewRestoreCommand() *cobra.Command {
 	bp := &cobra.Command{
@@ -43,94 +44,68 @@ func newFullRestoreCommand() *cobra.Command {
 		Use:   "full",
 		Short: "restore all tables",
 		RunE: func(cmd *cobra.Command, _ []string) error {
-			pdAddr, err := cmd.Flags().GetString(FlagPD)
-			if err != nil {
-				return errors.Trace(err)
-			}
 			ctx, cancel := context.WithCancel(GetDefaultContext())
 			defer cancel()
-			client, err := restore.NewRestoreClient(ctx, pdAddr)
+			client, err := newRestoreClient(ctx, cmd)
 			if err != nil {
 				return errors.Trace(err)
 			}
 			defer client.Close()
-			err = initRestoreClient(client, cmd.Flags())
+			conflict, err := cmd.Flags().GetString("system-tables-conflict")
 			if err != nil {
 				return errors.Trace(err)
 			}
-
-			tableRules := make([]*import_sstpb.RewriteRule, 0)
-			dataRules := make([]*import_sstpb.RewriteRule, 0)
-			files := make([]*backup.File, 0)
-			tables := make([]*utils.Table, 0)
-			newTables := make([]*model.TableInfo, 0)
-			for _, db := range client.GetDatabases() {
-				err = restore.CreateDatabase(db.Schema, client.GetDbDSN())
-				if err != nil {
-					return errors.Trace(err)
-				}
-				var rules *restore_util.RewriteRules
-				var nt []*model.TableInfo
-				rules, nt, err = client.CreateTables(db.Tables)
-				if err != nil {
-					return errors.Trace(err)
-				}
-				newTables = append(newTables, nt...)
-				tableRules = append(tableRules, rules.Table...)
-				dataRules = append(dataRules, rules.Data...)
-				for _, table := range db.Tables {
-					files = append(files, table.Files...)
-				}
-				tables = append(tables, db.Tables...)
-			}
-			ranges := restore.GetRanges(files)
-
-			// Redirect to log if there is no log file to avoid unreadable output.
-			updateCh := utils.StartProgress(
-				ctx,
-				"Full Restore",
-				// Split/Scatter + Download/Ingest
-				int64(len(ranges)+len(files)),
-				!HasLogFile())
-
-			rewriteRules := &restore_util.RewriteRules{
-				Table: tableRules,
-				Data:  dataRules,
-			}
-			err = restore.SplitRanges(ctx, client, ranges, rewriteRules, updateCh)
+			policy, err := restore.ParseConflictPolicy(conflict)
 			if err != nil {
 				return errors.Trace(err)
 			}
-			err = client.ResetTS()
+			unlock, err := initRestoreClient(cmd, client)
 			if err != nil {
 				return errors.Trace(err)
 			}
-
-			err = client.SwitchToImportMode(ctx)
+			defer unlock()
+			embedded, err := cmd.Flags().GetBool(flagEmbeddedSession)
 			if err != nil {
 				return errors.Trace(err)
 			}
+			if embedded && client.HasSystemTables() {
+				return errors.New("restoring system tables needs tidb, please specify --connect instead")
+			}
 
-			err = client.RestoreAll(rewriteRules, updateCh)
+			tables := make([]*utils.Table, 0)
+			for _, db := range client.GetDatabases() {
+				err = client.CreateDatabase(db.Schema)
+				if err != nil {
+					return errors.Trace(err)
+				}
+				tables = append(tables, db.Tables...)
+			}
+			wait, err := restoreTables(ctx, cmd, client, tables, "Full Restore")
 			if err != nil {
 				return errors.Trace(err)
 			}
-
-			err = client.SwitchToNormalMode(ctx)
+			defer wait()
+			err = client.CreateViews(client.GetDatabases())
 			if err != nil {
 				return errors.Trace(err)
 			}
-			err = client.ValidateChecksum(tables, newTables)
+			// Merge system tables after checksum, since the restored
+			// system tables are dropped after merged.
+			err = client.RestoreSystemTables(policy)
 			return errors.Trace(err)
 		},
 	}
 
 	command.Flags().String("connect", "", "the address to connect tidb, format: username:password@protocol(address)/")
+	command.Flags().Bool(flagEmbeddedSession, false, embeddedSessionUsage)
 	command.Flags().Uint("concurrency", 128, "The size of thread pool that execute the restore task")
-
-	if err := command.MarkFlagRequired("connect"); err != nil {
-		panic(err)
-	}
+	command.Flags().Uint64("ratelimit", 0, "The rate limit of the restore task, MB/s per store, 0 means unlimited")
+	command.Flags().Uint("store-concurrency", 0,
+		"The maximum number of concurrent downloads and ingests on each store, 0 means unlimited")
+	command.Flags().Bool("analyze", false, "analyze the tables which have no statistics in the backup")
+	command.Flags().String("system-tables-conflict", string(restore.ConflictSkip),
+		"what to do when a row of the backup system tables conflicts with an existing row, "+
+			"skip, overwrite or error")
 
 	return command
 }
@@ -140,22 +115,19 @@ func newDbRestoreCommand() *cobra.Command {
 		Use:   "db",
 		Short: "restore tables in a database",
 		RunE: func(cmd *cobra.Command, _ []string) error {
-			pdAddr, err := cmd.Flags().GetString(FlagPD)
-			if err != nil {
-				return errors.Trace(err)
-			}
 			ctx, cancel := context.WithCancel(GetDefaultContext())
 			defer cancel()
 
-			client, err := restore.NewRestoreClient(ctx, pdAddr)
+			client, err := newRestoreClient(ctx, cmd)
 			if err != nil {
 				return errors.Trace(err)
 			}
 			defer client.Close()
-			err = initRestoreClient(client, cmd.Flags())
+			unlock, err := initRestoreClient(cmd, client)
 			if err != nil {
 				return errors.Trace(err)
 			}
+			defer unlock()
 
 			dbName, err := cmd.Flags().GetString("db")
 			if err != nil {
@@ -165,66 +137,31 @@ func newDbRestoreCommand() *cobra.Command {
 			if db == nil {
 				return errors.New("not exists database")
 			}
-			err = restore.CreateDatabase(db.Schema, client.GetDbDSN())
-			if err != nil {
-				return errors.Trace(err)
-			}
-
-			rewriteRules, newTables, err := client.CreateTables(db.Tables)
-			if err != nil {
-				return errors.Trace(err)
-			}
-			files := make([]*backup.File, 0)
-			for _, table := range db.Tables {
-				files = append(files, table.Files...)
-			}
-			ranges := restore.GetRanges(files)
-
-			// Redirect to log if there is no log file to avoid unreadable output.
-			updateCh := utils.StartProgress(
-				ctx,
-				"Database Restore",
-				// Split/Scatter + Download/Ingest
-				int64(len(ranges)+len(files)),
-				!HasLogFile())
-
-			err = restore.SplitRanges(ctx, client, ranges, rewriteRules, updateCh)
-			if err != nil {
-				return errors.Trace(err)
-			}
-			err = client.ResetTS()
-			if err != nil {
-				return errors.Trace(err)
-			}
-
-			err = client.SwitchToImportMode(ctx)
+			err = client.CreateDatabase(db.Schema)
 			if err != nil {
 				return errors.Trace(err)
 			}
 
-			err = client.RestoreDatabase(
-				db, rewriteRules, updateCh)
+			wait, err := restoreTables(ctx, cmd, client, db.Tables, "Database Restore")
 			if err != nil {
 				return errors.Trace(err)
 			}
-
-			err = client.SwitchToNormalMode(ctx)
-			if err != nil {
-				return errors.Trace(err)
-			}
-			err = client.ValidateChecksum(db.Tables, newTables)
+			defer wait()
+			err = client.CreateViews([]*utils.Database{db})
 			return errors.Trace(err)
 		},
 	}
 
 	command.Flags().String("connect", "", "the address to connect tidb, format: username:password@protocol(address)/")
+	command.Flags().Bool(flagEmbeddedSession, false, embeddedSessionUsage)
 	command.Flags().Uint("concurrency", 128, "The size of thread pool that execute the restore task")
+	command.Flags().Uint64("ratelimit", 0, "The rate limit of the restore task, MB/s per store, 0 means unlimited")
+	command.Flags().Uint("store-concurrency", 0,
+		"The maximum number of concurrent downloads and ingests on each store, 0 means unlimited")
+	command.Flags().Bool("analyze", false, "analyze the tables which have no statistics in the backup")
 
 	command.Flags().String("db", "", "database name")
 
-	if err := command.MarkFlagRequired("connect"); err != nil {
-		panic(err)
-	}
 	if err := command.MarkFlagRequired("db"); err != nil {
 		panic(err)
 	}
@@ -237,22 +174,19 @@ func newTableRestoreCommand() *cobra.Command {
 		Use:   "table",
 		Short: "restore a table",
 		RunE: func(cmd *cobra.Command, _ []string) error {
-			pdAddr, err := cmd.Flags().GetString(FlagPD)
-			if err != nil {
-				return errors.Trace(err)
-			}
 			ctx, cancel := context.WithCancel(GetDefaultContext())
 			defer cancel()
 
-			client, err := restore.NewRestoreClient(ctx, pdAddr)
+			client, err := newRestoreClient(ctx, cmd)
 			if err != nil {
 				return errors.Trace(err)
 			}
 			defer client.Close()
-			err = initRestoreClient(client, cmd.Flags())
+			unlock, err := initRestoreClient(cmd, client)
 			if err != nil {
 				return errors.Trace(err)
 			}
+			defer unlock()
 
 			dbName, err := cmd.Flags().GetString("db")
 			if err != nil {
@@ -262,7 +196,7 @@ func newTableRestoreCommand() *cobra.Command {
 			if db == nil {
 				return errors.New("not exists database")
 			}
-			err = restore.CreateDatabase(db.Schema, client.GetDbDSN())
+			err = client.CreateDatabase(db.Schema)
 			if err != nil {
 				return errors.Trace(err)
 			}
@@ -273,57 +207,34 @@ func newTableRestoreCommand() *cobra.Command {
 			}
 			table := db.GetTable(tableName)
 			if table == nil {
-				return errors.New("not exists table")
-			}
-			// The rules here is raw key.
-			rewriteRules, newTables, err := client.CreateTables([]*utils.Table{table})
-			if err != nil {
-				return errors.Trace(err)
-			}
-			ranges := restore.GetRanges(table.Files)
-
-			// Redirect to log if there is no log file to avoid unreadable output.
-			updateCh := utils.StartProgress(
-				ctx,
-				"Table Restore",
-				// Split/Scatter + Download/Ingest
-				int64(len(ranges)+len(table.Files)),
-				!HasLogFile())
-
-			err = restore.SplitRanges(ctx, client, ranges, rewriteRules, updateCh)
-			if err != nil {
-				return errors.Trace(err)
-			}
-			err = client.ResetTS()
-			if err != nil {
-				return errors.Trace(err)
-			}
-			err = client.SwitchToImportMode(ctx)
-			if err != nil {
-				return errors.Trace(err)
-			}
-			err = client.RestoreTable(table, rewriteRules, updateCh)
-			if err != nil {
+				// A view has no data, only its definition is restored.
+				view := db.GetView(tableName)
+				if view == nil {
+					return errors.New("not exists table")
+				}
+				err = client.CreateViews([]*utils.Database{{Schema: db.Schema, Views: []*utils.Table{view}}})
 				return errors.Trace(err)
 			}
-			err = client.SwitchToNormalMode(ctx)
+			wait, err := restoreTables(ctx, cmd, client, []*utils.Table{table}, "Table Restore")
 			if err != nil {
 				return errors.Trace(err)
 			}
-			err = client.ValidateChecksum([]*utils.Table{table}, newTables)
-			return errors.Trace(err)
+			wait()
+			return nil
 		},
 	}
 
 	command.Flags().String("connect", "", "the address to connect tidb, format: username:password@protocol(address)/")
+	command.Flags().Bool(flagEmbeddedSession, false, embeddedSessionUsage)
 	command.Flags().Uint("concurrency", 128, "The size of thread pool that execute the restore task")
+	command.Flags().Uint64("ratelimit", 0, "The rate limit of the restore task, MB/s per store, 0 means unlimited")
+	command.Flags().Uint("store-concurrency", 0,
+		"The maximum number of concurrent downloads and ingests on each store, 0 means unlimited")
+	command.Flags().Bool("analyze", false, "analyze the tables which have no statistics in the backup")
 
 	command.Flags().String("db", "", "database name")
 	command.Flags().String("table", "", "table name")
 
-	if err := command.MarkFlagRequired("connect"); err != nil {
-		panic(err)
-	}
 	if err := command.MarkFlagRequired("db"); err != nil {
 		panic(err)
 	}
@@ -334,21 +245,114 @@ func newTableRestoreCommand() *cobra.Command {
 	return command
 }
 
-func initRestoreClient(client *restore.Client, flagSet *flag.FlagSet) error {
+// newRestoreClient creates a restore client, and decides whether schemas are
+// created by the embedded session.
+func newRestoreClient(ctx context.Context, cmd *cobra.Command) (*restore.Client, error) {
+	pdAddr, err := cmd.Flags().GetString(FlagPD)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	embedded, err := cmd.Flags().GetBool(flagEmbeddedSession)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	dsn, err := cmd.Flags().GetString("connect")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if !embedded && dsn == "" {
+		return nil, errors.Errorf("--connect is required unless --%s is set", flagEmbeddedSession)
+	}
+	client, err := restore.NewRestoreClient(ctx, pdAddr, GetSecurityConfig(), embedded)
+	return client, errors.Trace(err)
+}
+
+// restoreTables restores the tables through the pipeline of the client, and
+// then their statistics. The returned function waits for analyzing the tables.
+func restoreTables(
+	ctx context.Context,
+	cmd *cobra.Command,
+	client *restore.Client,
+	tables []*utils.Table,
+	name string,
+) (func(), error) {
+	total := 0
+	for _, table := range tables {
+		total += len(restore.GetRanges(table.Files)) + len(table.Files)
+	}
+	// Redirect to log if there is no log file to avoid unreadable output.
+	updateCh := utils.StartProgress(
+		ctx,
+		name,
+		// Split/Scatter + Download/Ingest
+		int64(total),
+		!HasLogFile())
+
+	err := client.ResetTS()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	err = client.SwitchToImportMode(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	err = client.RestoreTables(tables, updateCh)
+	// Switch back even if some tables failed.
+	if switchErr := client.SwitchToNormalMode(ctx); err == nil {
+		err = switchErr
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return restoreStats(cmd, client, tables)
+}
+
+// restoreStats restores the statistics of the tables, the returned
+// function waits for analyzing the tables without statistics.
+func restoreStats(
+	cmd *cobra.Command, client *restore.Client, tables []*utils.Table,
+) (func(), error) {
+	missing, err := client.RestoreStats(tables)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	analyze, err := cmd.Flags().GetBool("analyze")
+	if err != nil {
+		return nil, err
+	}
+	if !analyze || len(missing) == 0 {
+		return func() {}, nil
+	}
+	return client.AnalyzeTables(missing), nil
+}
+
+// initRestoreClient locks the storage and loads the backupmeta, the
+// returned function unlocks the storage.
+func initRestoreClient(cmd *cobra.Command, client *restore.Client) (func(), error) {
+	flagSet := cmd.Flags()
 	u, err := flagSet.GetString(FlagStorage)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	s, err := utils.CreateStorage(u)
+	s, err := CreateStorage(flagSet, u)
 	if err != nil {
-		return errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
-	metaData, err := s.Read(utils.MetaFile)
+	unlock, err := LockStorage(cmd, s)
 	if err != nil {
-		return errors.Trace(err)
+		return nil, errors.Trace(err)
+	}
+	if err = setupRestoreClient(client, flagSet, s); err != nil {
+		unlock()
+		return nil, err
 	}
-	backupMeta := &backup.BackupMeta{}
-	err = proto.Unmarshal(metaData, backupMeta)
+	return unlock, nil
+}
+
+func setupRestoreClient(
+	client *restore.Client, flagSet *flag.FlagSet, s utils.ExternalStorage,
+) error {
+	backupMeta, err := utils.ReadBackupMeta(s)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -356,6 +360,7 @@ func initRestoreClient(client *restore.Client, flagSet *flag.FlagSet) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	client.SetStorage(s)
 
 	dsn, err := flagSet.GetString("connect")
 	if err != nil {
@@ -369,5 +374,16 @@ func initRestoreClient(client *restore.Client, flagSet *flag.FlagSet) error {
 	}
 	client.SetConcurrency(concurrency)
 
+	rate, err := flagSet.GetUint64("ratelimit")
+	if err != nil {
+		return err
+	}
+	client.SetRateLimit(rate)
+	storeConcurrency, err := flagSet.GetUint("store-concurrency")
+	if err != nil {
+		return err
+	}
+	client.SetStoreConcurrency(storeConcurrency)
+
 	return nil
 }
@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/pingcap/br/pkg/meta"
+	"github.com/pingcap/br/pkg/utils"
+)
+
+const flagJSON = "json"
+
+// tsoInfo is the human readable form of a TSO.
+type tsoInfo struct {
+	TSO      uint64 `json:"tso"`
+	Physical string `json:"physical"`
+	Logical  int64  `json:"logical"`
+	// SinceNow is negative if the TSO is in the future.
+	SinceNow string `json:"since_now"`
+}
+
+func newTSOInfo(ts uint64, now time.Time) *tsoInfo {
+	decoded := meta.DecodeTs(ts)
+	physical := time.Unix(0, decoded.Physical*int64(time.Millisecond))
+	return &tsoInfo{
+		TSO:      ts,
+		Physical: physical.Format("2006-01-02 15:04:05.000 -0700"),
+		Logical:  decoded.Logical,
+		SinceNow: now.Sub(physical).Round(time.Millisecond).String(),
+	}
+}
+
+func printTSO(cmd *cobra.Command, ts uint64) error {
+	info := newTSOInfo(ts, time.Now())
+	asJSON, err := cmd.Flags().GetBool(flagJSON)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if asJSON {
+		data, err := json.Marshal(info)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		cmd.Println(string(data))
+		return nil
+	}
+	cmd.Printf("TSO:       %d\n", info.TSO)
+	cmd.Printf("Physical:  %s\n", info.Physical)
+	cmd.Printf("Logical:   %d\n", info.Logical)
+	cmd.Printf("Since now: %s\n", info.SinceNow)
+	return nil
+}
+
+// NewTSOCommand returns a tso subcommand.
+func NewTSOCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "tso <subcommand>",
+		Short: "convert between TSOs and datetimes",
+		PersistentPreRunE: func(c *cobra.Command, args []string) error {
+			if err := Init(c); err != nil {
+				return err
+			}
+			utils.LogBRInfo()
+			utils.LogArguments(c)
+			return nil
+		},
+	}
+	command.PersistentFlags().Bool(flagJSON, false, "print in JSON")
+
+	nowCmd := &cobra.Command{
+		Use:   "now",
+		Short: "show the current TSO of PD",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			backer, err := GetDefaultBacker()
+			if err != nil {
+				return err
+			}
+			p, l, err := backer.GetPDClient().GetTS(backer.Context())
+			if err != nil {
+				return errors.Trace(err)
+			}
+			return printTSO(cmd, meta.EncodeTs(meta.Timestamp{Physical: p, Logical: l}))
+		},
+	}
+	decodeCmd := &cobra.Command{
+		Use:   "decode <tso>",
+		Short: "decode a TSO into a datetime",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ts, err := strconv.ParseUint(args[0], 10, 64)
+			if err != nil {
+				return errors.Annotatef(err, "invalid tso %s", args[0])
+			}
+			return printTSO(cmd, ts)
+		},
+	}
+	encodeCmd := &cobra.Command{
+		Use:   "encode <datetime>",
+		Short: "encode a datetime, e.g. 2020-02-20T12:00:00+08:00 or 2020-02-20 12:00:00, into a TSO",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Allow an unquoted "2006-01-02 15:04:05".
+			ts, err := meta.ParseDatetime(strings.Join(args, " "))
+			if err != nil {
+				return err
+			}
+			return printTSO(cmd, ts)
+		},
+	}
+	gcSafePointCmd := &cobra.Command{
+		Use:   "gc-safepoint",
+		Short: "show the GC safepoint of the cluster",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			backer, err := GetDefaultBacker()
+			if err != nil {
+				return err
+			}
+			safePoint, err := backer.GetGCSafePoint(backer.Context())
+			if err != nil {
+				return err
+			}
+			return printTSO(cmd, meta.EncodeTs(safePoint))
+		},
+	}
+	command.AddCommand(nowCmd, decodeCmd, encodeCmd, gcSafePointCmd)
+	return command
+}
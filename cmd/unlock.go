@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/pingcap/br/pkg/utils"
+)
+
+const flagForce = "force"
+
+// NewUnlockCommand returns an unlock subcommand.
+func NewUnlockCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "unlock",
+		Short: "clear the lock on a backup storage left by a crashed br",
+		Args:  cobra.NoArgs,
+		PersistentPreRunE: func(c *cobra.Command, args []string) error {
+			if err := Init(c); err != nil {
+				return err
+			}
+			utils.LogBRInfo()
+			utils.LogArguments(c)
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			u, err := cmd.Flags().GetString(FlagStorage)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if u == "" {
+				return errors.New("empty backup store is not allowed")
+			}
+			storage, err := CreateStorage(cmd.Flags(), u)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if !storage.FileExists(utils.LockFile) {
+				cmd.Println("the storage is not locked")
+				return nil
+			}
+			force, err := cmd.Flags().GetBool(flagForce)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			holder, err := utils.RemoveStorageLock(storage, force)
+			if err != nil {
+				return err
+			}
+			if holder != nil {
+				cmd.Printf("removed the lock %s\n", holder)
+			} else {
+				cmd.Println("removed the unreadable lock")
+			}
+			return nil
+		},
+	}
+	command.Flags().Bool(flagForce, false,
+		"remove the lock even if it is not expired, make sure no br is running on the storage")
+	return command
+}
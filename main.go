@@ -51,6 +51,9 @@ func main() {
 		cmd.NewMetaCommand(),
 		cmd.NewBackupCommand(),
 		cmd.NewRestoreCommand(),
+		cmd.NewListCommand(),
+		cmd.NewUnlockCommand(),
+		cmd.NewTSOCommand(),
 	)
 	rootCmd.SetArgs(os.Args[1:])
 	if err := rootCmd.Execute(); err != nil {
@@ -0,0 +1,295 @@
+package backoff
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// ErrorClass decides how a failed call is retried.
+type ErrorClass int
+
+const (
+	// Retryable errors are retried with an exponential backoff.
+	Retryable ErrorClass = iota
+	// RegionError errors are retried with the base delay, since the call
+	// only needs to refresh the region info.
+	RegionError
+	// Fatal errors are not retried.
+	Fatal
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case Retryable:
+		return "retryable"
+	case RegionError:
+		return "region"
+	default:
+		return "fatal"
+	}
+}
+
+// Classifier returns the class of an error.
+type Classifier func(error) ErrorClass
+
+// AlwaysRetry classifies every error as retryable.
+func AlwaysRetry(error) ErrorClass {
+	return Retryable
+}
+
+// Policy is the retry policy of a call site.
+type Policy struct {
+	// Attempts is the maximum number of calls, zero means no limit.
+	Attempts uint
+	// BaseDelay is the delay before the first retry.
+	BaseDelay time.Duration
+	// MaxDelay is the maximum delay between two calls.
+	MaxDelay time.Duration
+	// Jitter is the fraction of the delay which is randomized.
+	Jitter float64
+	// Deadline is the maximum total time of the retries, zero means no limit.
+	// It includes the time of the calls.
+	Deadline time.Duration
+	// MaxSleep is the maximum total time slept between the calls, zero means
+	// no limit. Unlike Deadline, it does not count the time of the calls.
+	MaxSleep time.Duration
+}
+
+// Site is a call site which retries with a named policy, the policy can be
+// tuned by Configure.
+type Site struct {
+	name string
+
+	mu     sync.Mutex
+	policy Policy
+}
+
+var sites = struct {
+	mu    sync.Mutex
+	sites map[string]*Site
+}{sites: make(map[string]*Site)}
+
+// Register registers a call site with its default policy.
+func Register(name string, policy Policy) *Site {
+	sites.mu.Lock()
+	defer sites.mu.Unlock()
+	if _, ok := sites.sites[name]; ok {
+		panic("duplicated backoff site " + name)
+	}
+	site := &Site{name: name, policy: policy}
+	sites.sites[name] = site
+	return site
+}
+
+// Sites returns the names of the registered call sites.
+func Sites() []string {
+	sites.mu.Lock()
+	defer sites.mu.Unlock()
+	names := make([]string, 0, len(sites.sites))
+	for name := range sites.sites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Configure tunes the policies of the call sites. Every setting is in the
+// form of "site.field=value", the fields are attempts, base-delay,
+// max-delay, jitter, deadline and max-sleep.
+func Configure(settings []string) error {
+	for _, setting := range settings {
+		kv := strings.SplitN(setting, "=", 2)
+		dot := strings.LastIndex(kv[0], ".")
+		if len(kv) != 2 || dot < 0 {
+			return errors.Errorf("invalid backoff setting %q, want site.field=value", setting)
+		}
+		name, field, value := kv[0][:dot], kv[0][dot+1:], kv[1]
+		sites.mu.Lock()
+		site, ok := sites.sites[name]
+		sites.mu.Unlock()
+		if !ok {
+			return errors.Errorf("unknown backoff site %q, available sites: %s",
+				name, strings.Join(Sites(), ", "))
+		}
+		if err := site.set(field, value); err != nil {
+			return errors.Annotatef(err, "invalid backoff setting %q", setting)
+		}
+	}
+	return nil
+}
+
+func (s *Site) set(field, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	switch field {
+	case "attempts":
+		var attempts uint64
+		attempts, err = strconv.ParseUint(value, 10, 32)
+		s.policy.Attempts = uint(attempts)
+	case "base-delay":
+		s.policy.BaseDelay, err = time.ParseDuration(value)
+	case "max-delay":
+		s.policy.MaxDelay, err = time.ParseDuration(value)
+	case "jitter":
+		s.policy.Jitter, err = strconv.ParseFloat(value, 64)
+		if err == nil && (s.policy.Jitter < 0 || s.policy.Jitter > 1) {
+			err = errors.New("jitter must be between 0 and 1")
+		}
+	case "deadline":
+		s.policy.Deadline, err = time.ParseDuration(value)
+	case "max-sleep":
+		s.policy.MaxSleep, err = time.ParseDuration(value)
+	default:
+		err = errors.Errorf("unknown field %q", field)
+	}
+	return errors.Trace(err)
+}
+
+// Policy returns the current policy of the call site.
+func (s *Site) Policy() Policy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.policy
+}
+
+// Retry calls fn until it succeeds, or the error should not be retried.
+func (s *Site) Retry(ctx context.Context, classify Classifier, fn func() error) error {
+	bo := s.NewBackoffer(ctx, classify)
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if err = bo.Backoff(err); err != nil {
+			return err
+		}
+	}
+}
+
+// Backoffer backs off the retries of a call.
+type Backoffer struct {
+	ctx      context.Context
+	site     *Site
+	policy   Policy
+	classify Classifier
+
+	start   time.Time
+	attempt uint
+	delay   time.Duration
+	slept   time.Duration
+}
+
+// NewBackoffer returns a Backoffer with the current policy of the call site.
+func (s *Site) NewBackoffer(ctx context.Context, classify Classifier) *Backoffer {
+	if classify == nil {
+		classify = AlwaysRetry
+	}
+	return &Backoffer{
+		ctx:      ctx,
+		site:     s,
+		policy:   s.Policy(),
+		classify: classify,
+		start:    time.Now(),
+	}
+}
+
+// Backoff waits before the call is retried. It returns the error if the call
+// should not be retried.
+func (b *Backoffer) Backoff(err error) error {
+	class := b.classify(err)
+	if b.ctx.Err() != nil {
+		class = Fatal
+	}
+	var delay time.Duration
+	switch class {
+	case Retryable:
+		if b.delay == 0 {
+			b.delay = b.policy.BaseDelay
+		} else {
+			b.delay *= 2
+		}
+		if b.policy.MaxDelay > 0 && b.delay > b.policy.MaxDelay {
+			b.delay = b.policy.MaxDelay
+		}
+		delay = b.delay
+	case RegionError:
+		delay = b.policy.BaseDelay
+	}
+	return b.backoff(err, class, delay)
+}
+
+// BackoffFor waits for the given delay before the call is retried, the delay
+// is limited by the policy too. It returns the error if the call should not
+// be retried.
+func (b *Backoffer) BackoffFor(err error, delay time.Duration) error {
+	class := b.classify(err)
+	if b.ctx.Err() != nil {
+		class = Fatal
+	}
+	if b.policy.MaxDelay > 0 && delay > b.policy.MaxDelay {
+		delay = b.policy.MaxDelay
+	}
+	return b.backoff(err, class, delay)
+}
+
+func (b *Backoffer) backoff(err error, class ErrorClass, delay time.Duration) error {
+	b.attempt++
+	if class == Fatal {
+		return err
+	}
+	if b.policy.Attempts > 0 && b.attempt >= b.policy.Attempts {
+		b.giveUp(err, class, "too many attempts")
+		return err
+	}
+	if b.policy.Jitter > 0 && delay > 0 {
+		jitter := time.Duration(b.policy.Jitter * float64(delay))
+		delay += time.Duration(rand.Int63n(int64(2*jitter)+1)) - jitter
+	}
+	if b.policy.Deadline > 0 && time.Since(b.start)+delay > b.policy.Deadline {
+		b.giveUp(err, class, "deadline exceeded")
+		return err
+	}
+	if b.policy.MaxSleep > 0 && b.slept+delay > b.policy.MaxSleep {
+		b.giveUp(err, class, "max sleep exceeded")
+		return err
+	}
+	log.Warn("retry",
+		zap.String("site", b.site.name),
+		zap.Uint("attempt", b.attempt),
+		zap.Stringer("class", class),
+		zap.Duration("delay", delay),
+		zap.Error(err))
+	retryCounters.WithLabelValues(b.site.name, class.String()).Inc()
+	if delay <= 0 {
+		return nil
+	}
+	b.slept += delay
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-b.ctx.Done():
+		return errors.Trace(b.ctx.Err())
+	}
+}
+
+func (b *Backoffer) giveUp(err error, class ErrorClass, reason string) {
+	log.Warn("give up retrying",
+		zap.String("site", b.site.name),
+		zap.Uint("attempt", b.attempt),
+		zap.Stringer("class", class),
+		zap.String("reason", reason),
+		zap.Error(err))
+	giveUpCounters.WithLabelValues(b.site.name).Inc()
+}
@@ -0,0 +1,166 @@
+package backoff
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+)
+
+func TestT(t *testing.T) {
+	TestingT(t)
+}
+
+type testBackoffSuite struct{}
+
+var _ = Suite(&testBackoffSuite{})
+
+var (
+	errFatal  = errors.New("fatal")
+	errRegion = errors.New("region")
+
+	retrySite     = Register("test-retry", Policy{Attempts: 3, BaseDelay: time.Millisecond})
+	backofferSite = Register("test-backoffer", Policy{BaseDelay: 10 * time.Millisecond, MaxDelay: 40 * time.Millisecond})
+	deadlineSite  = Register("test-deadline", Policy{BaseDelay: 20 * time.Millisecond, Deadline: 50 * time.Millisecond})
+	maxSleepSite  = Register("test-max-sleep", Policy{BaseDelay: 20 * time.Millisecond, MaxSleep: 50 * time.Millisecond})
+	configureSite = Register("test-configure", Policy{Attempts: 1})
+)
+
+func classify(err error) ErrorClass {
+	switch errors.Cause(err) {
+	case errFatal:
+		return Fatal
+	case errRegion:
+		return RegionError
+	default:
+		return Retryable
+	}
+}
+
+func (r *testBackoffSuite) TestRetry(c *C) {
+	site := retrySite
+	ctx := context.Background()
+
+	calls := 0
+	err := site.Retry(ctx, classify, func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("retry")
+		}
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(calls, Equals, 3)
+
+	calls = 0
+	err = site.Retry(ctx, classify, func() error {
+		calls++
+		return errors.Errorf("attempt %d", calls)
+	})
+	c.Assert(err, ErrorMatches, "attempt 3")
+	c.Assert(calls, Equals, 3)
+
+	// Fatal errors are not retried.
+	calls = 0
+	err = site.Retry(ctx, classify, func() error {
+		calls++
+		return errFatal
+	})
+	c.Assert(err, Equals, errFatal)
+	c.Assert(calls, Equals, 1)
+
+	// Canceled calls are not retried.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	calls = 0
+	err = site.Retry(cancelCtx, classify, func() error {
+		calls++
+		cancel()
+		return errors.New("retry")
+	})
+	c.Assert(err, ErrorMatches, "retry")
+	c.Assert(calls, Equals, 1)
+}
+
+func (r *testBackoffSuite) TestBackoffer(c *C) {
+	site := backofferSite
+	bo := site.NewBackoffer(context.Background(), classify)
+	delays := make([]time.Duration, 0)
+	for _, err := range []error{errors.New("retry"), errors.New("retry"), errRegion, errors.New("retry"), errors.New("retry")} {
+		start := time.Now()
+		c.Assert(bo.Backoff(err), IsNil)
+		delays = append(delays, time.Since(start))
+	}
+	// Retryable errors back off exponentially, region errors wait for the
+	// base delay.
+	expected := []time.Duration{10, 20, 10, 40, 40}
+	for i, d := range delays {
+		c.Assert(d >= expected[i]*time.Millisecond, IsTrue, Commentf("delay %d: %s", i, d))
+		c.Assert(d < (expected[i]+30)*time.Millisecond, IsTrue, Commentf("delay %d: %s", i, d))
+	}
+
+	// The delay is limited by the max delay.
+	start := time.Now()
+	c.Assert(bo.BackoffFor(errors.New("retry"), time.Hour), IsNil)
+	c.Assert(time.Since(start) < time.Second, IsTrue)
+}
+
+func (r *testBackoffSuite) TestDeadline(c *C) {
+	site := deadlineSite
+	calls := 0
+	start := time.Now()
+	err := site.Retry(context.Background(), classify, func() error {
+		calls++
+		return errors.New("retry")
+	})
+	c.Assert(err, ErrorMatches, "retry")
+	// 20ms + 40ms exceeds the deadline.
+	c.Assert(calls, Equals, 2)
+	c.Assert(time.Since(start) < 50*time.Millisecond, IsTrue)
+}
+
+func (r *testBackoffSuite) TestMaxSleep(c *C) {
+	site := maxSleepSite
+	calls := 0
+	err := site.Retry(context.Background(), classify, func() error {
+		calls++
+		// The time of the calls does not count.
+		time.Sleep(30 * time.Millisecond)
+		if calls < 3 {
+			return errRegion
+		}
+		return errors.New("retry")
+	})
+	c.Assert(err, ErrorMatches, "retry")
+	// 20ms + 20ms for the region errors, another 20ms exceeds the max sleep.
+	c.Assert(calls, Equals, 3)
+}
+
+func (r *testBackoffSuite) TestConfigure(c *C) {
+	site := configureSite
+	err := Configure([]string{
+		"test-configure.attempts=10",
+		"test-configure.base-delay=1s",
+		"test-configure.max-delay=1m",
+		"test-configure.jitter=0.5",
+		"test-configure.deadline=1h",
+		"test-configure.max-sleep=2m",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(site.Policy(), DeepEquals, Policy{
+		Attempts:  10,
+		BaseDelay: time.Second,
+		MaxDelay:  time.Minute,
+		Jitter:    0.5,
+		Deadline:  time.Hour,
+		MaxSleep:  2 * time.Minute,
+	})
+
+	c.Assert(Configure([]string{"test-configure"}), ErrorMatches, "invalid backoff setting.*")
+	c.Assert(Configure([]string{"unknown.attempts=1"}), ErrorMatches, `unknown backoff site "unknown".*`)
+	c.Assert(Configure([]string{"test-configure.foo=1"}), ErrorMatches, `.*unknown field "foo"`)
+	c.Assert(Configure([]string{"test-configure.jitter=2"}), ErrorMatches, ".*jitter must be between 0 and 1")
+	c.Assert(Configure([]string{"test-configure.attempts=x"}), NotNil)
+	c.Assert(Sites(), DeepEquals, []string{"test-backoffer", "test-configure", "test-deadline", "test-max-sleep", "test-retry"})
+}
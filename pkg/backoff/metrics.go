@@ -0,0 +1,28 @@
+package backoff
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	retryCounters = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "br",
+			Subsystem: "backoff",
+			Name:      "retry_total",
+			Help:      "Counter of retries by call site and error class.",
+		}, []string{"site", "class"})
+
+	giveUpCounters = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "br",
+			Subsystem: "backoff",
+			Name:      "give_up_total",
+			Help:      "Counter of calls which fail after retrying.",
+		}, []string{"site"})
+)
+
+func init() {
+	prometheus.MustRegister(retryCounters)
+	prometheus.MustRegister(giveUpCounters)
+}
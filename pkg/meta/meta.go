@@ -2,6 +2,7 @@ package meta
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,7 +10,6 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/pingcap/errors"
@@ -17,17 +17,23 @@ import (
 	"github.com/pingcap/kvproto/pkg/tikvpb"
 	"github.com/pingcap/log"
 	pd "github.com/pingcap/pd/client"
+	"github.com/pingcap/tidb/config"
 	"github.com/pingcap/tidb/store/tikv"
 	"github.com/pingcap/tidb/store/tikv/oracle"
 	"go.uber.org/zap"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/pingcap/br/pkg/utils"
 )
 
 const (
-	dialTimeout          = 5 * time.Second
+	// backupConnsPerStore is the number of connections to every store,
+	// backup sends only one streaming request to a store at a time.
+	backupConnsPerStore  = 1
 	clusterVersionPrefix = "pd/api/v1/config/cluster-version"
 	regionCountPrefix    = "pd/api/v1/regions/count"
+	regionStatsPrefix    = "pd/api/v1/stats/region"
 )
 
 // Backer backups a TiDB/TiKV cluster.
@@ -43,15 +49,12 @@ type Backer struct {
 		addrs []string
 		cli   *http.Client
 	}
-	tikvCli  tikv.Storage
-	grpcClis struct {
-		mu   sync.Mutex
-		clis map[uint64]*grpc.ClientConn
-	}
+	tikvCli tikv.Storage
+	conns   *utils.StoreConns
 }
 
 var pdGet = func(addr string, prefix string, cli *http.Client) ([]byte, error) {
-	if addr != "" && !strings.HasPrefix("http", addr) {
+	if addr != "" && !strings.Contains(addr, "://") {
 		addr = "http://" + addr
 	}
 	u, err := url.Parse(addr)
@@ -80,13 +83,36 @@ var pdGet = func(addr string, prefix string, cli *http.Client) ([]byte, error) {
 	return r, nil
 }
 
+// newPDHTTP returns the client and the URLs of the HTTP API of PD, which is
+// served by https if TLS is enabled.
+func newPDHTTP(addrs []string, tlsConf *tls.Config) (*http.Client, []string) {
+	cli := &http.Client{Timeout: 30 * time.Second}
+	scheme := "http"
+	if tlsConf != nil {
+		cli.Transport = &http.Transport{TLSClientConfig: tlsConf}
+		scheme = "https"
+	}
+	urls := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if !strings.Contains(addr, "://") {
+			addr = scheme + "://" + addr
+		}
+		urls = append(urls, addr)
+	}
+	return cli, urls
+}
+
 // NewBacker creates a new Backer.
-func NewBacker(ctx context.Context, pdAddrs string) (*Backer, error) {
+func NewBacker(ctx context.Context, pdAddrs string, security utils.SecurityConfig) (*Backer, error) {
+	tlsConf, err := security.ToTLSConfig()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
 	addrs := strings.Split(pdAddrs, ",")
+	cli, httpAddrs := newPDHTTP(addrs, tlsConf)
 
 	failure := errors.Errorf("pd address (%s) has wrong format", pdAddrs)
-	cli := &http.Client{Timeout: 30 * time.Second}
-	for _, addr := range addrs {
+	for _, addr := range httpAddrs {
 		_, failure = pdGet(addr, clusterVersionPrefix, cli)
 		// TODO need check cluster version >= 3.1 when br release
 		if failure == nil {
@@ -97,11 +123,21 @@ func NewBacker(ctx context.Context, pdAddrs string) (*Backer, error) {
 		return nil, errors.Annotatef(failure, "pd address (%s) not available, please check network", pdAddrs)
 	}
 
-	pdClient, err := pd.NewClient(addrs, pd.SecurityOption{})
+	pdClient, err := pd.NewClient(addrs, pd.SecurityOption{
+		CAPath:   security.CA,
+		CertPath: security.Cert,
+		KeyPath:  security.Key,
+	})
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 	log.Info("new backer", zap.String("pdAddrs", pdAddrs))
+	// The tikv driver reads the certificates from the global config of TiDB.
+	conf := *config.GetGlobalConfig()
+	conf.Security.ClusterSSLCA = security.CA
+	conf.Security.ClusterSSLCert = security.Cert
+	conf.Security.ClusterSSLKey = security.Key
+	config.StoreGlobalConfig(&conf)
 	tikvCli, err := tikv.Driver{}.Open(
 		// Disable GC because TiDB enables GC already.
 		fmt.Sprintf("tikv://%s?disableGC=true", pdAddrs))
@@ -114,13 +150,19 @@ func NewBacker(ctx context.Context, pdAddrs string) (*Backer, error) {
 		PDClient: pdClient,
 		tikvCli:  tikvCli.(tikv.Storage),
 	}
-	backer.pdHTTP.addrs = addrs
+	backer.pdHTTP.addrs = httpAddrs
 	backer.pdHTTP.cli = cli
-	backer.grpcClis.clis = make(map[uint64]*grpc.ClientConn)
+	backer.conns = utils.NewStoreConns(ctx, pdClient, tlsConf, backupConnsPerStore)
 	backer.PDHTTPGet = pdGet
 	return backer, nil
 }
 
+// PDHTTPClient returns the client and the URLs of the HTTP API of PD, which
+// use TLS if it is enabled.
+func (backer *Backer) PDHTTPClient() (*http.Client, []string) {
+	return backer.pdHTTP.cli, backer.pdHTTP.addrs
+}
+
 // SetPDHTTP set pd addrs and cli for test
 func (backer *Backer) SetPDHTTP(addrs []string, cli *http.Client) {
 	backer.pdHTTP.addrs = addrs
@@ -161,6 +203,35 @@ func (backer *Backer) GetRegionCount() (int, error) {
 	return 0, err
 }
 
+// RegionStats is the approximate statistics of the regions in a key range.
+type RegionStats struct {
+	Count int `json:"count"`
+	// StorageSize is the approximate size in MiB.
+	StorageSize int64 `json:"storage_size"`
+	StorageKeys int64 `json:"storage_keys"`
+}
+
+// GetRegionStats returns the statistics of the regions in [startKey, endKey),
+// the keys are encoded as the region keys, an empty endKey means no limit.
+func (backer *Backer) GetRegionStats(startKey, endKey []byte) (*RegionStats, error) {
+	prefix := fmt.Sprintf("%s?start_key=%s&end_key=%s", regionStatsPrefix,
+		url.QueryEscape(string(startKey)), url.QueryEscape(string(endKey)))
+	var err error
+	for _, addr := range backer.pdHTTP.addrs {
+		v, e := backer.PDHTTPGet(addr, prefix, backer.pdHTTP.cli)
+		if e != nil {
+			err = e
+			continue
+		}
+		stats := &RegionStats{}
+		if err = json.Unmarshal(v, stats); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return stats, nil
+	}
+	return nil, err
+}
+
 // GetGCSafePoint returns the current gc safe point.
 // TODO: Some cluster may not enable distributed GC.
 func (backer *Backer) GetGCSafePoint(ctx context.Context) (Timestamp, error) {
@@ -171,51 +242,17 @@ func (backer *Backer) GetGCSafePoint(ctx context.Context) (Timestamp, error) {
 	return DecodeTs(safePoint), nil
 }
 
+// ErrStoreUnavailable is returned if a store can not be reached.
+var ErrStoreUnavailable = errors.New("store unavailable")
+
 // Context returns Backer's context.
 func (backer *Backer) Context() context.Context {
 	return backer.Ctx
 }
 
-func (backer *Backer) getGrpcConnLocked(storeID uint64) (*grpc.ClientConn, error) {
-	store, err := backer.PDClient.GetStore(backer.Ctx, storeID)
-	if err != nil {
-		return nil, errors.Trace(err)
-	}
-	opt := grpc.WithInsecure()
-	ctx, cancel := context.WithTimeout(backer.Ctx, dialTimeout)
-	keepAlive := 10
-	keepAliveTimeout := 3
-	conn, err := grpc.DialContext(
-		ctx,
-		store.GetAddress(),
-		opt,
-		grpc.WithBackoffMaxDelay(time.Second*3),
-		grpc.WithKeepaliveParams(keepalive.ClientParameters{
-			Time:                time.Duration(keepAlive) * time.Second,
-			Timeout:             time.Duration(keepAliveTimeout) * time.Second,
-			PermitWithoutStream: true,
-		}),
-	)
-	cancel()
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
-	// Cache the conn.
-	backer.grpcClis.clis[storeID] = conn
-	return conn, nil
-}
-
 // GetBackupClient get or create a backup client.
 func (backer *Backer) GetBackupClient(storeID uint64) (backup.BackupClient, error) {
-	backer.grpcClis.mu.Lock()
-	defer backer.grpcClis.mu.Unlock()
-
-	if conn, ok := backer.grpcClis.clis[storeID]; ok {
-		// Find a cached backup client.
-		return backup.NewBackupClient(conn), nil
-	}
-
-	conn, err := backer.getGrpcConnLocked(storeID)
+	conn, err := backer.conns.GetConn(storeID)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -224,33 +261,34 @@ func (backer *Backer) GetBackupClient(storeID uint64) (backup.BackupClient, erro
 
 // GetTikvClient get or create a coprocessor client.
 func (backer *Backer) GetTikvClient(storeID uint64) (tikvpb.TikvClient, error) {
-	backer.grpcClis.mu.Lock()
-	defer backer.grpcClis.mu.Unlock()
-
-	if conn, ok := backer.grpcClis.clis[storeID]; ok {
-		// Find a cached backup client.
-		return tikvpb.NewTikvClient(conn), nil
-	}
-
-	conn, err := backer.getGrpcConnLocked(storeID)
+	conn, err := backer.conns.GetConn(storeID)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 	return tikvpb.NewTikvClient(conn), nil
 }
 
+func (backer *Backer) resetBackupClient(storeID uint64) {
+	if err := backer.ResetGrpcClient(storeID); err != nil {
+		log.Warn("fail to reset backup client",
+			zap.Uint64("StoreID", storeID),
+			zap.Error(err))
+	}
+}
+
 // ResetGrpcClient reset and close cached backup client.
 func (backer *Backer) ResetGrpcClient(storeID uint64) error {
-	backer.grpcClis.mu.Lock()
-	defer backer.grpcClis.mu.Unlock()
+	return backer.conns.ResetConns(storeID)
+}
 
-	if conn, ok := backer.grpcClis.clis[storeID]; ok {
-		delete(backer.grpcClis.clis, storeID)
-		if err := conn.Close(); err != nil {
-			return errors.Trace(err)
-		}
-	}
-	return nil
+// GetStoreConns returns the connections to the stores.
+func (backer *Backer) GetStoreConns() *utils.StoreConns {
+	return backer.conns
+}
+
+// Close closes the connections to the stores.
+func (backer *Backer) Close() {
+	backer.conns.Close()
 }
 
 // CheckGCSafepoint spawns a goroutine and checks whether the ts is older
@@ -270,6 +308,7 @@ func (backer *Backer) CheckGCSafepoint(ctx context.Context, ts uint64) error {
 
 // SendBackup send backup request to the given store.
 // Stop receiving response if respFn returns error.
+// It returns ErrStoreUnavailable if the store can not be reached.
 func (backer *Backer) SendBackup(
 	ctx context.Context,
 	storeID uint64,
@@ -280,19 +319,15 @@ func (backer *Backer) SendBackup(
 	client, err := backer.GetBackupClient(storeID)
 	if err != nil {
 		log.Warn("fail to connect store", zap.Uint64("StoreID", storeID))
-		return nil
+		return errors.Annotatef(ErrStoreUnavailable, "connect store %d: %v", storeID, err)
 	}
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	bcli, err := client.Backup(ctx, &req)
 	if err != nil {
 		log.Warn("fail to create backup", zap.Uint64("StoreID", storeID))
-		if err1 := backer.ResetGrpcClient(storeID); err1 != nil {
-			log.Warn("fail to reset backup client",
-				zap.Uint64("StoreID", storeID),
-				zap.Error(err1))
-		}
-		return nil
+		backer.resetBackupClient(storeID)
+		return errors.Annotatef(ErrStoreUnavailable, "create backup on store %d: %v", storeID, err)
 	}
 	for {
 		resp, err := bcli.Recv()
@@ -302,6 +337,10 @@ func (backer *Backer) SendBackup(
 					zap.Uint64("StoreID", storeID))
 				break
 			}
+			if status.Code(err) == codes.Unavailable {
+				backer.resetBackupClient(storeID)
+				return errors.Annotatef(ErrStoreUnavailable, "receive from store %d: %v", storeID, err)
+			}
 			return errors.Trace(err)
 		}
 		// TODO: handle errors in the resp.
@@ -326,6 +365,11 @@ func (backer *Backer) GetTiKV() tikv.Storage {
 	return backer.tikvCli
 }
 
+// SetTiKV set tikv storage for test
+func (backer *Backer) SetTiKV(tikvCli tikv.Storage) {
+	backer.tikvCli = tikvCli
+}
+
 // GetLockResolver gets the LockResolver.
 func (backer *Backer) GetLockResolver() *tikv.LockResolver {
 	return backer.tikvCli.GetLockResolver()
@@ -353,3 +397,22 @@ func DecodeTs(ts uint64) Timestamp {
 func EncodeTs(tp Timestamp) uint64 {
 	return uint64((tp.Physical << physicalShiftBits) + tp.Logical)
 }
+
+// ParseDatetime parses a datetime in RFC3339 or "2006-01-02 15:04:05"
+// (local time) and encodes it into a ts.
+func ParseDatetime(s string) (uint64, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		var err1 error
+		t, err1 = time.ParseInLocation("2006-01-02 15:04:05", s, time.Local)
+		if err1 != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+	if t.Before(time.Unix(0, 0)) {
+		return 0, errors.Errorf("datetime %s is before the epoch", s)
+	}
+	return EncodeTs(Timestamp{
+		Physical: t.UnixNano() / int64(time.Millisecond),
+	}), nil
+}
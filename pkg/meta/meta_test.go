@@ -2,8 +2,11 @@ package meta
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
@@ -16,6 +19,8 @@ import (
 	"github.com/pingcap/pd/pkg/mock/mockid"
 	"github.com/pingcap/pd/server"
 	"google.golang.org/grpc"
+
+	"github.com/pingcap/br/pkg/utils"
 )
 
 func TestT(t *testing.T) {
@@ -34,6 +39,49 @@ func TestTimestampEncodeDecode(t *testing.T) {
 	}
 }
 
+func TestParseDatetime(t *testing.T) {
+	ts, err := ParseDatetime("2020-02-20T12:00:00.5+08:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tp := DecodeTs(ts); tp.Physical != 1582171200500 || tp.Logical != 0 {
+		t.Fatalf("unexpected %+v", tp)
+	}
+	for _, s := range []string{"", "2020-02-20", "1969-12-31T00:00:00Z"} {
+		if _, err = ParseDatetime(s); err == nil {
+			t.Fatalf("%q should be invalid", s)
+		}
+	}
+}
+
+func TestPDHTTPWithTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+	certPool := x509.NewCertPool()
+	certPool.AddCert(srv.Certificate())
+	addr := strings.TrimPrefix(srv.URL, "https://")
+
+	cli, urls := newPDHTTP([]string{addr}, &tls.Config{RootCAs: certPool})
+	if urls[0] != srv.URL {
+		t.Fatalf("unexpected url %s", urls[0])
+	}
+	resp, err := pdGet(urls[0], clusterVersionPrefix, cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "/"+clusterVersionPrefix {
+		t.Fatalf("unexpected response %s", resp)
+	}
+
+	// The plain http client is rejected.
+	cli, urls = newPDHTTP([]string{addr}, nil)
+	if _, err = pdGet(urls[0], clusterVersionPrefix, cli); err == nil {
+		t.Fatal("http should be rejected by the tls server")
+	}
+}
+
 func TestClient(t *testing.T) {
 	server.EnableZap = true
 	TestingT(t)
@@ -90,6 +138,7 @@ type testClientSuite struct {
 
 	srv    *server.Server
 	backer *Backer
+	pdGet  func(string, string, *http.Client) ([]byte, error)
 }
 
 func (s *testClientSuite) SetUpSuite(c *C) {
@@ -118,16 +167,18 @@ func (s *testClientSuite) SetUpSuite(c *C) {
 	}
 
 	// Disable pd connection check.
+	s.pdGet = pdGet
 	pdGet = func(string, string, *http.Client) ([]byte, error) {
 		return []byte{}, nil
 	}
 	s.backer, err = NewBacker(
-		s.ctx, strings.TrimPrefix(s.srv.GetAddr(), "http://"))
+		s.ctx, strings.TrimPrefix(s.srv.GetAddr(), "http://"), utils.SecurityConfig{})
 	c.Assert(err, IsNil)
 }
 
 func (s *testClientSuite) TearDownSuite(c *C) {
 	s.cancel()
+	pdGet = s.pdGet
 
 	s.cleanup()
 }
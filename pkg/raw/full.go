@@ -1,14 +1,16 @@
 package raw
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/gogo/protobuf/proto"
 	"github.com/google/btree"
 	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/backup"
@@ -18,6 +20,7 @@ import (
 	pd "github.com/pingcap/pd/client"
 	"github.com/pingcap/tidb/ddl"
 	"github.com/pingcap/tidb/domain"
+	"github.com/pingcap/tidb/kv"
 	"github.com/pingcap/tidb/meta/autoid"
 	"github.com/pingcap/tidb/session"
 	"github.com/pingcap/tidb/store/tikv"
@@ -26,6 +29,7 @@ import (
 	"github.com/pingcap/tidb/util/sqlexec"
 	"go.uber.org/zap"
 
+	"github.com/pingcap/br/pkg/backoff"
 	"github.com/pingcap/br/pkg/meta"
 	"github.com/pingcap/br/pkg/utils"
 )
@@ -33,6 +37,26 @@ import (
 // Maximum total sleep time(in ms) for kv/cop commands.
 const (
 	backupFineGrainedMaxBackoff = 80000
+	// leaderBackoffMs is the time to wait for a region to elect a leader.
+	leaderBackoffMs = 1000
+	// defaultFineGrainedConcurrency is the number of concurrent requests of
+	// fine grained backup.
+	defaultFineGrainedConcurrency = 16
+	// defaultRangeConcurrency is the number of ranges backed up concurrently.
+	defaultRangeConcurrency = 8
+	// defaultChecksumConcurrency is the number of tables checksummed
+	// concurrently.
+	defaultChecksumConcurrency = 4
+)
+
+var (
+	// fineGrainedBackupBackoff waits for the locks and the region errors of
+	// the incomplete ranges. Only the sleep time is limited, the fine grained
+	// backup itself may take much longer.
+	fineGrainedBackupBackoff = backoff.Register("fine-grained-backup", backoff.Policy{
+		MaxDelay: 3 * time.Second,
+		MaxSleep: backupFineGrainedMaxBackoff * time.Millisecond,
+	})
 )
 
 // BackupClient is a client instructs TiKV how to do a backup.
@@ -46,8 +70,21 @@ type BackupClient struct {
 	dom       *domain.Domain
 
 	backupMeta    backup.BackupMeta
+	backupExtMeta utils.BackupExtMeta
 	backupSchemas backupSchemas
 	storage       utils.ExternalStorage
+	// fineGrainedConcurrency is the number of concurrent requests of fine
+	// grained backup.
+	fineGrainedConcurrency uint
+	// rangeConcurrency is the number of ranges backed up concurrently.
+	rangeConcurrency uint
+	// checksum enables the admin checksum from TiDB, which runs with
+	// checksumConcurrency sessions during the backup.
+	checksum            bool
+	checksumConcurrency uint
+	// dryRun prepares the backup without writing anything to the storage.
+	dryRun     bool
+	sendBackup backupSender
 }
 
 // NewBackupClient returns a new backup client
@@ -55,11 +92,6 @@ func NewBackupClient(backer *meta.Backer) (*BackupClient, error) {
 	log.Info("new backup client")
 	ctx, cancel := context.WithCancel(backer.Context())
 	pdClient := backer.GetPDClient()
-	stores, err := pdClient.GetAllStores(ctx)
-	if err != nil {
-		cancel()
-		return nil, errors.Trace(err)
-	}
 	// Do not run ddl worker in BR.
 	ddl.RunWorker = false
 	// Do not run stat worker in BR.
@@ -69,10 +101,6 @@ func NewBackupClient(backer *meta.Backer) (*BackupClient, error) {
 		cancel()
 		return nil, errors.Trace(err)
 	}
-	poolSize := uint(len(stores) * 8)
-	if poolSize > 100 {
-		poolSize = 100
-	}
 	return &BackupClient{
 		clusterID: pdClient.GetClusterID(ctx),
 		backer:    backer,
@@ -80,20 +108,51 @@ func NewBackupClient(backer *meta.Backer) (*BackupClient, error) {
 		cancel:    cancel,
 		pdClient:  backer.GetPDClient(),
 		dom:       dom,
-		backupSchemas: backupSchemas{
-			meta:       make(map[string]*backup.Schema),
-			checksumCh: make(chan *tableChecksum),
-			errCh:      make(chan error),
-			wg:         sync.WaitGroup{},
-			workerPool: utils.NewWorkerPool(poolSize, "restore"),
+
+		fineGrainedConcurrency: defaultFineGrainedConcurrency,
+		rangeConcurrency:       defaultRangeConcurrency,
+		checksum:               true,
+		checksumConcurrency:    defaultChecksumConcurrency,
+		sendBackup:             backer.SendBackup,
+		backupExtMeta: utils.BackupExtMeta{
+			Type:   utils.FullBackup,
+			Verify: utils.VerifySkipped,
 		},
 	}, nil
 }
 
+// SetFineGrainedConcurrency sets the number of concurrent requests of fine
+// grained backup.
+func (bc *BackupClient) SetFineGrainedConcurrency(concurrency uint) {
+	bc.fineGrainedConcurrency = concurrency
+}
+
+// SetRangeConcurrency sets the number of ranges backed up concurrently.
+func (bc *BackupClient) SetRangeConcurrency(concurrency uint) {
+	bc.rangeConcurrency = concurrency
+}
+
+// SetChecksum enables or disables the admin checksum from TiDB.
+func (bc *BackupClient) SetChecksum(enabled bool) {
+	bc.checksum = enabled
+}
+
+// SetChecksumConcurrency sets the number of tables checksummed concurrently.
+func (bc *BackupClient) SetChecksumConcurrency(concurrency uint) {
+	bc.checksumConcurrency = concurrency
+}
+
+// SetDryRun makes the client prepare the backup without writing anything to
+// the storage, it is used to plan a backup.
+func (bc *BackupClient) SetDryRun(dryRun bool) {
+	bc.dryRun = dryRun
+}
+
 // Close a backup client
 func (bc *BackupClient) Close() {
 	bc.dom.Close()
 	bc.cancel()
+	bc.backer.Close()
 }
 
 // GetTS returns the latest timestamp.
@@ -120,6 +179,9 @@ func (bc *BackupClient) GetTS(timeAgo string) (uint64, error) {
 			return 0, errors.New("given backup time exceed GCSafePoint")
 		}
 		p -= t
+		bc.backupExtMeta.BackupTSForm = utils.BackupTSTimeAgo
+	} else {
+		bc.backupExtMeta.BackupTSForm = utils.BackupTSNow
 	}
 
 	ts := meta.Timestamp{
@@ -131,13 +193,61 @@ func (bc *BackupClient) GetTS(timeAgo string) (uint64, error) {
 	return backupTS, nil
 }
 
-// SetStorage set ExternalStorage for client
-func (bc *BackupClient) SetStorage(base string) error {
-	var err error
-	bc.storage, err = utils.CreateStorage(base)
+// ParseBackupTS parses the backup ts given by user. It accepts a TSO, a
+// datetime in RFC3339 or "2006-01-02 15:04:05" (local time), optionally
+// prefixed by "tso:" or "time:".
+func ParseBackupTS(s string) (uint64, utils.BackupTSForm, error) {
+	switch {
+	case strings.HasPrefix(s, "tso:"):
+		ts, err := strconv.ParseUint(strings.TrimPrefix(s, "tso:"), 10, 64)
+		if err != nil {
+			return 0, "", errors.Annotatef(err, "invalid backup ts %s", s)
+		}
+		return ts, utils.BackupTSTSO, nil
+	case strings.HasPrefix(s, "time:"):
+		ts, err := meta.ParseDatetime(strings.TrimPrefix(s, "time:"))
+		if err != nil {
+			return 0, "", errors.Annotatef(err, "invalid backup ts %s", s)
+		}
+		return ts, utils.BackupTSTime, nil
+	}
+	if ts, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return ts, utils.BackupTSTSO, nil
+	}
+	ts, err := meta.ParseDatetime(s)
 	if err != nil {
-		return err
+		return 0, "", errors.Errorf("invalid backup ts %s, expect a TSO or a datetime", s)
+	}
+	return ts, utils.BackupTSTime, nil
+}
+
+// GetBackupTS parses the backup ts given by user and checks it is newer
+// than the GC safepoint and not in the future.
+func (bc *BackupClient) GetBackupTS(backupTS string) (uint64, error) {
+	ts, form, err := ParseBackupTS(backupTS)
+	if err != nil {
+		return 0, err
+	}
+	p, l, err := bc.pdClient.GetTS(bc.ctx)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	currentTS := meta.EncodeTs(meta.Timestamp{Physical: p, Logical: l})
+	if ts > currentTS {
+		return 0, errors.Errorf("backup ts %d is newer than the current ts %d", ts, currentTS)
+	}
+	if err = bc.backer.CheckGCSafepoint(bc.ctx, ts); err != nil {
+		return 0, errors.Trace(err)
 	}
+	bc.backupExtMeta.BackupTSForm = form
+	log.Info("backup specified timestamp",
+		zap.Uint64("BackupTS", ts), zap.String("form", string(form)))
+	return ts, nil
+}
+
+// SetStorage set ExternalStorage for client
+func (bc *BackupClient) SetStorage(storage utils.ExternalStorage) error {
+	bc.storage = storage
 	// backupmeta already exists
 	if exist := bc.storage.FileExists(utils.MetaFile); exist {
 		return errors.New("backup meta exists, may be some backup files in the path already")
@@ -148,26 +258,22 @@ func (bc *BackupClient) SetStorage(base string) error {
 // SaveBackupMeta saves the current backup meta at the given path.
 func (bc *BackupClient) SaveBackupMeta(path string) error {
 	bc.backupMeta.Path = path
-	backupMetaData, err := proto.Marshal(&bc.backupMeta)
-	if err != nil {
-		return errors.Trace(err)
-	}
 	log.Debug("backup meta",
 		zap.Reflect("meta", bc.backupMeta))
 	log.Info("save backup meta", zap.String("path", path))
-	return bc.storage.Write(utils.MetaFile, backupMetaData)
+	err := utils.SaveBackupExtMeta(bc.storage, &bc.backupExtMeta)
+	if err != nil {
+		return err
+	}
+	return utils.WriteBackupMeta(bc.storage, &bc.backupMeta)
 }
 
-// PreBackupTableRanges gets the range of table and request admin checksum from TiDB.
+// PreBackupTableRanges gets the range of table.
 func (bc *BackupClient) PreBackupTableRanges(
 	dbName, tableName string,
 	path string,
 	backupTS uint64,
 ) ([]Range, error) {
-	dbSession, err := session.CreateSession(bc.backer.GetTiKV())
-	if err != nil {
-		return nil, errors.Trace(err)
-	}
 	info, err := bc.dom.GetSnapshotInfoSchema(backupTS)
 	if err != nil {
 		return nil, errors.Trace(err)
@@ -186,6 +292,11 @@ func (bc *BackupClient) PreBackupTableRanges(
 		return nil, errors.Trace(err)
 	}
 	tableInfo = table.Meta()
+	bc.backupExtMeta.Type = utils.TableBackup
+	if tableInfo.IsView() {
+		err = bc.backupView(dbInfo, tableInfo)
+		return []Range{}, errors.Trace(err)
+	}
 	idAlloc := autoid.NewAllocator(bc.backer.GetTiKV(), dbInfo.ID, false)
 	globalAutoID, err := idAlloc.NextGlobalAutoID(tableInfo.ID)
 	if err != nil {
@@ -207,11 +318,10 @@ func (bc *BackupClient) PreBackupTableRanges(
 		Db:    dbData,
 		Table: tableData,
 	}
-	// TODO figure out why
-	// must set to true to avoid load global vars, otherwise we got error
-	dbSession.GetSessionVars().CommonGlobalLoaded = true
-	dbSession.GetSessionVars().SnapshotTS = backupTS
-	bc.backupSchemas.startTableChecksum(bc.ctx, dbSession, backupSchema, dbInfo.Name.L, tableInfo.Name.L)
+	bc.backupSchemas.addTable(backupSchema, dbInfo.Name.L, tableInfo)
+	if err = bc.backupTableStats(dbInfo.Name.L, tableInfo, backupTS); err != nil {
+		return nil, errors.Trace(err)
+	}
 
 	log.Info("save table schema",
 		zap.Stringer("db", dbInfo.Name),
@@ -264,27 +374,100 @@ func buildTableRanges(tbl *model.TableInfo) []tableRange {
 	return ranges
 }
 
-// PreBackupAllTableRanges gets the range of all tables and request admin checksum from TiDB.
-func (bc *BackupClient) PreBackupAllTableRanges(backupTS uint64) ([]Range, error) {
+// backupView saves the definition of the view. A view has no data, so
+// there is neither range nor checksum.
+func (bc *BackupClient) backupView(dbInfo *model.DBInfo, viewInfo *model.TableInfo) error {
+	dbData, err := json.Marshal(dbInfo)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	viewData, err := json.Marshal(viewInfo)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	bc.backupSchemas.addSchema(&backup.Schema{
+		Db:    dbData,
+		Table: viewData,
+	}, dbInfo.Name.L, viewInfo.Name.L)
+	return nil
+}
+
+// backupTableStats saves the statistics of the table at backupTS. Tables
+// without statistics are skipped, and so are tables whose statistics can
+// not be dumped, since statistics are not necessary for a restore.
+func (bc *BackupClient) backupTableStats(
+	dbName string, tableInfo *model.TableInfo, backupTS uint64,
+) error {
+	if bc.dryRun {
+		return nil
+	}
+	// Do not share the session with checksum, which runs in background.
+	statsSession, err := session.CreateSession(bc.backer.GetTiKV())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer statsSession.Close()
+	statsSession.GetSessionVars().CommonGlobalLoaded = true
+	statsSession.GetSessionVars().SnapshotTS = backupTS
+	stats, err := bc.dom.StatsHandle().DumpStatsToJSON(
+		dbName, tableInfo, statsSession.(sqlexec.RestrictedSQLExecutor))
+	if err != nil {
+		log.Warn("dump table stats failed, skip it",
+			zap.String("db", dbName),
+			zap.Stringer("table", tableInfo.Name),
+			zap.Error(err))
+		return nil
+	}
+	// A partitioned table always has a JSONTable, check its partitions.
+	if stats == nil || (stats.Partitions != nil && len(stats.Partitions) == 0) {
+		log.Info("table has no stats",
+			zap.String("db", dbName), zap.Stringer("table", tableInfo.Name))
+		return nil
+	}
+	return utils.SaveTableStats(bc.storage, tableInfo.ID, stats)
+}
+
+// PreBackupAllTableRanges gets the range of all tables.
+// System tables are skipped except the given tables in utils.SystemTables.
+func (bc *BackupClient) PreBackupAllTableRanges(
+	backupTS uint64, systemTables []string,
+) ([]Range, error) {
 	SystemDatabases := [3]string{
 		"information_schema",
 		"performance_schema",
-		"mysql",
+		utils.SystemDatabase,
+	}
+	if err := utils.CheckSystemTables(systemTables); err != nil {
+		return nil, err
+	}
+	includeSystemTables := make(map[string]bool)
+	for _, name := range systemTables {
+		includeSystemTables[strings.ToLower(name)] = true
 	}
 
 	info, err := bc.dom.GetSnapshotInfoSchema(backupTS)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	bc.backupExtMeta.Type = utils.FullBackup
 
 	dbInfos := info.AllSchemas()
 	ranges := make([]Range, 0)
 LoadDb:
 	for _, dbInfo := range dbInfos {
+		tableInfos := dbInfo.Tables
 		// skip system databases
 		for _, sysDbName := range SystemDatabases {
 			if sysDbName == dbInfo.Name.L {
-				continue LoadDb
+				if sysDbName != utils.SystemDatabase || len(includeSystemTables) == 0 {
+					continue LoadDb
+				}
+				tableInfos = make([]*model.TableInfo, 0, len(includeSystemTables))
+				for _, tableInfo := range dbInfo.Tables {
+					if includeSystemTables[tableInfo.Name.L] {
+						tableInfos = append(tableInfos, tableInfo)
+					}
+				}
 			}
 		}
 		dbData, err := json.Marshal(dbInfo)
@@ -292,7 +475,13 @@ LoadDb:
 			return nil, errors.Trace(err)
 		}
 		idAlloc := autoid.NewAllocator(bc.backer.GetTiKV(), dbInfo.ID, false)
-		for _, tableInfo := range dbInfo.Tables {
+		for _, tableInfo := range tableInfos {
+			if tableInfo.IsView() {
+				if err = bc.backupView(dbInfo, tableInfo); err != nil {
+					return nil, errors.Trace(err)
+				}
+				continue
+			}
 			globalAutoID, err := idAlloc.NextGlobalAutoID(tableInfo.ID)
 			if err != nil {
 				return nil, errors.Trace(err)
@@ -307,14 +496,10 @@ LoadDb:
 				Db:    dbData,
 				Table: tableData,
 			}
-			dbSession, err := session.CreateSession(bc.backer.GetTiKV())
-			if err != nil {
+			bc.backupSchemas.addTable(backupSchema, dbInfo.Name.L, tableInfo)
+			if err = bc.backupTableStats(dbInfo.Name.L, tableInfo, backupTS); err != nil {
 				return nil, errors.Trace(err)
 			}
-			dbSession.GetSessionVars().CommonGlobalLoaded = true
-			// make FastChecksum snapshot is same as backup snapshot
-			dbSession.GetSessionVars().SnapshotTS = backupTS
-			bc.backupSchemas.startTableChecksum(bc.ctx, dbSession, backupSchema, dbInfo.Name.L, tableInfo.Name.L)
 
 			// TODO: We may need to include [t<tableID>, t<tableID+1>) in order to
 			//       backup global index.
@@ -345,15 +530,30 @@ func (bc *BackupClient) BackupRanges(
 	errCh := make(chan error)
 	ctx, cancel := context.WithCancel(bc.ctx)
 	defer cancel()
+	if bc.checksum {
+		// The admin checksum runs along with the data backup.
+		bc.backupSchemas.startTableChecksum(
+			bc.ctx, bc.backer.GetTiKV(), backupTS, bc.checksumConcurrency)
+	}
 	go func() {
-		for _, r := range ranges {
-			err := bc.backupRange(
-				ctx, r.StartKey, r.EndKey, path, backupTS, rate, concurrency, updateCh)
-			if err != nil {
-				errCh <- err
-				return
-			}
+		results, err1 := bc.backupRangesConcurrently(
+			ctx, mergeRanges(ranges), path, backupTS, rate, concurrency, updateCh)
+		if err1 != nil {
+			errCh <- err1
+			return
 		}
+		bc.backupMeta.StartVersion = backupTS
+		bc.backupMeta.EndVersion = backupTS
+		log.Info("backup time range",
+			zap.Reflect("StartVersion", backupTS),
+			zap.Reflect("EndVersion", backupTS))
+		results.tree.Ascend(func(i btree.Item) bool {
+			r := i.(*Range)
+			bc.backupMeta.Files = append(bc.backupMeta.Files, r.Files...)
+			return true
+		})
+		// Check if there are duplicated files.
+		results.checkDupFiles()
 		close(errCh)
 	}()
 
@@ -387,6 +587,85 @@ func (bc *BackupClient) BackupRanges(
 	}
 }
 
+// mergeRanges sorts the ranges, and merges the overlapped ones. Adjacent
+// ranges are kept apart: TiKV writes a file per region and request range,
+// and restore assigns every file to a single table, so a request must not
+// span the boundary of two tables.
+func mergeRanges(ranges []Range) []Range {
+	if len(ranges) == 0 {
+		return ranges
+	}
+	sorted := make([]Range, 0, len(ranges))
+	for _, rg := range ranges {
+		sorted = append(sorted, Range{StartKey: rg.StartKey, EndKey: rg.EndKey})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].StartKey, sorted[j].StartKey) < 0
+	})
+	merged := sorted[:1]
+	for _, rg := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if len(last.EndKey) == 0 {
+			// The last range reaches the end of the keyspace.
+			break
+		}
+		if bytes.Compare(rg.StartKey, last.EndKey) < 0 {
+			if len(rg.EndKey) == 0 || bytes.Compare(rg.EndKey, last.EndKey) > 0 {
+				last.EndKey = rg.EndKey
+			}
+			continue
+		}
+		merged = append(merged, rg)
+	}
+	return merged
+}
+
+// backupRangesConcurrently backs up the disjoint ranges concurrently, and
+// combines their results. The first error cancels the other ranges.
+func (bc *BackupClient) backupRangesConcurrently(
+	ctx context.Context,
+	ranges []Range,
+	path string,
+	backupTS uint64,
+	rate uint64,
+	concurrency uint32,
+	updateCh chan<- struct{},
+) (RangeTree, error) {
+	log.Info("backup ranges concurrently",
+		zap.Int("ranges", len(ranges)), zap.Uint("concurrency", bc.rangeConcurrency))
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := newRangeTree()
+	var mu sync.Mutex
+	var firstErr error
+	pool := utils.NewWorkerPool(bc.rangeConcurrency, "backup range")
+	wg := sync.WaitGroup{}
+	for _, r := range ranges {
+		if ctx.Err() != nil {
+			break
+		}
+		rg := r
+		wg.Add(1)
+		pool.Apply(func() {
+			defer wg.Done()
+			rangeTree, err := bc.backupRange(
+				ctx, rg.StartKey, rg.EndKey, path, backupTS, rate, concurrency, updateCh)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				return
+			}
+			results.merge(rangeTree)
+		})
+	}
+	wg.Wait()
+	return results, firstErr
+}
+
 // backupRange make a backup of the given key range.
 func (bc *BackupClient) backupRange(
 	ctx context.Context,
@@ -396,7 +675,7 @@ func (bc *BackupClient) backupRange(
 	rateMBs uint64,
 	concurrency uint32,
 	updateCh chan<- struct{},
-) error {
+) (RangeTree, error) {
 	// The unit of rate limit in protocol is bytes per second.
 	rateLimit := rateMBs * 1024 * 1024
 	log.Info("backup started",
@@ -410,7 +689,7 @@ func (bc *BackupClient) backupRange(
 
 	allStores, err := bc.pdClient.GetAllStores(ctx)
 	if err != nil {
-		return errors.Trace(err)
+		return RangeTree{}, errors.Trace(err)
 	}
 	req := backup.BackupRequest{
 		ClusterId:    bc.clusterID,
@@ -422,68 +701,134 @@ func (bc *BackupClient) backupRange(
 		RateLimit:    rateLimit,
 		Concurrency:  concurrency,
 	}
-	push := newPushDown(ctx, bc.backer, len(allStores))
+	push := newPushDown(ctx, bc.sendBackup)
 
 	results, err := push.pushBackup(req, allStores, updateCh)
 	if err != nil {
-		return err
+		return RangeTree{}, err
 	}
 	log.Info("finish backup push down", zap.Int("Ok", results.len()))
 
+	// Push the incomplete ranges down to the current leaders of their
+	// regions in bulk, e.g. the regions led by the unavailable stores.
+	err = bc.pushIncompleteRanges(ctx, push, req, results, updateCh)
+	if err != nil {
+		return RangeTree{}, err
+	}
+
 	// Find and backup remaining ranges.
-	// TODO: test fine grained backup.
-	err = bc.fineGrainedBackup(
+	err = bc.fineGrainedBackup(ctx,
 		startKey, endKey,
 		backupTS, path, rateLimit, concurrency, results, updateCh)
 	if err != nil {
-		return err
+		return RangeTree{}, err
 	}
 
-	bc.backupMeta.StartVersion = backupTS
-	bc.backupMeta.EndVersion = backupTS
-	log.Info("backup time range",
-		zap.Reflect("StartVersion", backupTS),
-		zap.Reflect("EndVersion", backupTS))
-
-	results.tree.Ascend(func(i btree.Item) bool {
-		r := i.(*Range)
-		bc.backupMeta.Files = append(bc.backupMeta.Files, r.Files...)
-		return true
-	})
-
-	// Check if there are duplicated files.
-	results.checkDupFiles()
-
 	log.Info("backup range finished",
+		zap.Binary("StartKey", startKey),
+		zap.Binary("EndKey", endKey),
 		zap.Duration("take", time.Since(start)))
-	return nil
+	return results, nil
 }
 
-func (bc *BackupClient) findRegionLeader(key []byte) (*metapb.Peer, error) {
-	// Keys are saved in encoded format in TiKV, so the key must be encoded
-	// in order to find the correct region.
-	key = codec.EncodeBytes([]byte{}, key)
-	for i := 0; i < 5; i++ {
-		// better backoff.
-		_, leader, err := bc.pdClient.GetRegion(bc.ctx, key)
+// pushIncompleteRanges pushes the incomplete ranges down to the stores which
+// lead their regions now.
+func (bc *BackupClient) pushIncompleteRanges(
+	ctx context.Context,
+	push *pushDown,
+	req backup.BackupRequest,
+	results RangeTree,
+	updateCh chan<- struct{},
+) error {
+	incomplete := results.getIncompleteRange(req.StartKey, req.EndKey)
+	if len(incomplete) == 0 {
+		return nil
+	}
+	storeRanges, _, err := bc.splitRangesByLeader(ctx, incomplete)
+	if err != nil {
+		return err
+	}
+	tasks := make(map[uint64][]backup.BackupRequest, len(storeRanges))
+	for storeID, ranges := range storeRanges {
+		for _, rg := range ranges {
+			r := req
+			r.StartKey, r.EndKey = rg.StartKey, rg.EndKey
+			tasks[storeID] = append(tasks[storeID], r)
+		}
+	}
+	log.Info("push incomplete ranges down to region leaders",
+		zap.Int("incomplete", len(incomplete)), zap.Int("stores", len(tasks)))
+	return push.push(tasks, results, updateCh)
+}
+
+// splitRangesByLeader splits the ranges on region boundaries, and groups
+// them by the stores which lead the regions. It also returns the number of
+// regions without a leader.
+func (bc *BackupClient) splitRangesByLeader(
+	ctx context.Context, ranges []Range,
+) (map[uint64][]Range, int, error) {
+	storeRanges := make(map[uint64][]Range)
+	noLeader := 0
+	for _, rg := range ranges {
+		// Keys are saved in encoded format in TiKV.
+		startKey := codec.EncodeBytes([]byte{}, rg.StartKey)
+		var endKey []byte
+		if len(rg.EndKey) != 0 {
+			endKey = codec.EncodeBytes([]byte{}, rg.EndKey)
+		}
+		regions, leaders, err := bc.pdClient.ScanRegions(ctx, startKey, endKey, 0)
 		if err != nil {
-			log.Error("find region failed", zap.Error(err))
-			time.Sleep(time.Millisecond * time.Duration(100*i))
-			continue
+			return nil, 0, errors.Trace(err)
+		}
+		for i, region := range regions {
+			regionStart, regionEnd, err := decodeRegionRange(region)
+			if err != nil {
+				return nil, 0, err
+			}
+			start, end, ok := rg.intersect(regionStart, regionEnd)
+			if !ok {
+				continue
+			}
+			var storeID uint64
+			if i < len(leaders) {
+				storeID = leaders[i].GetStoreId()
+			}
+			if storeID == 0 {
+				log.Warn("region has no leader", zap.Uint64("RegionID", region.GetId()))
+				noLeader++
+				continue
+			}
+			storeRanges[storeID] = append(storeRanges[storeID], Range{StartKey: start, EndKey: end})
+		}
+	}
+	return storeRanges, noLeader, nil
+}
+
+// decodeRegionRange decodes the key range of a region.
+func decodeRegionRange(region *metapb.Region) (startKey, endKey []byte, err error) {
+	if len(region.GetStartKey()) != 0 {
+		_, startKey, err = codec.DecodeBytes(region.GetStartKey(), nil)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
 		}
-		if leader != nil {
-			log.Info("find region",
-				zap.Reflect("Leader", leader), zap.Binary("Key", key))
-			return leader, nil
+	}
+	if len(region.GetEndKey()) != 0 {
+		_, endKey, err = codec.DecodeBytes(region.GetEndKey(), nil)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
 		}
-		log.Warn("no region found", zap.Binary("Key", key))
-		time.Sleep(time.Millisecond * time.Duration(100*i))
-		continue
 	}
-	return nil, errors.Errorf("can not find region for key %v", key)
+	return startKey, endKey, nil
+}
+
+// fineGrainedTask is a range which is sent to the leader of its region.
+type fineGrainedTask struct {
+	storeID uint64
+	rg      Range
 }
 
 func (bc *BackupClient) fineGrainedBackup(
+	ctx context.Context,
 	startKey, endKey []byte,
 	backupTS uint64,
 	path string,
@@ -492,7 +837,8 @@ func (bc *BackupClient) fineGrainedBackup(
 	rangeTree RangeTree,
 	updateCh chan<- struct{},
 ) error {
-	bo := tikv.NewBackoffer(bc.ctx, backupFineGrainedMaxBackoff)
+	bo := tikv.NewBackoffer(ctx, backupFineGrainedMaxBackoff)
+	fineGrainedBo := fineGrainedBackupBackoff.NewBackoffer(ctx, backoff.AlwaysRetry)
 	for {
 		// Step1, check whether there is any incomplete range
 		incomplete := rangeTree.getIncompleteRange(startKey, endKey)
@@ -500,93 +846,166 @@ func (bc *BackupClient) fineGrainedBackup(
 			return nil
 		}
 		log.Info("start fine grained backup", zap.Int("incomplete", len(incomplete)))
-		// Step2, retry backup on incomplete range
-		respCh := make(chan *backup.BackupResponse, 4)
-		errCh := make(chan error, 4)
-		retry := make(chan Range, 4)
-
-		max := &struct {
-			ms int
-			mu sync.Mutex
-		}{}
-		wg := sync.WaitGroup{}
-		for i := 0; i < 4; i++ {
-			wg.Add(1)
-			fork, _ := bo.Fork()
-			go func(boFork *tikv.Backoffer) {
-				defer wg.Done()
-				for rg := range retry {
-					backoffMs, err :=
-						bc.handleFineGrained(boFork, rg, backupTS, path, rateLimit, concurrency, respCh)
-					if err != nil {
-						errCh <- err
-						return
-					}
-					if backoffMs != 0 {
-						max.mu.Lock()
-						if max.ms < backoffMs {
-							max.ms = backoffMs
-						}
-						max.mu.Unlock()
-					}
-				}
-			}(fork)
+		// Step2, split the incomplete ranges on region boundaries, and retry
+		// backup on the leaders of the regions.
+		storeRanges, noLeader, err := bc.splitRangesByLeader(ctx, incomplete)
+		if err != nil {
+			return err
+		}
+		tasks := interleaveByStore(storeRanges)
+		backoffMs, finished, err := bc.runFineGrainedTasks(
+			ctx, bo, tasks, backupTS, path, rateLimit, concurrency, rangeTree, updateCh)
+		if err != nil {
+			return err
 		}
 
-		// Dispatch rangs and wait
-		go func() {
-			for _, rg := range incomplete {
-				retry <- rg
+		// Step3. Backoff if needed, then repeat.
+		if backoffMs == 0 && (noLeader > 0 || finished == 0) {
+			// Wait for the regions to elect leaders.
+			backoffMs = leaderBackoffMs
+		}
+		if backoffMs != 0 {
+			log.Info("handle fine grained", zap.Int("backoffMs", backoffMs))
+			err := fineGrainedBo.BackoffFor(
+				errors.Errorf("%d ranges are incomplete", len(incomplete)),
+				time.Duration(backoffMs)*time.Millisecond)
+			if err != nil {
+				return errors.Trace(err)
 			}
-			close(retry)
-			wg.Wait()
-			close(respCh)
-		}()
+		}
+	}
+}
 
-	selectLoop:
-		for {
-			select {
-			case err := <-errCh:
-				// TODO: should we handle err here?
-				return err
-			case resp, ok := <-respCh:
-				if !ok {
-					// Finished.
-					break selectLoop
+// interleaveByStore orders the ranges of the stores in turn, so that the
+// concurrent requests are spread over the stores.
+func interleaveByStore(storeRanges map[uint64][]Range) []fineGrainedTask {
+	storeIDs := make([]uint64, 0, len(storeRanges))
+	total := 0
+	for storeID, ranges := range storeRanges {
+		storeIDs = append(storeIDs, storeID)
+		total += len(ranges)
+	}
+	sort.Slice(storeIDs, func(i, j int) bool { return storeIDs[i] < storeIDs[j] })
+	tasks := make([]fineGrainedTask, 0, total)
+	for i := 0; len(tasks) < total; i++ {
+		for _, storeID := range storeIDs {
+			if ranges := storeRanges[storeID]; i < len(ranges) {
+				tasks = append(tasks, fineGrainedTask{storeID: storeID, rg: ranges[i]})
+			}
+		}
+	}
+	return tasks
+}
+
+// runFineGrainedTasks sends the tasks concurrently, and puts the backed up
+// ranges into the range tree. It returns the longest backoff required by the
+// responses and the number of backed up ranges.
+func (bc *BackupClient) runFineGrainedTasks(
+	ctx context.Context,
+	bo *tikv.Backoffer,
+	tasks []fineGrainedTask,
+	backupTS uint64,
+	path string,
+	rateLimit uint64,
+	concurrency uint32,
+	rangeTree RangeTree,
+	updateCh chan<- struct{},
+) (int, int, error) {
+	workers := int(bc.fineGrainedConcurrency)
+	if workers > len(tasks) {
+		workers = len(tasks)
+	}
+	respCh := make(chan *backup.BackupResponse, workers)
+	errCh := make(chan error, workers)
+	taskCh := make(chan fineGrainedTask, workers)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	max := &struct {
+		ms int
+		mu sync.Mutex
+	}{}
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		fork, _ := bo.Fork()
+		go func(boFork *tikv.Backoffer) {
+			defer wg.Done()
+			for task := range taskCh {
+				backoffMs, err := bc.handleFineGrained(ctx,
+					boFork, task.storeID, task.rg, backupTS, path, rateLimit, concurrency, respCh)
+				if err != nil {
+					errCh <- err
+					return
 				}
-				if resp.Error != nil {
-					log.Fatal("unexpected backup error",
-						zap.Reflect("error", resp.Error))
+				if backoffMs != 0 {
+					max.mu.Lock()
+					if max.ms < backoffMs {
+						max.ms = backoffMs
+					}
+					max.mu.Unlock()
 				}
-				log.Info("put fine grained range",
-					zap.Binary("StartKey", resp.StartKey),
-					zap.Binary("EndKey", resp.EndKey),
-				)
-				rangeTree.putOk(resp.StartKey, resp.EndKey, resp.Files)
+			}
+		}(fork)
+	}
 
-				// Update progress
-				updateCh <- struct{}{}
+	// Dispatch tasks and wait
+	go func() {
+		defer func() {
+			close(taskCh)
+			wg.Wait()
+			close(respCh)
+		}()
+		for _, task := range tasks {
+			select {
+			case taskCh <- task:
+			case <-ctx.Done():
+				return
 			}
 		}
+	}()
 
-		// Step3. Backoff if needed, then repeat.
-		max.mu.Lock()
-		ms := max.ms
-		max.mu.Unlock()
-		if ms != 0 {
-			log.Info("handle fine grained", zap.Int("backoffMs", ms))
-			err := bo.BackoffWithMaxSleep(2, /* magic boTxnLockFast */
-				ms, errors.New("TODO: attach error"))
-			if err != nil {
-				return errors.Trace(err)
+	finished := 0
+	for {
+		select {
+		case err := <-errCh:
+			return 0, 0, err
+		case resp, ok := <-respCh:
+			if !ok {
+				// Finished.
+				max.mu.Lock()
+				defer max.mu.Unlock()
+				return max.ms, finished, nil
 			}
+			if resp.Error != nil {
+				// Leave the range incomplete, it is retried after backoff.
+				log.Warn("unexpected backup error",
+					zap.Binary("StartKey", resp.StartKey),
+					zap.Binary("EndKey", resp.EndKey),
+					zap.Reflect("error", resp.Error))
+				max.mu.Lock()
+				if max.ms < leaderBackoffMs {
+					max.ms = leaderBackoffMs
+				}
+				max.mu.Unlock()
+				continue
+			}
+			log.Info("put fine grained range",
+				zap.Binary("StartKey", resp.StartKey),
+				zap.Binary("EndKey", resp.EndKey),
+			)
+			rangeTree.putOk(resp.StartKey, resp.EndKey, resp.Files)
+			finished++
+
+			// Update progress
+			updateCh <- struct{}{}
 		}
 	}
 }
 
 func onBackupResponse(
 	bo *tikv.Backoffer,
-	lockResolver *tikv.LockResolver,
+	getLockResolver func() *tikv.LockResolver,
 	resp *backup.BackupResponse,
 ) (*backup.BackupResponse, int, error) {
 	log.Debug("onBackupResponse", zap.Reflect("resp", resp))
@@ -599,7 +1018,7 @@ func onBackupResponse(
 		if lockErr := v.KvError.Locked; lockErr != nil {
 			// Try to resolve lock.
 			log.Warn("backup occur kv error", zap.Reflect("error", v))
-			msBeforeExpired, err1 := lockResolver.ResolveLocks(
+			msBeforeExpired, err1 := getLockResolver().ResolveLocks(
 				bo, []*tikv.Lock{tikv.NewLock(lockErr)})
 			if err1 != nil {
 				return nil, 0, errors.Trace(err1)
@@ -645,7 +1064,9 @@ func onBackupResponse(
 }
 
 func (bc *BackupClient) handleFineGrained(
+	ctx context.Context,
 	bo *tikv.Backoffer,
+	storeID uint64,
 	rg Range,
 	backupTS uint64,
 	path string,
@@ -653,14 +1074,10 @@ func (bc *BackupClient) handleFineGrained(
 	concurrency uint32,
 	respCh chan<- *backup.BackupResponse,
 ) (int, error) {
-	leader, pderr := bc.findRegionLeader(rg.StartKey)
-	if pderr != nil {
-		return 0, pderr
-	}
 	max := 0
 	req := backup.BackupRequest{
 		ClusterId:    bc.clusterID,
-		StartKey:     rg.StartKey, // TODO: the range may cross region.
+		StartKey:     rg.StartKey,
 		EndKey:       rg.EndKey,
 		StartVersion: backupTS,
 		EndVersion:   backupTS,
@@ -668,13 +1085,12 @@ func (bc *BackupClient) handleFineGrained(
 		RateLimit:    rateLimit,
 		Concurrency:  concurrency,
 	}
-	lockResolver := bc.backer.GetLockResolver()
-	err := bc.backer.SendBackup(
-		bc.ctx, leader.GetStoreId(), req,
+	err := bc.sendBackup(
+		ctx, storeID, req,
 		// Handle responses with the same backoffer.
 		func(resp *backup.BackupResponse) error {
 			response, backoffMs, err :=
-				onBackupResponse(bo, lockResolver, resp)
+				onBackupResponse(bo, bc.backer.GetLockResolver, resp)
 			if err != nil {
 				return err
 			}
@@ -682,10 +1098,19 @@ func (bc *BackupClient) handleFineGrained(
 				max = backoffMs
 			}
 			if response != nil {
-				respCh <- response
+				select {
+				case respCh <- response:
+				case <-ctx.Done():
+					return errors.Trace(ctx.Err())
+				}
 			}
 			return nil
 		})
+	if errors.Cause(err) == meta.ErrStoreUnavailable {
+		// Wait for the region to elect a new leader.
+		log.Warn("backup occur store error", zap.Error(err))
+		return leaderBackoffMs, nil
+	}
 	if err != nil {
 		return 0, err
 	}
@@ -697,7 +1122,8 @@ func (bc *BackupClient) GetRangeRegionCount(startKey, endKey []byte) (int, error
 	return bc.backer.GetRegionCount()
 }
 
-// FastChecksum check data integrity by xor all(sst_checksum) per table
+// FastChecksum verifies the checksum of the tables, which is computed from
+// the backed up files, against the admin checksum from TiDB.
 func (bc *BackupClient) FastChecksum() (bool, error) {
 	start := time.Now()
 	defer func() {
@@ -705,64 +1131,32 @@ func (bc *BackupClient) FastChecksum() (bool, error) {
 		log.Info("Backup Checksum", zap.Duration("take", elapsed))
 	}()
 
-	dbs, err := utils.LoadBackupTables(&bc.backupMeta)
+	valid, err := bc.backupSchemas.verifyChecksum()
 	if err != nil {
 		return false, err
 	}
-
-	for _, schema := range bc.backupMeta.Schemas {
-		dbInfo := &model.DBInfo{}
-		err = json.Unmarshal(schema.Db, dbInfo)
-		if err != nil {
-			return false, err
-		}
-		tblInfo := &model.TableInfo{}
-		err = json.Unmarshal(schema.Table, tblInfo)
-		if err != nil {
-			return false, err
-		}
-		tbl := dbs[dbInfo.Name.String()].GetTable(tblInfo.Name.String())
-
-		checksum := uint64(0)
-		totalKvs := uint64(0)
-		totalBytes := uint64(0)
-		for _, file := range tbl.Files {
-			checksum ^= file.Crc64Xor
-			totalKvs += file.TotalKvs
-			totalBytes += file.TotalBytes
-		}
-		if schema.Crc64Xor == checksum && schema.TotalKvs == totalKvs && schema.TotalBytes == totalBytes {
-			log.Info("fast checksum success", zap.Stringer("db", dbInfo.Name), zap.Stringer("table", tblInfo.Name))
-		} else {
-			log.Error("failed in fast checksum",
-				zap.String("database", dbInfo.Name.String()),
-				zap.String("table", tblInfo.Name.String()),
-				zap.Uint64("origin tidb crc64", schema.Crc64Xor),
-				zap.Uint64("calculated crc64", checksum),
-				zap.Uint64("origin tidb total kvs", schema.TotalKvs),
-				zap.Uint64("calculated total kvs", totalKvs),
-				zap.Uint64("origin tidb total bytes", schema.TotalBytes),
-				zap.Uint64("calculated total bytes", totalBytes),
-			)
-			return false, nil
-		}
+	if valid {
+		bc.backupExtMeta.Verify = utils.VerifyPassed
+	} else {
+		bc.backupExtMeta.Verify = utils.VerifyFailed
 	}
-
-	return true, nil
+	return valid, nil
 }
 
-// CompleteMeta wait response of admin checksum from TiDB to complete backup meta
+// CompleteMeta computes the checksum of the tables from the backed up files,
+// and waits for the admin checksum from TiDB if it is enabled.
 func (bc *BackupClient) CompleteMeta() error {
-	schemas, err := bc.backupSchemas.finishTableChecksum()
-	if err != nil {
+	if err := bc.backupSchemas.fillChecksum(bc.backupMeta.Files); err != nil {
+		return err
+	}
+	if err := bc.backupSchemas.finishTableChecksum(); err != nil {
 		return err
 	}
-	bc.backupMeta.Schemas = schemas
+	bc.backupMeta.Schemas = bc.backupSchemas.allSchemas()
 	return nil
 }
 
 type tableChecksum struct {
-	name       string
 	checksum   uint64
 	totalKvs   uint64
 	totalBytes uint64
@@ -808,63 +1202,206 @@ func getChecksumFromTiDB(
 	}, nil
 }
 
+// backupTable is a table to backup with its data.
+type backupTable struct {
+	dbName, tableName string
+	schema            *backup.Schema
+	// physicalIDs are the IDs of the table and its partitions.
+	physicalIDs []int64
+	// adminChecksum is the admin checksum from TiDB, nil if it is disabled.
+	adminChecksum *tableChecksum
+}
+
+func (t *backupTable) name() string {
+	return fmt.Sprintf("%s.%s", t.dbName, t.tableName)
+}
+
 type backupSchemas struct {
-	meta       map[string]*backup.Schema
-	checksumCh chan *tableChecksum
-	errCh      chan error
-	wg         sync.WaitGroup
-	workerPool *utils.WorkerPool
+	tables []*backupTable
+	// schemas without checksum, e.g. views.
+	schemas []*backup.Schema
+
+	// done is closed when the admin checksum finishes, it is nil if the
+	// admin checksum is not started.
+	done chan struct{}
+	mu   sync.Mutex
+	err  error
 }
 
+// addTable adds a table which has data to checksum.
+func (bs *backupSchemas) addTable(schema *backup.Schema, dbName string, tableInfo *model.TableInfo) {
+	table := &backupTable{
+		dbName:    dbName,
+		tableName: tableInfo.Name.L,
+		schema:    schema,
+	}
+	for _, r := range buildTableRanges(tableInfo) {
+		table.physicalIDs = append(table.physicalIDs, r.startID)
+	}
+	bs.tables = append(bs.tables, table)
+}
+
+// addSchema adds a schema which has no data to checksum.
+func (bs *backupSchemas) addSchema(schema *backup.Schema, dbName, tableName string) {
+	log.Info("backup schema without data",
+		zap.String("table", fmt.Sprintf("%s.%s", dbName, tableName)))
+	bs.schemas = append(bs.schemas, schema)
+}
+
+// startTableChecksum runs the admin checksum of the tables in background, at
+// most concurrency tables at a time. Every worker reuses one session.
 func (bs *backupSchemas) startTableChecksum(
-	ctx context.Context,
-	dbSession session.Session,
-	schema *backup.Schema,
-	dbName, tableName string) {
-	name := fmt.Sprintf("%s.%s", dbName, tableName)
-	log.Info("admin checksum from TiDB start",
-		zap.String("table", name),
-	)
-	bs.meta[name] = schema
-	bs.wg.Add(1)
-	// TODO: It may block backup if len(table) > len(workers).
-	bs.workerPool.Apply(func() {
-		defer bs.wg.Done()
-		checksum, err := getChecksumFromTiDB(ctx, dbSession, dbName, tableName)
+	ctx context.Context, store kv.Storage, backupTS uint64, concurrency uint,
+) {
+	bs.done = make(chan struct{})
+	tableCh := make(chan *backupTable, len(bs.tables))
+	for _, table := range bs.tables {
+		tableCh <- table
+	}
+	close(tableCh)
+	if concurrency > uint(len(bs.tables)) {
+		concurrency = uint(len(bs.tables))
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	wg := sync.WaitGroup{}
+	for i := uint(0); i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := bs.checksumTables(ctx, store, backupTS, tableCh); err != nil {
+				bs.mu.Lock()
+				if bs.err == nil {
+					bs.err = err
+				}
+				bs.mu.Unlock()
+				cancel()
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		cancel()
+		close(bs.done)
+	}()
+}
+
+func (bs *backupSchemas) checksumTables(
+	ctx context.Context, store kv.Storage, backupTS uint64, tableCh <-chan *backupTable,
+) error {
+	dbSession, err := session.CreateSession(store)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer dbSession.Close()
+	// TODO figure out why
+	// must set to true to avoid load global vars, otherwise we got error
+	dbSession.GetSessionVars().CommonGlobalLoaded = true
+	// make admin checksum snapshot is same as backup snapshot
+	dbSession.GetSessionVars().SnapshotTS = backupTS
+	for table := range tableCh {
+		if ctx.Err() != nil {
+			return errors.Trace(ctx.Err())
+		}
+		log.Info("admin checksum from TiDB start", zap.String("table", table.name()))
+		checksum, err := getChecksumFromTiDB(ctx, dbSession, table.dbName, table.tableName)
 		if err != nil {
-			bs.errCh <- err
-			return
+			return errors.Annotatef(err, "admin checksum %s", table.name())
 		}
-		checksum.name = name
-		bs.checksumCh <- checksum
-	})
+		log.Info("admin checksum from TiDB finished",
+			zap.String("table", table.name()),
+			zap.Uint64("Crc64Xor", checksum.checksum),
+			zap.Uint64("TotalKvs", checksum.totalKvs),
+			zap.Uint64("TotalBytes", checksum.totalBytes),
+			zap.Duration("take", checksum.duration))
+		bs.mu.Lock()
+		table.adminChecksum = checksum
+		bs.mu.Unlock()
+	}
+	return nil
 }
 
-func (bs *backupSchemas) finishTableChecksum() ([]*backup.Schema, error) {
-	go func() {
-		bs.wg.Wait()
-		close(bs.checksumCh)
-	}()
-	var schemas []*backup.Schema
-	for {
-		select {
-		case checksum, ok := <-bs.checksumCh:
-			if !ok {
-				return schemas, nil
-			}
-			log.Info("admin checksum from TiDB finished",
-				zap.String("table", checksum.name),
-				zap.Uint64("Crc64Xor", checksum.checksum),
-				zap.Uint64("TotalKvs", checksum.totalKvs),
-				zap.Uint64("TotalBytes", checksum.totalBytes),
-				zap.Duration("take", checksum.duration))
-			s := bs.meta[checksum.name]
-			s.Crc64Xor = checksum.checksum
-			s.TotalKvs = checksum.totalKvs
-			s.TotalBytes = checksum.totalBytes
-			schemas = append(schemas, s)
-		case err := <-bs.errCh:
-			return nil, errors.Trace(err)
+// finishTableChecksum waits for the admin checksum if it is started.
+func (bs *backupSchemas) finishTableChecksum() error {
+	if bs.done == nil {
+		return nil
+	}
+	<-bs.done
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return errors.Trace(bs.err)
+}
+
+// fillChecksum computes the checksum of the tables from the CRCs of the
+// backed up files. A file must belong to a single table, since its checksum
+// can not be divided, and restore assigns it to the table of its start key.
+func (bs *backupSchemas) fillChecksum(files []*backup.File) error {
+	tableIDs := make(map[int64]*backup.Schema)
+	for _, table := range bs.tables {
+		table.schema.Crc64Xor = 0
+		table.schema.TotalKvs = 0
+		table.schema.TotalBytes = 0
+		for _, id := range table.physicalIDs {
+			tableIDs[id] = table.schema
+		}
+	}
+	for _, file := range files {
+		// Skip the files which do not contain any table data.
+		if !bytes.HasPrefix(file.GetStartKey(), tablecodec.TablePrefix()) {
+			continue
 		}
+		tableID := tablecodec.DecodeTableID(file.GetStartKey())
+		schema, ok := tableIDs[tableID]
+		if !ok {
+			continue
+		}
+		tableEnd := tablecodec.GenTablePrefix(tableID + 1)
+		if len(file.GetEndKey()) == 0 || bytes.Compare(file.GetEndKey(), tableEnd) > 0 {
+			return errors.Errorf("file %s [%x, %x) spans more than one table",
+				file.GetName(), file.GetStartKey(), file.GetEndKey())
+		}
+		schema.Crc64Xor ^= file.GetCrc64Xor()
+		schema.TotalKvs += file.GetTotalKvs()
+		schema.TotalBytes += file.GetTotalBytes()
+	}
+	return nil
+}
+
+// verifyChecksum compares the checksum of the tables with the admin checksum.
+func (bs *backupSchemas) verifyChecksum() (bool, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	for _, table := range bs.tables {
+		checksum := table.adminChecksum
+		if checksum == nil {
+			return false, errors.Errorf("admin checksum of %s not found", table.name())
+		}
+		schema := table.schema
+		if schema.Crc64Xor == checksum.checksum &&
+			schema.TotalKvs == checksum.totalKvs &&
+			schema.TotalBytes == checksum.totalBytes {
+			log.Info("fast checksum success", zap.String("table", table.name()))
+			continue
+		}
+		log.Error("failed in fast checksum",
+			zap.String("table", table.name()),
+			zap.Uint64("origin tidb crc64", checksum.checksum),
+			zap.Uint64("calculated crc64", schema.Crc64Xor),
+			zap.Uint64("origin tidb total kvs", checksum.totalKvs),
+			zap.Uint64("calculated total kvs", schema.TotalKvs),
+			zap.Uint64("origin tidb total bytes", checksum.totalBytes),
+			zap.Uint64("calculated total bytes", schema.TotalBytes),
+		)
+		return false, nil
+	}
+	return true, nil
+}
+
+// allSchemas returns the schemas of the tables and the schemas without data.
+func (bs *backupSchemas) allSchemas() []*backup.Schema {
+	schemas := make([]*backup.Schema, 0, len(bs.schemas)+len(bs.tables))
+	schemas = append(schemas, bs.schemas...)
+	for _, table := range bs.tables {
+		schemas = append(schemas, table.schema)
 	}
+	return schemas
 }
@@ -2,15 +2,22 @@ package raw
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"net/url"
 	"testing"
 	"time"
 
 	"github.com/pingcap/br/pkg/meta"
+	"github.com/pingcap/br/pkg/utils"
 
 	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/backup"
 	"github.com/pingcap/parser/model"
 	"github.com/pingcap/tidb/store/mockstore/mocktikv"
+	"github.com/pingcap/tidb/tablecodec"
+	"github.com/pingcap/tidb/util/codec"
 )
 
 type testBackup struct {
@@ -142,3 +149,158 @@ func (r *testBackup) TestPDHTTP(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(respString, Equals, "test")
 }
+
+func (r *testBackup) TestParseBackupTS(c *C) {
+	ts, form, err := ParseBackupTS("415520709034803201")
+	c.Assert(err, IsNil)
+	c.Assert(ts, Equals, uint64(415520709034803201))
+	c.Assert(form, Equals, utils.BackupTSTSO)
+
+	ts, form, err = ParseBackupTS("tso:415520709034803201")
+	c.Assert(err, IsNil)
+	c.Assert(ts, Equals, uint64(415520709034803201))
+	c.Assert(form, Equals, utils.BackupTSTSO)
+
+	expected := meta.EncodeTs(meta.Timestamp{Physical: 1582171200000})
+	ts, form, err = ParseBackupTS("2020-02-20T12:00:00+08:00")
+	c.Assert(err, IsNil)
+	c.Assert(ts, Equals, expected)
+	c.Assert(form, Equals, utils.BackupTSTime)
+
+	ts, form, err = ParseBackupTS("time:2020-02-20T04:00:00Z")
+	c.Assert(err, IsNil)
+	c.Assert(ts, Equals, expected)
+	c.Assert(form, Equals, utils.BackupTSTime)
+
+	local := time.Date(2020, 2, 20, 12, 0, 0, 0, time.Local)
+	ts, _, err = ParseBackupTS("time:2020-02-20 12:00:00")
+	c.Assert(err, IsNil)
+	c.Assert(meta.DecodeTs(ts).Physical, Equals, local.UnixNano()/int64(time.Millisecond))
+
+	for _, s := range []string{"", "tso:abc", "time:415520709034803201", "yesterday", "-1"} {
+		_, _, err = ParseBackupTS(s)
+		c.Assert(err, NotNil, Commentf("%s", s))
+	}
+}
+
+func (r *testBackup) TestGetBackupTS(c *C) {
+	ts, err := r.backupClient.GetBackupTS("tso:1")
+	c.Assert(err, IsNil)
+	c.Assert(ts, Equals, uint64(1))
+	c.Assert(r.backupClient.backupExtMeta.BackupTSForm, Equals, utils.BackupTSTSO)
+
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+	_, err = r.backupClient.GetBackupTS(future)
+	c.Assert(err, ErrorMatches, "backup ts .* is newer than the current ts .*")
+}
+
+func (r *testBackup) TestTableChecksum(c *C) {
+	bs := &backupSchemas{}
+	bs.addTable(&backup.Schema{}, "test", &model.TableInfo{ID: 1, Name: model.NewCIStr("t1")})
+	bs.addTable(&backup.Schema{}, "test", &model.TableInfo{
+		ID:   2,
+		Name: model.NewCIStr("t2"),
+		Partition: &model.PartitionInfo{Enable: true, Definitions: []model.PartitionDefinition{
+			{ID: 3}, {ID: 4},
+		}},
+	})
+	bs.addSchema(&backup.Schema{}, "test", "v1")
+	file := func(tableID int64, crc, kvs, bytes uint64) *backup.File {
+		return &backup.File{
+			StartKey:   tablecodec.GenTablePrefix(tableID),
+			EndKey:     tablecodec.GenTablePrefix(tableID + 1),
+			Crc64Xor:   crc,
+			TotalKvs:   kvs,
+			TotalBytes: bytes,
+		}
+	}
+	c.Assert(bs.fillChecksum([]*backup.File{
+		file(1, 1, 1, 10), file(1, 2, 2, 20), file(3, 4, 3, 30), file(4, 8, 4, 40), file(5, 16, 5, 50),
+		{StartKey: []byte("a")},
+	}), IsNil)
+	c.Assert(bs.tables[0].schema, DeepEquals, &backup.Schema{Crc64Xor: 3, TotalKvs: 3, TotalBytes: 30})
+	c.Assert(bs.tables[1].schema, DeepEquals, &backup.Schema{Crc64Xor: 12, TotalKvs: 7, TotalBytes: 70})
+	c.Assert(bs.allSchemas(), HasLen, 3)
+
+	// A file which spans two tables can not be charged to either of them.
+	spanning := file(3, 4, 3, 30)
+	spanning.EndKey = tablecodec.GenTablePrefix(5)
+	c.Assert(bs.fillChecksum([]*backup.File{spanning}), ErrorMatches, ".*spans more than one table")
+	c.Assert(bs.fillChecksum([]*backup.File{
+		file(1, 1, 1, 10), file(1, 2, 2, 20), file(3, 4, 3, 30), file(4, 8, 4, 40),
+	}), IsNil)
+
+	// The admin checksum is not started.
+	c.Assert(bs.finishTableChecksum(), IsNil)
+	_, err := bs.verifyChecksum()
+	c.Assert(err, ErrorMatches, "admin checksum of test.t1 not found")
+
+	bs.tables[0].adminChecksum = &tableChecksum{checksum: 3, totalKvs: 3, totalBytes: 30}
+	bs.tables[1].adminChecksum = &tableChecksum{checksum: 12, totalKvs: 7, totalBytes: 70}
+	valid, err := bs.verifyChecksum()
+	c.Assert(err, IsNil)
+	c.Assert(valid, IsTrue)
+
+	bs.tables[1].adminChecksum.totalKvs = 8
+	valid, err = bs.verifyChecksum()
+	c.Assert(err, IsNil)
+	c.Assert(valid, IsFalse)
+}
+
+func (r *testBackup) TestStartTableChecksumWithoutTables(c *C) {
+	bs := &backupSchemas{}
+	bs.startTableChecksum(context.Background(), nil, 1, 4)
+	c.Assert(bs.finishTableChecksum(), IsNil)
+}
+
+func (r *testBackup) TestPlanBackup(c *C) {
+	storage, err := utils.CreateStorage(fmt.Sprintf("local://%s", c.MkDir()))
+	c.Assert(err, IsNil)
+	backer := &meta.Backer{Ctx: r.backupClient.ctx, PDClient: r.backupClient.pdClient}
+	backer.SetPDHTTP([]string{"test"}, nil)
+	prefixes := make([]string, 0)
+	backer.PDHTTPGet = func(addr, prefix string, cli *http.Client) ([]byte, error) {
+		prefixes = append(prefixes, prefix)
+		return []byte(`{"count":2,"empty_count":0,"storage_size":3,"storage_keys":100}`), nil
+	}
+	bc := &BackupClient{
+		ctx:      r.backupClient.ctx,
+		pdClient: r.backupClient.pdClient,
+		backer:   backer,
+		storage:  storage,
+	}
+	bc.backupSchemas.addTable(&backup.Schema{}, "test", &model.TableInfo{ID: 1, Name: model.NewCIStr("t1")})
+	bc.backupSchemas.addSchema(&backup.Schema{}, "test", "v1")
+	ranges := []Range{
+		{StartKey: []byte("a"), EndKey: []byte("b")},
+		{StartKey: []byte("b"), EndKey: []byte("c")},
+		{StartKey: []byte("d"), EndKey: []byte{}},
+	}
+
+	backupTS := meta.EncodeTs(meta.Timestamp{Physical: int64(time.Hour / time.Millisecond)})
+	plan, err := bc.PlanBackup(ranges, backupTS)
+	c.Assert(err, IsNil)
+	c.Assert(plan.GCMargin, Equals, time.Hour)
+	c.Assert(plan.Warnings, HasLen, 0)
+	c.Assert(plan.Tables, DeepEquals, []string{"test.t1"})
+	c.Assert(plan.Views, Equals, 1)
+	c.Assert(plan.Ranges, HasLen, 3)
+	c.Assert(plan.Regions, Equals, 6)
+	c.Assert(plan.Size, Equals, int64(9*1024*1024))
+	c.Assert(plan.Kvs, Equals, int64(300))
+	c.Assert(prefixes, HasLen, 3)
+	c.Assert(prefixes[2], Equals, fmt.Sprintf("pd/api/v1/stats/region?start_key=%s&end_key=",
+		url.QueryEscape(string(codec.EncodeBytes(nil, []byte("d"))))))
+	// Nothing is left in the storage.
+	c.Assert(storage.WalkDir(func(path string, size int64) error {
+		return errors.Errorf("unexpected file %s", path)
+	}), IsNil)
+
+	backupTS = meta.EncodeTs(meta.Timestamp{Physical: int64(time.Minute / time.Millisecond)})
+	plan, err = bc.PlanBackup(ranges, backupTS)
+	c.Assert(err, IsNil)
+	c.Assert(plan.Warnings, HasLen, 1)
+
+	_, err = bc.PlanBackup(ranges, 0)
+	c.Assert(err, ErrorMatches, "GC safepoint 0 exceed backup ts 0")
+}
@@ -0,0 +1,109 @@
+package raw
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/util/codec"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/meta"
+	"github.com/pingcap/br/pkg/utils"
+)
+
+// minGCMargin is the least time between the GC safepoint and the backup ts
+// which is considered safe, it is the default GC life time of TiDB.
+const minGCMargin = 10 * time.Minute
+
+// RangePlan is a range to backup with the estimation from PD.
+type RangePlan struct {
+	Range
+	Regions int
+	// Size is the approximate size in bytes.
+	Size int64
+	Kvs  int64
+}
+
+// BackupPlan describes what a backup would do, without sending any backup
+// request.
+type BackupPlan struct {
+	BackupTS  uint64
+	SafePoint uint64
+	// GCMargin is the time between the GC safepoint and the backup ts.
+	GCMargin time.Duration
+	// Tables are the tables with data, in the form of "db.table".
+	Tables []string
+	// Views is the number of schemas without data.
+	Views  int
+	Ranges []RangePlan
+
+	Regions int
+	Size    int64
+	Kvs     int64
+
+	Warnings []string
+}
+
+// PlanBackup checks the storage is writable and the backup ts is not garbage
+// collected, and estimates the backup of the ranges from the region stats of
+// PD. The ranges are merged as BackupRanges does.
+func (bc *BackupClient) PlanBackup(ranges []Range, backupTS uint64) (*BackupPlan, error) {
+	if err := utils.CheckWritable(bc.storage); err != nil {
+		return nil, err
+	}
+	safePoint, err := bc.backer.GetGCSafePoint(bc.ctx)
+	if err != nil {
+		return nil, err
+	}
+	plan := &BackupPlan{
+		BackupTS:  backupTS,
+		SafePoint: meta.EncodeTs(safePoint),
+		Views:     len(bc.backupSchemas.schemas),
+	}
+	if backupTS <= plan.SafePoint {
+		return nil, errors.Errorf("GC safepoint %d exceed backup ts %d", plan.SafePoint, backupTS)
+	}
+	plan.GCMargin = time.Duration(meta.DecodeTs(backupTS).Physical-safePoint.Physical) * time.Millisecond
+	if plan.GCMargin < minGCMargin {
+		plan.Warnings = append(plan.Warnings, fmt.Sprintf(
+			"backup ts is only %s ahead of the GC safepoint, "+
+				"it may be garbage collected before the backup starts", plan.GCMargin))
+	}
+	for _, table := range bc.backupSchemas.tables {
+		plan.Tables = append(plan.Tables, table.name())
+	}
+
+	for _, r := range mergeRanges(ranges) {
+		// The keys of regions are encoded.
+		startKey := codec.EncodeBytes(nil, r.StartKey)
+		var endKey []byte
+		if len(r.EndKey) != 0 {
+			endKey = codec.EncodeBytes(nil, r.EndKey)
+		}
+		stats, err := bc.backer.GetRegionStats(startKey, endKey)
+		if err != nil {
+			return nil, errors.Annotatef(err, "get region stats of [%x, %x)", r.StartKey, r.EndKey)
+		}
+		rp := RangePlan{
+			Range:   r,
+			Regions: stats.Count,
+			Size:    stats.StorageSize * 1024 * 1024,
+			Kvs:     stats.StorageKeys,
+		}
+		plan.Ranges = append(plan.Ranges, rp)
+		plan.Regions += rp.Regions
+		plan.Size += rp.Size
+		plan.Kvs += rp.Kvs
+	}
+	log.Info("backup plan",
+		zap.Uint64("BackupTS", plan.BackupTS),
+		zap.Duration("GCMargin", plan.GCMargin),
+		zap.Int("tables", len(plan.Tables)),
+		zap.Int("ranges", len(plan.Ranges)),
+		zap.Int("regions", plan.Regions),
+		zap.Int64("size", plan.Size),
+		zap.Int64("kvs", plan.Kvs))
+	return plan, nil
+}
@@ -3,6 +3,7 @@ package raw
 import (
 	"context"
 	"sync"
+	"time"
 
 	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/backup"
@@ -13,65 +14,111 @@ import (
 	"github.com/pingcap/br/pkg/meta"
 )
 
+// backupStallTimeout is the longest time that a push down backup can go
+// without any response.
+const backupStallTimeout = 5 * time.Minute
+
+// backupSender sends a backup request to a store, and handles the responses.
+type backupSender func(
+	ctx context.Context,
+	storeID uint64,
+	req backup.BackupRequest,
+	respFn func(*backup.BackupResponse) error,
+) error
+
 // pushDown warps a backup task.
 type pushDown struct {
-	ctx    context.Context
-	backer *meta.Backer
-	respCh chan *backup.BackupResponse
-	errCh  chan error
+	ctx          context.Context
+	send         backupSender
+	stallTimeout time.Duration
 }
 
 // newPushDown creates a push down backup.
-func newPushDown(ctx context.Context, backer *meta.Backer, cap int) *pushDown {
+func newPushDown(ctx context.Context, send backupSender) *pushDown {
 	log.Info("new backup client")
 	return &pushDown{
-		ctx:    ctx,
-		backer: backer,
-		respCh: make(chan *backup.BackupResponse, cap),
-		errCh:  make(chan error, cap),
+		ctx:          ctx,
+		send:         send,
+		stallTimeout: backupStallTimeout,
 	}
 }
 
-// FullBackup make a full backup of a tikv cluster.
+// pushBackup pushes the backup request down to all the stores. Tombstone
+// stores are skipped, offline stores still serve the regions which are not
+// moved away yet.
 func (push *pushDown) pushBackup(
 	req backup.BackupRequest,
 	stores []*metapb.Store,
 	updateCh chan<- struct{},
 ) (RangeTree, error) {
+	tasks := make(map[uint64][]backup.BackupRequest, len(stores))
+	for _, s := range stores {
+		if s.GetState() == metapb.StoreState_Tombstone {
+			log.Info("skip tombstone store", zap.Uint64("StoreID", s.GetId()))
+			continue
+		}
+		tasks[s.GetId()] = []backup.BackupRequest{req}
+	}
+	res := newRangeTree()
+	err := push.push(tasks, res, updateCh)
+	return res, err
+}
+
+// push sends the requests to the stores, and puts the backed up ranges into
+// res. An unavailable store is skipped, its regions are left incomplete, so
+// that they can be backed up from their new leaders.
+func (push *pushDown) push(
+	tasks map[uint64][]backup.BackupRequest,
+	res RangeTree,
+	updateCh chan<- struct{},
+) error {
+	ctx, cancel := context.WithCancel(push.ctx)
+	defer cancel()
+	respCh := make(chan *backup.BackupResponse, len(tasks))
+	errCh := make(chan error, len(tasks))
+
 	// Push down backup tasks to all tikv instances.
 	wg := sync.WaitGroup{}
-	for _, s := range stores {
-		storeID := s.GetId()
+	for storeID, reqs := range tasks {
+		storeID, reqs := storeID, reqs
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			err := push.backer.SendBackup(
-				push.ctx, storeID, req,
-				func(resp *backup.BackupResponse) error {
-					// Forward all responses (including error).
-					push.respCh <- resp
-					return nil
-				})
-			if err != nil {
-				push.errCh <- err
-				return
+			for _, req := range reqs {
+				err := push.send(ctx, storeID, req,
+					func(resp *backup.BackupResponse) error {
+						// Forward all responses (including error).
+						select {
+						case respCh <- resp:
+							return nil
+						case <-ctx.Done():
+							return errors.Trace(ctx.Err())
+						}
+					})
+				if errors.Cause(err) == meta.ErrStoreUnavailable {
+					log.Warn("skip unavailable store",
+						zap.Uint64("StoreID", storeID), zap.Error(err))
+					return
+				}
+				if err != nil {
+					errCh <- err
+					return
+				}
 			}
 		}()
 	}
 
 	go func() {
 		wg.Wait()
-		// TODO: test concurrent receive response and close channel.
-		close(push.respCh)
+		close(respCh)
 	}()
 
-	res := newRangeTree()
 	for {
 		select {
-		case resp, ok := <-push.respCh:
+		case resp, ok := <-respCh:
 			if !ok {
 				// Finished.
-				return res, nil
+				return nil
 			}
 			if resp.GetError() == nil {
 				// None error means range has been backuped successfully.
@@ -93,16 +140,19 @@ func (push *pushDown) pushBackup(
 				case *backup.Error_ClusterIdError:
 					log.Error("backup occur cluster ID error",
 						zap.Reflect("error", v))
-					return res, errors.Errorf("%v", errPb)
+					return errors.Errorf("%v", errPb)
 
 				default:
 					log.Error("backup occur unknown error",
 						zap.String("error", errPb.GetMsg()))
-					return res, errors.Errorf("%v", errPb)
+					return errors.Errorf("%v", errPb)
 				}
 			}
-		case err := <-push.errCh:
-			return res, errors.Trace(err)
+		case err := <-errCh:
+			return errors.Trace(err)
+		case <-time.After(push.stallTimeout):
+			return errors.Errorf("backup stalled, no response from the stores in %s",
+				push.stallTimeout)
 		}
 	}
 }
@@ -0,0 +1,374 @@
+package raw
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/btree"
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/parser/model"
+	pd "github.com/pingcap/pd/client"
+	"github.com/pingcap/tidb/tablecodec"
+	"github.com/pingcap/tidb/util/codec"
+
+	"github.com/pingcap/br/pkg/meta"
+)
+
+var _ = Suite(&testPushDownSuite{})
+
+type testPushDownSuite struct{}
+
+// fakeSender backs up the ranges in ok of every store, or the requested
+// range if echo is set. If regions is set too, it writes a file per region
+// in the requested range as TiKV does.
+type fakeSender struct {
+	mu         sync.Mutex
+	ok         map[uint64][]Range
+	errs       map[uint64]error
+	regionErrs map[uint64]int
+	reqs       map[uint64][]backup.BackupRequest
+	echo       bool
+	regions    []Range
+}
+
+func newFakeSender() *fakeSender {
+	return &fakeSender{
+		ok:         make(map[uint64][]Range),
+		errs:       make(map[uint64]error),
+		regionErrs: make(map[uint64]int),
+		reqs:       make(map[uint64][]backup.BackupRequest),
+	}
+}
+
+func (f *fakeSender) send(
+	ctx context.Context,
+	storeID uint64,
+	req backup.BackupRequest,
+	respFn func(*backup.BackupResponse) error,
+) error {
+	f.mu.Lock()
+	f.reqs[storeID] = append(f.reqs[storeID], req)
+	ok, err := f.ok[storeID], f.errs[storeID]
+	regionErr := f.regionErrs[storeID] > 0
+	if regionErr {
+		f.regionErrs[storeID]--
+	}
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if regionErr {
+		return respFn(&backup.BackupResponse{
+			StartKey: req.StartKey,
+			EndKey:   req.EndKey,
+			Error: &backup.Error{Detail: &backup.Error_RegionError{
+				RegionError: &errorpb.Error{NotLeader: &errorpb.NotLeader{}},
+			}},
+		})
+	}
+	if f.echo && len(f.regions) != 0 {
+		return f.sendRegionFiles(req, respFn)
+	}
+	if f.echo {
+		ok = []Range{{StartKey: req.StartKey, EndKey: req.EndKey}}
+	}
+	for _, rg := range ok {
+		if err := respFn(&backup.BackupResponse{StartKey: rg.StartKey, EndKey: rg.EndKey}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeSender) sendRegionFiles(
+	req backup.BackupRequest, respFn func(*backup.BackupResponse) error,
+) error {
+	for _, region := range f.regions {
+		start, end := req.StartKey, req.EndKey
+		if bytes.Compare(region.StartKey, start) > 0 {
+			start = region.StartKey
+		}
+		if len(region.EndKey) != 0 && bytes.Compare(region.EndKey, end) < 0 {
+			end = region.EndKey
+		}
+		if bytes.Compare(start, end) >= 0 {
+			continue
+		}
+		err := respFn(&backup.BackupResponse{
+			StartKey: start,
+			EndKey:   end,
+			Files:    []*backup.File{{Name: fmt.Sprintf("%x", start), StartKey: start, EndKey: end}},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newTestPushDown(sender backupSender) *pushDown {
+	return &pushDown{
+		ctx:          context.Background(),
+		send:         sender,
+		stallTimeout: backupStallTimeout,
+	}
+}
+
+func drain(updateCh chan struct{}) {
+	for {
+		select {
+		case <-updateCh:
+		default:
+			return
+		}
+	}
+}
+
+func (s *testPushDownSuite) TestPushBackupSkipStores(c *C) {
+	sender := newFakeSender()
+	sender.ok[1] = []Range{{StartKey: []byte("a"), EndKey: []byte("b")}}
+	sender.errs[2] = errors.Annotate(meta.ErrStoreUnavailable, "connect store 2")
+	stores := []*metapb.Store{
+		{Id: 1, State: metapb.StoreState_Up},
+		{Id: 2, State: metapb.StoreState_Offline},
+		{Id: 3, State: metapb.StoreState_Tombstone},
+	}
+	updateCh := make(chan struct{}, 16)
+	defer drain(updateCh)
+	req := backup.BackupRequest{StartKey: []byte("a"), EndKey: []byte("c")}
+	res, err := newTestPushDown(sender.send).pushBackup(req, stores, updateCh)
+	c.Assert(err, IsNil)
+	c.Assert(res.getIncompleteRange(req.StartKey, req.EndKey), DeepEquals,
+		[]Range{{StartKey: []byte("b"), EndKey: []byte("c")}})
+	// Tombstone stores are skipped.
+	c.Assert(sender.reqs[1], HasLen, 1)
+	c.Assert(sender.reqs[2], HasLen, 1)
+	c.Assert(sender.reqs[3], HasLen, 0)
+
+	// Other errors fail the backup.
+	sender.errs[2] = errors.New("backup failed")
+	_, err = newTestPushDown(sender.send).pushBackup(req, stores, updateCh)
+	c.Assert(err, ErrorMatches, "backup failed")
+}
+
+func (s *testPushDownSuite) TestPushBackupStall(c *C) {
+	push := newTestPushDown(func(
+		ctx context.Context,
+		storeID uint64,
+		req backup.BackupRequest,
+		respFn func(*backup.BackupResponse) error,
+	) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	push.stallTimeout = 50 * time.Millisecond
+	stores := []*metapb.Store{{Id: 1}}
+	_, err := push.pushBackup(backup.BackupRequest{}, stores, make(chan struct{}))
+	c.Assert(err, ErrorMatches, "backup stalled, no response from the stores in 50ms")
+}
+
+// fakeLeaderPD returns the leaders of the regions in the range.
+type fakeLeaderPD struct {
+	pd.Client
+	stores  []*metapb.Store
+	regions []*metapb.Region
+	leaders []*metapb.Peer
+}
+
+func (f *fakeLeaderPD) GetAllStores(ctx context.Context, opts ...pd.GetStoreOption) ([]*metapb.Store, error) {
+	return f.stores, nil
+}
+
+func (f *fakeLeaderPD) ScanRegions(
+	ctx context.Context, key, endKey []byte, limit int,
+) ([]*metapb.Region, []*metapb.Peer, error) {
+	regions := make([]*metapb.Region, 0)
+	leaders := make([]*metapb.Peer, 0)
+	for i, r := range f.regions {
+		if (len(endKey) == 0 || string(r.StartKey) < string(endKey)) &&
+			(len(r.EndKey) == 0 || string(key) < string(r.EndKey)) {
+			regions = append(regions, r)
+			leaders = append(leaders, f.leaders[i])
+		}
+	}
+	return regions, leaders, nil
+}
+
+func (s *testPushDownSuite) TestPushIncompleteRanges(c *C) {
+	encode := func(key string) []byte {
+		return codec.EncodeBytes([]byte{}, []byte(key))
+	}
+	fakePD := &fakeLeaderPD{
+		regions: []*metapb.Region{
+			{Id: 1, StartKey: encode("a"), EndKey: encode("c")},
+			{Id: 2, StartKey: encode("c"), EndKey: encode("e")},
+			{Id: 3, StartKey: encode("e"), EndKey: encode("g")},
+		},
+		// The region 3 has no leader.
+		leaders: []*metapb.Peer{{StoreId: 4}, {StoreId: 5}, {}},
+	}
+	bc := &BackupClient{pdClient: fakePD}
+	sender := newFakeSender()
+	sender.ok[4] = []Range{{StartKey: []byte("b"), EndKey: []byte("c")}}
+	sender.ok[5] = []Range{{StartKey: []byte("c"), EndKey: []byte("d")}}
+
+	results := newRangeTree()
+	results.putOk([]byte("a"), []byte("b"), nil)
+	updateCh := make(chan struct{}, 16)
+	defer drain(updateCh)
+	req := backup.BackupRequest{StartKey: []byte("a"), EndKey: []byte("f")}
+	err := bc.pushIncompleteRanges(context.Background(), newTestPushDown(sender.send), req, results, updateCh)
+	c.Assert(err, IsNil)
+	// The incomplete range is split and sent to the leaders of its regions.
+	c.Assert(sender.reqs[4], HasLen, 1)
+	c.Assert(sender.reqs[4][0].StartKey, DeepEquals, []byte("b"))
+	c.Assert(sender.reqs[4][0].EndKey, DeepEquals, []byte("c"))
+	c.Assert(sender.reqs[5], HasLen, 1)
+	c.Assert(sender.reqs[5][0].StartKey, DeepEquals, []byte("c"))
+	c.Assert(sender.reqs[5][0].EndKey, DeepEquals, []byte("e"))
+	c.Assert(results.getIncompleteRange(req.StartKey, req.EndKey), DeepEquals,
+		[]Range{{StartKey: []byte("d"), EndKey: []byte("f")}})
+}
+
+func (s *testPushDownSuite) TestFineGrainedBackup(c *C) {
+	encode := func(key string) []byte {
+		return codec.EncodeBytes([]byte{}, []byte(key))
+	}
+	fakePD := &fakeLeaderPD{
+		regions: []*metapb.Region{
+			{Id: 1, StartKey: encode("a"), EndKey: encode("c")},
+			{Id: 2, StartKey: encode("c"), EndKey: encode("e")},
+			{Id: 3, StartKey: encode("e"), EndKey: encode("g")},
+			{Id: 4, StartKey: encode("g")},
+		},
+		leaders: []*metapb.Peer{{StoreId: 4}, {StoreId: 5}, {StoreId: 4}, {StoreId: 6}},
+	}
+	sender := newFakeSender()
+	sender.echo = true
+	// The store 5 is not the leader at first.
+	sender.regionErrs[5] = 1
+	bc := &BackupClient{
+		ctx:                    context.Background(),
+		pdClient:               fakePD,
+		sendBackup:             sender.send,
+		fineGrainedConcurrency: 2,
+	}
+	results := newRangeTree()
+	results.putOk([]byte("a"), []byte("b"), nil)
+	updateCh := make(chan struct{}, 16)
+	defer drain(updateCh)
+	err := bc.fineGrainedBackup(context.Background(), []byte("a"), []byte("h"), 1, "", 0, 1, results, updateCh)
+	c.Assert(err, IsNil)
+	c.Assert(results.getIncompleteRange([]byte("a"), []byte("h")), HasLen, 0)
+
+	// Every request is in one region.
+	ranges := func(reqs []backup.BackupRequest) []string {
+		rs := make([]string, 0, len(reqs))
+		for _, req := range reqs {
+			rs = append(rs, string(req.StartKey)+"-"+string(req.EndKey))
+		}
+		sort.Strings(rs)
+		return rs
+	}
+	c.Assert(ranges(sender.reqs[4]), DeepEquals, []string{"b-c", "e-g"})
+	c.Assert(ranges(sender.reqs[5]), DeepEquals, []string{"c-e", "c-e"})
+	c.Assert(ranges(sender.reqs[6]), DeepEquals, []string{"g-h"})
+}
+
+func (s *testPushDownSuite) TestInterleaveByStore(c *C) {
+	rg := func(key string) Range {
+		return Range{StartKey: []byte(key)}
+	}
+	tasks := interleaveByStore(map[uint64][]Range{
+		2: {rg("d")},
+		1: {rg("a"), rg("b"), rg("c")},
+	})
+	keys := make([]string, 0, len(tasks))
+	for _, task := range tasks {
+		keys = append(keys, string(task.rg.StartKey))
+	}
+	c.Assert(keys, DeepEquals, []string{"a", "d", "b", "c"})
+}
+
+func (s *testPushDownSuite) TestMergeRanges(c *C) {
+	rg := func(start, end string) Range {
+		return Range{StartKey: []byte(start), EndKey: []byte(end)}
+	}
+	c.Assert(mergeRanges(nil), HasLen, 0)
+	// Adjacent ranges are not merged.
+	c.Assert(mergeRanges([]Range{rg("d", "e"), rg("a", "b"), rg("b", "c"), rg("f", "h"), rg("g", "i")}),
+		DeepEquals, []Range{rg("a", "b"), rg("b", "c"), rg("d", "e"), rg("f", "i")})
+	c.Assert(mergeRanges([]Range{rg("c", "d"), rg("a", ""), rg("b", "c")}),
+		DeepEquals, []Range{rg("a", "")})
+}
+
+func (s *testPushDownSuite) TestBackupRangesConcurrently(c *C) {
+	sender := newFakeSender()
+	sender.echo = true
+	bc := &BackupClient{
+		ctx:              context.Background(),
+		pdClient:         &fakeLeaderPD{stores: []*metapb.Store{{Id: 1}}},
+		sendBackup:       sender.send,
+		rangeConcurrency: 2,
+	}
+	updateCh := make(chan struct{}, 16)
+	defer drain(updateCh)
+	ranges := mergeRanges([]Range{
+		{StartKey: []byte("a"), EndKey: []byte("b")},
+		{StartKey: []byte("b"), EndKey: []byte("c")},
+		{StartKey: []byte("d"), EndKey: []byte("e")},
+	})
+	results, err := bc.backupRangesConcurrently(context.Background(), ranges, "", 1, 0, 1, updateCh)
+	c.Assert(err, IsNil)
+	c.Assert(results.len(), Equals, 3)
+	c.Assert(results.getIncompleteRange([]byte("a"), []byte("c")), HasLen, 0)
+	c.Assert(results.getIncompleteRange([]byte("d"), []byte("e")), HasLen, 0)
+	c.Assert(sender.reqs[1], HasLen, 3)
+
+	sender.errs[1] = errors.New("backup failed")
+	_, err = bc.backupRangesConcurrently(context.Background(), ranges, "", 1, 0, 1, updateCh)
+	c.Assert(err, ErrorMatches, "backup failed")
+}
+
+func (s *testPushDownSuite) TestBackupTablesInOneRegion(c *C) {
+	sender := newFakeSender()
+	sender.echo = true
+	// One region covers two small tables.
+	sender.regions = []Range{{StartKey: tablecodec.GenTablePrefix(1), EndKey: tablecodec.GenTablePrefix(3)}}
+	bc := &BackupClient{
+		ctx:              context.Background(),
+		pdClient:         &fakeLeaderPD{stores: []*metapb.Store{{Id: 1}}},
+		sendBackup:       sender.send,
+		rangeConcurrency: 2,
+	}
+	updateCh := make(chan struct{}, 16)
+	defer drain(updateCh)
+	ranges := make([]Range, 0, 2)
+	for _, id := range []int64{1, 2} {
+		for _, r := range buildTableRanges(&model.TableInfo{ID: id}) {
+			ranges = append(ranges, r.Range())
+		}
+	}
+	results, err := bc.backupRangesConcurrently(context.Background(), mergeRanges(ranges), "", 1, 0, 1, updateCh)
+	c.Assert(err, IsNil)
+	files := make([]*backup.File, 0)
+	results.tree.Ascend(func(i btree.Item) bool {
+		files = append(files, i.(*Range).Files...)
+		return true
+	})
+	// Every file belongs to a single table.
+	c.Assert(files, HasLen, 2)
+	for _, file := range files {
+		tableID := tablecodec.DecodeTableID(file.StartKey)
+		c.Assert(bytes.Compare(file.EndKey, tablecodec.GenTablePrefix(tableID+1)) <= 0, IsTrue,
+			Commentf("file [%x, %x) spans tables", file.StartKey, file.EndKey))
+	}
+}
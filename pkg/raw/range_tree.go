@@ -184,6 +184,14 @@ func (rangeTree *RangeTree) getIncompleteRange(
 	return incomplete
 }
 
+// merge puts the ranges of other into the tree.
+func (rangeTree *RangeTree) merge(other RangeTree) {
+	other.tree.Ascend(func(i btree.Item) bool {
+		rangeTree.update(i.(*Range))
+		return true
+	})
+}
+
 func (rangeTree *RangeTree) checkDupFiles() {
 	// Name -> SHA256
 	files := make(map[string][]byte)
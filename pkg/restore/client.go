@@ -3,7 +3,6 @@ package restore
 import (
 	"bytes"
 	"context"
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -29,18 +28,32 @@ import (
 	"github.com/pingcap/tidb/util/ranger"
 	"github.com/pingcap/tipb/go-tipb"
 	"go.uber.org/zap"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/keepalive"
 
+	"github.com/pingcap/br/pkg/backoff"
 	"github.com/pingcap/br/pkg/meta"
 	"github.com/pingcap/br/pkg/utils"
 )
 
 const (
-	resetTSURL             = "/pd/api/v1/admin/reset-ts"
-	resetTsRetryTime       = 16
-	resetTSWaitInterval    = 50 * time.Millisecond
-	resetTSMaxWaitInterval = 500 * time.Millisecond
+	// defaultDDLConcurrency is the number of workers creating tables.
+	defaultDDLConcurrency = 16
+	// importConnsPerStore is the number of connections to every store, so
+	// that the concurrent downloads and ingests are not blocked by one
+	// connection.
+	importConnsPerStore = 4
+
+	resetTSURL = "/pd/api/v1/admin/reset-ts"
+)
+
+var (
+	errResetTSRejected = errors.New("reset TS rejected")
+
+	resetTSBackoff = backoff.Register("reset-ts", backoff.Policy{
+		Attempts:  16,
+		BaseDelay: 100 * time.Millisecond,
+		MaxDelay:  500 * time.Millisecond,
+		Jitter:    0.2,
+	})
 )
 
 // Client sends requests to importer to restore files
@@ -49,8 +62,8 @@ type Client struct {
 	cancel context.CancelFunc
 
 	pdClient        pd.Client
-	pdAddrs         []string
 	tikvCli         tikv.Storage
+	conns           *utils.StoreConns
 	fileImporter    FileImporter
 	workerPool      *utils.WorkerPool
 	tableWorkerPool *utils.WorkerPool
@@ -58,32 +71,54 @@ type Client struct {
 	databases  map[string]*utils.Database
 	dbDSN      string
 	backupMeta *backup.BackupMeta
+	storage    utils.ExternalStorage
 	backer     *meta.Backer
 	dom        *domain.Domain
+	// embedded indicates whether the schemas are created by the session
+	// embedded in BR instead of a TiDB server.
+	embedded bool
 }
 
-// NewRestoreClient returns a new RestoreClient
-func NewRestoreClient(ctx context.Context, pdAddrs string) (*Client, error) {
+// NewRestoreClient returns a new RestoreClient. If embedded is true, the
+// schemas are created by the session embedded in BR, so the restore does not
+// need a TiDB server.
+func NewRestoreClient(
+	ctx context.Context, pdAddrs string, security utils.SecurityConfig, embedded bool,
+) (*Client, error) {
 	ctx, cancel := context.WithCancel(ctx)
 	addrs := strings.Split(pdAddrs, ",")
-	backer, err := meta.NewBacker(ctx, addrs[0])
+	tlsConf, err := security.ToTLSConfig()
 	if err != nil {
 		cancel()
 		return nil, errors.Trace(err)
 	}
-	pdClient, err := pd.NewClient(addrs, pd.SecurityOption{})
+	backer, err := meta.NewBacker(ctx, addrs[0], security)
 	if err != nil {
 		cancel()
 		return nil, errors.Trace(err)
 	}
+	pdClient, err := pd.NewClient(addrs, pd.SecurityOption{
+		CAPath:   security.CA,
+		CertPath: security.Cert,
+		KeyPath:  security.Key,
+	})
+	if err != nil {
+		backer.Close()
+		cancel()
+		return nil, errors.Trace(err)
+	}
 
 	// Do not run ddl worker in BR.
 	// BR sends create table sql to tidb instance instead of using the DDL package.
-	ddl.RunWorker = false
+	// The embedded session needs the ddl worker, since there may be no tidb
+	// instance to run the DDL jobs. The worker may take the DDL owner from a
+	// running tidb, so the embedded session must not be used with tidb.
+	ddl.RunWorker = embedded
 	// Do not run stat worker in BR.
 	session.DisableStats4Test()
 	dom, err := session.BootstrapSession(backer.GetTiKV())
 	if err != nil {
+		backer.Close()
 		cancel()
 		return nil, errors.Trace(err)
 	}
@@ -92,11 +127,12 @@ func NewRestoreClient(ctx context.Context, pdAddrs string) (*Client, error) {
 		ctx:             ctx,
 		cancel:          cancel,
 		pdClient:        pdClient,
-		pdAddrs:         addrs,
 		tikvCli:         backer.GetTiKV().(tikv.Storage),
+		conns:           utils.NewStoreConns(ctx, pdClient, tlsConf, importConnsPerStore),
 		backer:          backer,
 		tableWorkerPool: utils.NewWorkerPool(128, "table"),
 		dom:             dom,
+		embedded:        embedded,
 	}, nil
 }
 
@@ -108,6 +144,8 @@ func (rc *Client) GetPDClient() pd.Client {
 // Close a client
 func (rc *Client) Close() {
 	rc.dom.Close()
+	rc.conns.Close()
+	rc.backer.Close()
 	rc.cancel()
 }
 
@@ -117,14 +155,20 @@ func (rc *Client) InitBackupMeta(backupMeta *backup.BackupMeta) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	renameSystemDatabase(databases)
 	rc.databases = databases
 	rc.backupMeta = backupMeta
 
 	client := restore_util.NewClient(rc.pdClient)
-	rc.fileImporter = NewFileImporter(rc.ctx, client, backupMeta.GetPath())
+	rc.fileImporter = NewFileImporter(rc.ctx, client, backupMeta.GetPath(), rc.conns)
 	return nil
 }
 
+// SetStorage sets the storage which the backup is read from.
+func (rc *Client) SetStorage(storage utils.ExternalStorage) {
+	rc.storage = storage
+}
+
 // SetDbDSN sets the DSN to connect the database to a new value
 func (rc *Client) SetDbDSN(dsn string) {
 	rc.dbDSN = dsn
@@ -135,11 +179,51 @@ func (rc *Client) GetDbDSN() string {
 	return rc.dbDSN
 }
 
+// openDatabase opens a database with the embedded session or the DSN.
+func (rc *Client) openDatabase(dbName string) (DB, error) {
+	if rc.embedded {
+		return OpenEmbeddedDatabase(dbName, rc.tikvCli)
+	}
+	db, err := OpenDatabase(dbName, rc.dbDSN)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// CreateDatabase creates a database if it does not exist.
+func (rc *Client) CreateDatabase(schema *model.DBInfo) error {
+	db, err := rc.openDatabase("")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return CreateDatabase(db, schema)
+}
+
+// HasSystemTables returns whether the backup has system tables.
+func (rc *Client) HasSystemTables() bool {
+	_, ok := rc.databases[temporarySystemDatabase]
+	return ok
+}
+
 // SetConcurrency sets the concurrency of dbs tables files
 func (rc *Client) SetConcurrency(c uint) {
 	rc.workerPool = utils.NewWorkerPool(c, "file")
 }
 
+// SetRateLimit sets the download speed limit of each store in MB/s. It must
+// be called after InitBackupMeta.
+func (rc *Client) SetRateLimit(rateMBs uint64) {
+	rc.fileImporter.SetRateLimit(rateMBs)
+}
+
+// SetStoreConcurrency sets the maximum number of concurrent downloads and
+// ingests on each store. It must be called after InitBackupMeta.
+func (rc *Client) SetStoreConcurrency(concurrency uint) {
+	rc.fileImporter.SetStoreConcurrency(concurrency)
+}
+
 // GetTS gets a new timestamp from PD
 func (rc *Client) GetTS() (uint64, error) {
 	p, l, err := rc.pdClient.GetTS(rc.ctx)
@@ -164,22 +248,34 @@ func (rc *Client) ResetTS() error {
 	if err != nil {
 		return err
 	}
-	// TODO: Support TLS
-	reqURL := "http://" + rc.pdAddrs[0] + resetTSURL
-	return withRetry(func() error {
-		resp, err := http.Post(reqURL, "application/json", strings.NewReader(string(req)))
+	cli, addrs := rc.backer.PDHTTPClient()
+	reqURL := addrs[0] + resetTSURL
+	return resetTSBackoff.Retry(rc.ctx, classifyResetTSError, func() error {
+		resp, err := cli.Post(reqURL, "application/json", strings.NewReader(string(req)))
 		if err != nil {
 			return errors.Trace(err)
 		}
-		if resp.StatusCode != 200 && resp.StatusCode != 403 {
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusForbidden {
 			buf := new(bytes.Buffer)
 			_, err := buf.ReadFrom(resp.Body)
+			if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+				// The request is rejected, retrying does not help.
+				return errors.Annotatef(errResetTSRejected,
+					"pd resets TS failed: req=%v, resp=%v, err=%v", string(req), buf.String(), err)
+			}
 			return errors.Errorf("pd resets TS failed: req=%v, resp=%v, err=%v", string(req), buf.String(), err)
 		}
 		return nil
-	}, func(e error) bool {
-		return true
-	}, resetTsRetryTime, resetTSWaitInterval, resetTSMaxWaitInterval)
+	})
+}
+
+// classifyResetTSError retries all the errors except the rejected requests.
+func classifyResetTSError(err error) backoff.ErrorClass {
+	if errors.Cause(err) == errResetTSRejected {
+		return backoff.Fatal
+	}
+	return backoff.Retryable
 }
 
 // GetDatabases returns all databases.
@@ -213,47 +309,101 @@ func (rc *Client) GetTableSchema(dbName model.CIStr, tableName model.CIStr) (*mo
 	return table.Meta(), nil
 }
 
-// CreateTables creates multiple tables, and returns their rewrite rules.
-func (rc *Client) CreateTables(tables []*utils.Table) (*restore_util.RewriteRules, []*model.TableInfo, error) {
-	rewriteRules := &restore_util.RewriteRules{
-		Table: make([]*import_sstpb.RewriteRule, 0),
-		Data:  make([]*import_sstpb.RewriteRule, 0),
+// resolveTables returns the created tables and their rewrite rules. All the
+// new tables are resolved from a single schema snapshot.
+func (rc *Client) resolveTables(
+	tables []*utils.Table,
+) ([]*model.TableInfo, []*restore_util.RewriteRules, error) {
+	ts, err := rc.GetTS()
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	info, err := rc.dom.GetSnapshotInfoSchema(ts)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
 	}
 	newTables := make([]*model.TableInfo, 0, len(tables))
-	openDBs := make(map[string]*sql.DB)
+	tableRules := make([]*restore_util.RewriteRules, 0, len(tables))
+	for _, table := range tables {
+		newTable, err := info.TableByName(table.Db.Name, table.Schema.Name)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		newTableInfo := newTable.Meta()
+		rules, err := GetRewriteRules(newTableInfo, table.Schema)
+		if err != nil {
+			return nil, nil, err
+		}
+		newTables = append(newTables, newTableInfo)
+		tableRules = append(tableRules, rules)
+	}
+	return newTables, tableRules, nil
+}
+
+// createTables creates the tables concurrently, every worker creates tables
+// with its own connections.
+func (rc *Client) createTables(tables []*utils.Table) error {
+	concurrency := defaultDDLConcurrency
+	if concurrency > len(tables) {
+		concurrency = len(tables)
+	}
+	ctx, cancel := context.WithCancel(rc.ctx)
+	defer cancel()
+	tableCh := make(chan *utils.Table)
+	errCh := make(chan error, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := rc.createTablesWorker(ctx, tableCh); err != nil {
+				errCh <- err
+				cancel()
+			}
+		}()
+	}
+dispatch:
+	for _, table := range tables {
+		select {
+		case tableCh <- table:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(tableCh)
+	wg.Wait()
+	close(errCh)
+	if err := <-errCh; err != nil {
+		return err
+	}
+	return errors.Trace(ctx.Err())
+}
+
+func (rc *Client) createTablesWorker(ctx context.Context, tableCh <-chan *utils.Table) error {
+	openDBs := make(map[string]DB)
 	defer func() {
 		for _, db := range openDBs {
 			_ = db.Close()
 		}
 	}()
-	for _, table := range tables {
+	for table := range tableCh {
+		if ctx.Err() != nil {
+			return nil
+		}
 		var err error
 		db, ok := openDBs[table.Db.Name.String()]
 		if !ok {
-			db, err = OpenDatabase(table.Db.Name.String(), rc.dbDSN)
+			db, err = rc.openDatabase(table.Db.Name.String())
 			if err != nil {
-				return nil, nil, err
+				return err
 			}
 			openDBs[table.Db.Name.String()] = db
 		}
-		err = CreateTable(db, table)
-		if err != nil {
-			return nil, nil, err
-		}
-		err = AlterAutoIncID(db, table)
-		if err != nil {
-			return nil, nil, err
-		}
-		newTableInfo, err := rc.GetTableSchema(table.Db.Name, table.Schema.Name)
-		if err != nil {
-			return nil, nil, err
+		if err = CreateTable(db, table); err != nil {
+			return err
 		}
-		rules := GetRewriteRules(newTableInfo, table.Schema)
-		rewriteRules.Table = append(rewriteRules.Table, rules.Table...)
-		rewriteRules.Data = append(rewriteRules.Data, rules.Data...)
-		newTables = append(newTables, newTableInfo)
 	}
-	return rewriteRules, newTables, nil
+	return nil
 }
 
 // RestoreTable tries to restore the data of a table.
@@ -272,6 +422,10 @@ func (rc *Client) RestoreTable(
 		zap.Stringer("db", table.Db.Name),
 		zap.Array("files", files(table.Files)),
 	)
+	// Only the files of this table are canceled on failure, so that the
+	// other tables go on.
+	ctx, cancel := context.WithCancel(rc.ctx)
+	defer cancel()
 	errCh := make(chan error, len(table.Files))
 	var wg sync.WaitGroup
 	defer close(errCh)
@@ -283,18 +437,18 @@ func (rc *Client) RestoreTable(
 		rc.workerPool.Apply(
 			func() {
 				defer wg.Done()
-				select {
-				case <-rc.ctx.Done():
+				if ctx.Err() != nil {
 					errCh <- nil
-				case errCh <- rc.fileImporter.Import(fileReplica, encodedRules):
-					updateCh <- struct{}{}
+					return
 				}
+				errCh <- rc.fileImporter.Import(fileReplica, encodedRules)
+				updateCh <- struct{}{}
 			})
 	}
 	for range table.Files {
 		err := <-errCh
 		if err != nil {
-			rc.cancel()
+			cancel()
 			wg.Wait()
 			log.Error(
 				"restore table failed",
@@ -305,6 +459,9 @@ func (rc *Client) RestoreTable(
 			return err
 		}
 	}
+	if err := rc.ctx.Err(); err != nil {
+		return errors.Trace(err)
+	}
 	log.Info(
 		"finish to restore table",
 		zap.Stringer("table", table.Schema.Name),
@@ -313,78 +470,80 @@ func (rc *Client) RestoreTable(
 	return nil
 }
 
-// RestoreDatabase tries to restore the data of a database
-func (rc *Client) RestoreDatabase(
-	db *utils.Database,
-	rewriteRules *restore_util.RewriteRules,
-	updateCh chan<- struct{},
-) error {
-	start := time.Now()
-	defer func() {
-		elapsed := time.Since(start)
-		log.Info("RestoreDatabase", zap.Stringer("db", db.Schema.Name), zap.Duration("take", elapsed))
-	}()
-	errCh := make(chan error, len(db.Tables))
-	var wg sync.WaitGroup
-	defer close(errCh)
-	for _, table := range db.Tables {
-		wg.Add(1)
-		tblReplica := table
-		rc.tableWorkerPool.Apply(func() {
-			defer wg.Done()
-			select {
-			case <-rc.ctx.Done():
-				errCh <- nil
-			case errCh <- rc.RestoreTable(
-				tblReplica, rewriteRules, updateCh):
-			}
-		})
+// RestoreStats loads the statistics of the backup tables into the new
+// tables. It returns the tables which have no statistics in the backup.
+func (rc *Client) RestoreStats(tables []*utils.Table) ([]*utils.Table, error) {
+	ts, err := rc.GetTS()
+	if err != nil {
+		return nil, errors.Trace(err)
 	}
-	for range db.Tables {
-		err := <-errCh
+	info, err := rc.dom.GetSnapshotInfoSchema(ts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	missing := make([]*utils.Table, 0)
+	for _, table := range tables {
+		stats, err := utils.LoadTableStats(rc.storage, table.Schema.ID)
 		if err != nil {
-			wg.Wait()
-			return err
+			return nil, errors.Trace(err)
+		}
+		if stats == nil {
+			missing = append(missing, table)
+			continue
+		}
+		// The statistics is loaded into the table of the same name, so the
+		// new table ID is used.
+		stats.DatabaseName = table.Db.Name.L
+		stats.TableName = table.Schema.Name.L
+		err = rc.dom.StatsHandle().LoadStatsFromJSON(info, stats)
+		if err != nil {
+			log.Warn("restore table stats failed",
+				zap.Stringer("db", table.Db.Name),
+				zap.Stringer("table", table.Schema.Name),
+				zap.Error(err))
+			missing = append(missing, table)
+			continue
 		}
+		log.Info("restore table stats",
+			zap.Stringer("db", table.Db.Name),
+			zap.Stringer("table", table.Schema.Name))
 	}
-	return nil
+	return missing, nil
 }
 
-// RestoreAll tries to restore all the data of backup files.
-func (rc *Client) RestoreAll(
-	rewriteRules *restore_util.RewriteRules,
-	updateCh chan<- struct{},
-) error {
-	start := time.Now()
-	defer func() {
-		elapsed := time.Since(start)
-		log.Info("RestoreAll", zap.Duration("take", elapsed))
-	}()
-	errCh := make(chan error, len(rc.databases))
-	var wg sync.WaitGroup
-	defer close(errCh)
-	for _, db := range rc.databases {
-		wg.Add(1)
-		dbReplica := db
-		rc.tableWorkerPool.Apply(func() {
-			defer wg.Done()
-			select {
-			case <-rc.ctx.Done():
-				errCh <- nil
-			case errCh <- rc.RestoreDatabase(
-				dbReplica, rewriteRules, updateCh):
+// AnalyzeTables executes ANALYZE TABLE of the tables in background, the
+// returned function waits until all tables are analyzed. Analyze failures
+// are only logged, since they do not affect the restored data.
+func (rc *Client) AnalyzeTables(tables []*utils.Table) func() {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, table := range tables {
+			if rc.ctx.Err() != nil {
+				return
 			}
-		})
+			err := rc.analyzeTable(table)
+			if err != nil {
+				log.Warn("analyze table failed",
+					zap.Stringer("db", table.Db.Name),
+					zap.Stringer("table", table.Schema.Name),
+					zap.Error(err))
+			}
+		}
+	}()
+	return func() {
+		log.Info("wait for analyzing tables", zap.Int("count", len(tables)))
+		<-done
 	}
+}
 
-	for range rc.databases {
-		err := <-errCh
-		if err != nil {
-			wg.Wait()
-			return err
-		}
+func (rc *Client) analyzeTable(table *utils.Table) error {
+	db, err := rc.openDatabase(table.Db.Name.String())
+	if err != nil {
+		return err
 	}
-	return nil
+	defer db.Close()
+	return AnalyzeTable(db, table)
 }
 
 //SwitchToImportMode switch tikv cluster to import mode
@@ -403,22 +562,7 @@ func (rc *Client) switchTiKVMode(ctx context.Context, mode import_sstpb.SwitchMo
 		return errors.Trace(err)
 	}
 	for _, store := range stores {
-		opt := grpc.WithInsecure()
-		gctx, cancel := context.WithTimeout(ctx, time.Second*5)
-		keepAlive := 10
-		keepAliveTimeout := 3
-		conn, err := grpc.DialContext(
-			gctx,
-			store.GetAddress(),
-			opt,
-			grpc.WithBackoffMaxDelay(time.Second*3),
-			grpc.WithKeepaliveParams(keepalive.ClientParameters{
-				Time:                time.Duration(keepAlive) * time.Second,
-				Timeout:             time.Duration(keepAliveTimeout) * time.Second,
-				PermitWithoutStream: true,
-			}),
-		)
-		cancel()
+		conn, err := rc.conns.GetConn(store.GetId())
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -429,62 +573,44 @@ func (rc *Client) switchTiKVMode(ctx context.Context, mode import_sstpb.SwitchMo
 		if err != nil {
 			return errors.Trace(err)
 		}
-		err = conn.Close()
-		if err != nil {
-			log.Error("close grpc connection failed in switch mode", zap.Error(err))
-			continue
-		}
 	}
 	return nil
 }
 
-//ValidateChecksum validate checksum after restore
-func (rc *Client) ValidateChecksum(tables []*utils.Table, newTables []*model.TableInfo) error {
-	start := time.Now()
-	defer func() {
-		elapsed := time.Since(start)
-		log.Info("Restore Checksum", zap.Duration("take", elapsed))
-	}()
-
-	log.Info("Start to validate checksum")
-	for i, t := range tables {
-		table := t
-		newTable := newTables[i]
-
-		checksumResp := &tipb.ChecksumResponse{}
-		startTS, err := rc.GetTS()
-		if err != nil {
-			return errors.Trace(err)
-		}
-		reqs, err := buildChecksumRequest(newTable, table, startTS)
+// validateTableChecksum validates the checksum of a restored table.
+func (rc *Client) validateTableChecksum(table *utils.Table, newTable *model.TableInfo) error {
+	checksumResp := &tipb.ChecksumResponse{}
+	startTS, err := rc.GetTS()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	reqs, err := buildChecksumRequest(newTable, table, startTS)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, req := range reqs {
+		resp, err := sendChecksumRequest(rc.ctx, rc.tikvCli.GetClient(), req)
 		if err != nil {
 			return errors.Trace(err)
 		}
-		for _, req := range reqs {
-			resp, err := sendChecksumRequest(rc.ctx, rc.tikvCli.GetClient(), req)
-			if err != nil {
-				return errors.Trace(err)
-			}
-			updateChecksumResponse(checksumResp, resp)
-		}
-
-		if checksumResp.Checksum != table.Crc64Xor ||
-			checksumResp.TotalKvs != table.TotalKvs ||
-			checksumResp.TotalBytes != table.TotalBytes {
-			log.Error("failed in validate checksum",
-				zap.String("database", table.Db.Name.L),
-				zap.String("table", table.Schema.Name.L),
-				zap.Uint64("origin tidb crc64", table.Crc64Xor),
-				zap.Uint64("calculated crc64", checksumResp.Checksum),
-				zap.Uint64("origin tidb total kvs", table.TotalKvs),
-				zap.Uint64("calculated total kvs", checksumResp.TotalKvs),
-				zap.Uint64("origin tidb total bytes", table.TotalBytes),
-				zap.Uint64("calculated total bytes", checksumResp.TotalBytes),
-			)
-			return errors.New("failed to validate checksum")
-		}
+		updateChecksumResponse(checksumResp, resp)
+	}
+
+	if checksumResp.Checksum != table.Crc64Xor ||
+		checksumResp.TotalKvs != table.TotalKvs ||
+		checksumResp.TotalBytes != table.TotalBytes {
+		log.Error("failed in validate checksum",
+			zap.String("database", table.Db.Name.L),
+			zap.String("table", table.Schema.Name.L),
+			zap.Uint64("origin tidb crc64", table.Crc64Xor),
+			zap.Uint64("calculated crc64", checksumResp.Checksum),
+			zap.Uint64("origin tidb total kvs", table.TotalKvs),
+			zap.Uint64("calculated total kvs", checksumResp.TotalKvs),
+			zap.Uint64("origin tidb total bytes", table.TotalBytes),
+			zap.Uint64("calculated total bytes", checksumResp.TotalBytes),
+		)
+		return errors.New("failed to validate checksum")
 	}
-	log.Info("validate checksum passed!!")
 	return nil
 }
 
@@ -492,18 +618,14 @@ func buildChecksumRequest(
 	newTable *model.TableInfo,
 	oldTable *utils.Table,
 	startTs uint64) ([]*kv.Request, error) {
-	var partDefs []model.PartitionDefinition
-	if part := newTable.Partition; part != nil {
-		partDefs = part.Definitions
-	}
-
-	reqs := make([]*kv.Request, 0, (len(newTable.Indices)+1)*(len(partDefs)+1))
-	if err := appendRequest(newTable, newTable.ID, &reqs, oldTable, startTs); err != nil {
+	tables, err := mapPhysicalTables(newTable, oldTable.Schema)
+	if err != nil {
 		return nil, err
 	}
 
-	for _, partDef := range partDefs {
-		if err := appendRequest(newTable, partDef.ID, &reqs, oldTable, startTs); err != nil {
+	reqs := make([]*kv.Request, 0, (len(newTable.Indices)+1)*len(tables))
+	for _, t := range tables {
+		if err := appendRequest(newTable, t, &reqs, oldTable, startTs); err != nil {
 			return nil, err
 		}
 	}
@@ -512,11 +634,11 @@ func buildChecksumRequest(
 
 func appendRequest(
 	tableInfo *model.TableInfo,
-	tableID int64,
+	table physicalTable,
 	reqs *[]*kv.Request,
 	oldTable *utils.Table,
 	startTs uint64) error {
-	req, err := buildTableRequest(tableID, oldTable, startTs)
+	req, err := buildTableRequest(table, startTs)
 	if err != nil {
 		return err
 	}
@@ -528,7 +650,7 @@ func appendRequest(
 		}
 		for _, oldIndexInfo := range oldTable.Schema.Indices {
 			if oldIndexInfo.Name == indexInfo.Name {
-				req, err = buildIndexRequest(tableID, indexInfo, oldTable.Schema.ID, oldIndexInfo, startTs)
+				req, err = buildIndexRequest(table.newID, indexInfo, table.oldID, oldIndexInfo, startTs)
 				if err != nil {
 					return err
 				}
@@ -541,12 +663,11 @@ func appendRequest(
 }
 
 func buildTableRequest(
-	tableID int64,
-	oldTable *utils.Table,
+	table physicalTable,
 	startTs uint64) (*kv.Request, error) {
 	rule := &tipb.ChecksumRewriteRule{
-		OldPrefix: tablecodec.GenTableRecordPrefix(oldTable.Schema.ID),
-		NewPrefix: tablecodec.GenTableRecordPrefix(tableID),
+		OldPrefix: tablecodec.GenTableRecordPrefix(table.oldID),
+		NewPrefix: tablecodec.GenTableRecordPrefix(table.newID),
 	}
 
 	checksum := &tipb.ChecksumRequest{
@@ -559,7 +680,7 @@ func buildTableRequest(
 	ranges := ranger.FullIntRange(false)
 
 	var builder distsql.RequestBuilder
-	return builder.SetTableRanges(tableID, ranges, nil).
+	return builder.SetTableRanges(table.newID, ranges, nil).
 		SetChecksumRequest(checksum).
 		SetConcurrency(variable.DefDistSQLScanConcurrency).
 		Build()
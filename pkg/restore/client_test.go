@@ -0,0 +1,92 @@
+package restore
+
+import (
+	"context"
+	"fmt"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/tidb/ddl"
+	"github.com/pingcap/tidb/store/mockstore/mocktikv"
+	"github.com/pingcap/tidb/store/tikv"
+	"github.com/pingcap/tidb/util/testkit"
+
+	"github.com/pingcap/br/pkg/meta"
+	"github.com/pingcap/br/pkg/raw"
+	"github.com/pingcap/br/pkg/utils"
+)
+
+func (s *testRestoreSchemaSuite) TestRestoreStats(c *C) {
+	s.startServer(c)
+	defer s.stopServer(c)
+	tk := testkit.NewTestKit(c, s.store)
+	tk.MustExec("drop database if exists src")
+	tk.MustExec("create database src")
+	tk.MustExec("create table src.t1 (a int, b int, index ib (b))")
+	tk.MustExec("insert into src.t1 values (1, 1), (2, 2), (3, 3)")
+	tk.MustExec("analyze table src.t1")
+	tk.MustExec("create table src.t2 (a int)")
+	tk.MustExec("insert into src.t2 values (1)")
+	ver, err := s.store.CurrentVersion()
+	c.Assert(err, IsNil)
+	backupTS := ver.Ver
+	// The statistics after backupTS are not backed up.
+	tk.MustExec("insert into src.t1 values (4, 4), (5, 5)")
+	tk.MustExec("analyze table src.t1")
+
+	storage, err := utils.CreateStorage(fmt.Sprintf("local://%s", c.MkDir()))
+	c.Assert(err, IsNil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pdClient := mocktikv.NewPDClient(s.cluster)
+	backer := &meta.Backer{Ctx: ctx, PDClient: pdClient}
+	backer.SetTiKV(s.store.(tikv.Storage))
+	// The backup client disables the DDL worker of the new domains.
+	defer func(runWorker bool) { ddl.RunWorker = runWorker }(ddl.RunWorker)
+	bc, err := raw.NewBackupClient(backer)
+	c.Assert(err, IsNil)
+	c.Assert(bc.SetStorage(storage), IsNil)
+	dbInfo, ok := s.dom.InfoSchema().SchemaByName(model.NewCIStr("src"))
+	c.Assert(ok, IsTrue)
+	tables := make([]*utils.Table, 0, 2)
+	for _, name := range []string{"t1", "t2"} {
+		_, err = bc.PreBackupTableRanges("src", name, "", backupTS)
+		c.Assert(err, IsNil)
+		tables = append(tables, &utils.Table{Db: dbInfo, Schema: s.getTableInfo(c, "src", name)})
+	}
+	c.Assert(storage.FileExists(utils.StatsFile(tables[0].Schema.ID)), IsTrue)
+	c.Assert(storage.FileExists(utils.StatsFile(tables[1].Schema.ID)), IsFalse)
+
+	// Restore the tables with new IDs.
+	tk.MustExec("drop database src")
+	tk.MustExec("create database src")
+	tk.MustExec("create table src.t1 (a int, b int, index ib (b))")
+	tk.MustExec("create table src.t2 (a int)")
+	newT1, newT2 := s.getTableInfo(c, "src", "t1"), s.getTableInfo(c, "src", "t2")
+	c.Assert(newT1.ID, Not(Equals), tables[0].Schema.ID)
+
+	rc := &Client{
+		ctx:      ctx,
+		cancel:   cancel,
+		pdClient: pdClient,
+		dom:      s.dom,
+		storage:  storage,
+		dbDSN:    "root@tcp(127.0.0.1:4001)/",
+	}
+	missing, err := rc.RestoreStats(tables)
+	c.Assert(err, IsNil)
+	c.Assert(missing, DeepEquals, []*utils.Table{tables[1]})
+	stats := s.dom.StatsHandle().GetTableStats(newT1)
+	c.Assert(stats.Pseudo, IsFalse)
+	c.Assert(stats.Count, Equals, int64(3))
+	c.Assert(stats.Indices, HasLen, 1)
+
+	// The tables without statistics are analyzed.
+	c.Assert(s.dom.StatsHandle().GetTableStats(newT2).Pseudo, IsTrue)
+	tk.MustExec("insert into src.t2 values (1), (2)")
+	rc.AnalyzeTables(missing)()
+	c.Assert(s.dom.StatsHandle().Update(s.dom.InfoSchema()), IsNil)
+	stats = s.dom.StatsHandle().GetTableStats(newT2)
+	c.Assert(stats.Pseudo, IsFalse)
+	c.Assert(stats.Count, Equals, int64(2))
+}
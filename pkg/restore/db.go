@@ -2,6 +2,7 @@ package restore
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
 	"net/url"
@@ -12,6 +13,8 @@ import (
 	"github.com/pingcap/log"
 	"github.com/pingcap/parser/model"
 	"github.com/pingcap/parser/mysql"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/session"
 	tidbTable "github.com/pingcap/tidb/table"
 	"github.com/pingcap/tidb/types"
 	"github.com/pingcap/tidb/util/format"
@@ -20,6 +23,13 @@ import (
 	"github.com/pingcap/br/pkg/utils"
 )
 
+// DB is the database which restore executes SQL statements on. It is either a
+// TiDB server connected with a DSN, or a session embedded in BR.
+type DB interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Close() error
+}
+
 // OpenDatabase opens a database with dsn.
 func OpenDatabase(dbName string, dsn string) (*sql.DB, error) {
 	dbDSN := dsn + url.QueryEscape(dbName)
@@ -30,15 +40,50 @@ func OpenDatabase(dbName string, dsn string) (*sql.DB, error) {
 	return db, err
 }
 
-// CreateDatabase executes a CREATE DATABASE SQL.
-func CreateDatabase(schema *model.DBInfo, dsn string) error {
-	db, err := sql.Open("mysql", dsn)
+// embeddedDB executes SQL statements with a session on the storage directly,
+// so no TiDB server is needed.
+type embeddedDB struct {
+	se session.Session
+}
+
+// OpenEmbeddedDatabase opens a database with a session on the storage.
+func OpenEmbeddedDatabase(dbName string, store kv.Storage) (DB, error) {
+	se, err := session.CreateSession(store)
 	if err != nil {
-		log.Error("open database failed", zap.String("addr", dsn), zap.Error(err))
-		return errors.Trace(err)
+		return nil, errors.Trace(err)
+	}
+	db := &embeddedDB{se: se}
+	if dbName != "" {
+		if _, err = db.Exec("USE " + utils.EncloseName(dbName)); err != nil {
+			se.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// Exec executes a SQL statement. Arguments are not supported.
+func (db *embeddedDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	if len(args) > 0 {
+		return nil, errors.New("arguments are not supported by the embedded session")
+	}
+	rss, err := db.se.Execute(context.Background(), query)
+	for _, rs := range rss {
+		_ = rs.Close()
 	}
+	return nil, errors.Trace(err)
+}
+
+// Close closes the session.
+func (db *embeddedDB) Close() error {
+	db.se.Close()
+	return nil
+}
+
+// CreateDatabase executes a CREATE DATABASE SQL.
+func CreateDatabase(db DB, schema *model.DBInfo) error {
 	createSQL := GetCreateDatabaseSQL(schema)
-	_, err = db.Exec(createSQL)
+	_, err := db.Exec(createSQL)
 	if err != nil {
 		log.Error("create database failed", zap.String("SQL", createSQL), zap.Error(err))
 		return errors.Trace(err)
@@ -47,7 +92,7 @@ func CreateDatabase(schema *model.DBInfo, dsn string) error {
 }
 
 // CreateTable executes a CREATE TABLE SQL.
-func CreateTable(db *sql.DB, table *utils.Table) error {
+func CreateTable(db DB, table *utils.Table) error {
 	createSQL := GetCreateTableSQL(table.Schema)
 	_, err := db.Exec(createSQL)
 	if err != nil {
@@ -60,38 +105,28 @@ func CreateTable(db *sql.DB, table *utils.Table) error {
 	return nil
 }
 
-// AnalyzeTable executes a ANALYZE TABLE SQL.
-func AnalyzeTable(db *sql.DB, table *utils.Table) error {
-	analyzeSQL := fmt.Sprintf("ANALYZE TABLE %s", utils.EncloseName(table.Schema.Name.String()))
-	_, err := db.Exec(analyzeSQL)
+// CreateView executes a CREATE VIEW SQL.
+func CreateView(db DB, view *utils.Table) error {
+	createSQL := GetCreateViewSQL(view.Schema)
+	_, err := db.Exec(createSQL)
 	if err != nil {
-		log.Error("analyze table failed", zap.String("SQL", analyzeSQL), zap.Error(err))
+		log.Error("create view failed",
+			zap.String("SQL", createSQL),
+			zap.Stringer("db", view.Db.Name),
+			zap.Error(err))
 		return errors.Trace(err)
 	}
 	return nil
 }
 
-// AlterAutoIncID alters max auto-increment id of table.
-func AlterAutoIncID(db *sql.DB, table *utils.Table) error {
-	alterIDSQL := fmt.Sprintf(
-		"ALTER TABLE %s auto_increment = %d",
-		utils.EncloseName(table.Schema.Name.String()),
-		table.Schema.AutoIncID,
-	)
-	_, err := db.Exec(alterIDSQL)
+// AnalyzeTable executes a ANALYZE TABLE SQL.
+func AnalyzeTable(db DB, table *utils.Table) error {
+	analyzeSQL := fmt.Sprintf("ANALYZE TABLE %s", utils.EncloseName(table.Schema.Name.String()))
+	_, err := db.Exec(analyzeSQL)
 	if err != nil {
-		log.Error("alter auto inc id failed",
-			zap.String("SQL", alterIDSQL),
-			zap.Stringer("db", table.Db.Name),
-			zap.Error(err),
-		)
+		log.Error("analyze table failed", zap.String("SQL", analyzeSQL), zap.Error(err))
 		return errors.Trace(err)
 	}
-	log.Info("alter auto inc id",
-		zap.Stringer("table", table.Schema.Name),
-		zap.Stringer("db", table.Db.Name),
-		zap.Int64("auto_inc_id", table.Schema.AutoIncID),
-	)
 	return nil
 }
 
@@ -111,7 +146,7 @@ func GetCreateTableSQL(t *model.TableInfo) string {
 
 	tblCharset := t.Charset
 	tblCollate := t.Collate
-	fmt.Fprintf(&buf, "CREATE TABLE IF NOT EXISTS %s (\n", t.Name)
+	fmt.Fprintf(&buf, "CREATE TABLE IF NOT EXISTS %s (\n", utils.EncloseName(t.Name.O))
 	var pkCol *model.ColumnInfo
 	for i, col := range t.Columns {
 		fmt.Fprintf(&buf, "  %s %s", utils.EncloseName(col.Name.String()), getColumnTypeDesc(col))
@@ -205,13 +240,19 @@ func GetCreateTableSQL(t *model.TableInfo) string {
 
 		cols := make([]string, 0, len(idx.Columns))
 		for _, c := range idx.Columns {
-			colInfo := c.Name.String()
+			colInfo := utils.EncloseName(c.Name.String())
 			if c.Length != types.UnspecifiedLength {
 				colInfo = fmt.Sprintf("%s(%s)", colInfo, strconv.Itoa(c.Length))
 			}
 			cols = append(cols, colInfo)
 		}
 		fmt.Fprintf(&buf, "(%s)", strings.Join(cols, ","))
+		if idx.Tp != model.IndexTypeInvalid {
+			fmt.Fprintf(&buf, " USING %s", idx.Tp)
+		}
+		if len(idx.Comment) > 0 {
+			fmt.Fprintf(&buf, " COMMENT '%s'", format.OutputFormat(idx.Comment))
+		}
 		if i != len(publicIndices)-1 {
 			buf.WriteString(",\n")
 		}
@@ -230,6 +271,12 @@ func GetCreateTableSQL(t *model.TableInfo) string {
 		fmt.Fprintf(&buf, " DEFAULT CHARSET=%s COLLATE=%s", tblCharset, tblCollate)
 	}
 
+	// Rebase the auto-increment ID when creating the table, so that no
+	// ALTER TABLE is needed after it.
+	if t.AutoIncID > 1 {
+		fmt.Fprintf(&buf, " AUTO_INCREMENT=%d", t.AutoIncID)
+	}
+
 	// Displayed if the compression typed is set.
 	if len(t.Compression) != 0 {
 		fmt.Fprintf(&buf, " COMPRESSION='%s'", t.Compression)
@@ -253,6 +300,32 @@ func GetCreateTableSQL(t *model.TableInfo) string {
 	return buf.String()
 }
 
+// GetCreateViewSQL generates a CREATE VIEW SQL from TableInfo of a view.
+func GetCreateViewSQL(t *model.TableInfo) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "CREATE OR REPLACE ALGORITHM=%s ", t.View.Algorithm.String())
+	if t.View.Definer != nil {
+		fmt.Fprintf(&buf, "DEFINER=%s@%s ",
+			utils.EncloseName(t.View.Definer.Username), utils.EncloseName(t.View.Definer.Hostname))
+	}
+	fmt.Fprintf(&buf, "SQL SECURITY %s ", t.View.Security.String())
+	fmt.Fprintf(&buf, "VIEW %s (", utils.EncloseName(t.Name.O))
+	for i, col := range t.Columns {
+		buf.WriteString(utils.EncloseName(col.Name.O))
+		if i < len(t.Columns)-1 {
+			buf.WriteString(", ")
+		}
+	}
+	fmt.Fprintf(&buf, ") AS %s", t.View.SelectStmt)
+	// A view without check option is saved as CASCADED, so only LOCAL is
+	// known to be specified explicitly.
+	if t.View.CheckOption == model.CheckOptionLocal {
+		buf.WriteString(" WITH LOCAL CHECK OPTION")
+	}
+	buf.WriteString(";")
+	return buf.String()
+}
+
 func getColumnTypeDesc(col *model.ColumnInfo) string {
 	desc := col.FieldType.CompactStr()
 	if mysql.HasUnsignedFlag(col.Flag) && col.Tp != mysql.TypeBit && col.Tp != mysql.TypeYear {
@@ -268,27 +341,33 @@ func appendPartitionInfo(partitionInfo *model.PartitionInfo, buf *bytes.Buffer)
 	if partitionInfo == nil {
 		return
 	}
-	if partitionInfo.Type == model.PartitionTypeHash {
+	switch partitionInfo.Type {
+	case model.PartitionTypeHash:
 		fmt.Fprintf(buf, "\nPARTITION BY HASH( %s )", partitionInfo.Expr)
 		fmt.Fprintf(buf, "\nPARTITIONS %d", partitionInfo.Num)
 		return
+	case model.PartitionTypeRange:
+	default:
+		// Other partition types are discarded by TiDB when creating the
+		// table, so they never appear in a backup.
+		return
 	}
 	// this if statement takes care of range columns case
-	if partitionInfo.Columns != nil && partitionInfo.Type == model.PartitionTypeRange {
-		buf.WriteString("\nPARTITION BY RANGE COLUMNS(")
-		for i, col := range partitionInfo.Columns {
-			buf.WriteString(col.L)
-			if i < len(partitionInfo.Columns)-1 {
-				buf.WriteString(",")
-			}
+	if partitionInfo.Columns != nil {
+		cols := make([]string, 0, len(partitionInfo.Columns))
+		for _, col := range partitionInfo.Columns {
+			cols = append(cols, utils.EncloseName(col.O))
 		}
-		buf.WriteString(") (\n")
+		fmt.Fprintf(buf, "\nPARTITION BY RANGE COLUMNS(%s) (\n", strings.Join(cols, ","))
 	} else {
-		fmt.Fprintf(buf, "\nPARTITION BY %s ( %s ) (\n", partitionInfo.Type.String(), partitionInfo.Expr)
+		fmt.Fprintf(buf, "\nPARTITION BY RANGE ( %s ) (\n", partitionInfo.Expr)
 	}
 	for i, def := range partitionInfo.Definitions {
 		lessThans := strings.Join(def.LessThan, ",")
 		fmt.Fprintf(buf, "  PARTITION %s VALUES LESS THAN (%s)", utils.EncloseName(def.Name.String()), lessThans)
+		if len(def.Comment) > 0 {
+			fmt.Fprintf(buf, " COMMENT '%s'", format.OutputFormat(def.Comment))
+		}
 		if i < len(partitionInfo.Definitions)-1 {
 			buf.WriteString(",\n")
 		} else {
@@ -1,11 +1,12 @@
 package restore
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"math"
 	"net/http"
 	"strconv"
 	"testing"
@@ -14,15 +15,19 @@ import (
 	"github.com/go-sql-driver/mysql"
 	. "github.com/pingcap/check"
 	"github.com/pingcap/log"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
 	"github.com/pingcap/parser/model"
+	tmysql "github.com/pingcap/parser/mysql"
 	"github.com/pingcap/tidb/config"
 	"github.com/pingcap/tidb/domain"
 	"github.com/pingcap/tidb/kv"
-	"github.com/pingcap/tidb/meta/autoid"
 	"github.com/pingcap/tidb/server"
 	"github.com/pingcap/tidb/session"
 	"github.com/pingcap/tidb/store/mockstore"
 	"github.com/pingcap/tidb/store/mockstore/mocktikv"
+	"github.com/pingcap/tidb/store/tikv"
+	"github.com/pingcap/tidb/tablecodec"
 	"github.com/pingcap/tidb/util/testkit"
 	"github.com/pingcap/tidb/util/testleak"
 	"go.uber.org/zap"
@@ -116,37 +121,189 @@ func (s *testRestoreSchemaSuite) TestRestoreAutoIncID(c *C) {
 	tk := testkit.NewTestKit(c, s.store)
 	tk.MustExec("use test")
 	tk.MustExec("drop table if exists t;")
+	// The table has no auto_increment column, the rows are allocated by the
+	// implicit _tidb_rowid.
 	tk.MustExec("create table t (a int);")
 	tk.MustExec("insert into t values (10);")
 	// Query the current AutoIncID
-	autoIncID, err := strconv.ParseUint(tk.MustQuery("admin show t next_row_id").Rows()[0][3].(string), 10, 64)
+	autoIncID, err := strconv.ParseInt(tk.MustQuery("admin show t next_row_id").Rows()[0][3].(string), 10, 64)
 	c.Assert(err, IsNil, Commentf("Error query auto inc id: %s", err))
-	// Get schemas of db and table
-	info, err := s.dom.GetSnapshotInfoSchema(math.MaxUint64)
-	c.Assert(err, IsNil, Commentf("Error get snapshot info schema: %s", err))
-	dbInfo, exists := info.SchemaByName(model.NewCIStr("test"))
-	c.Assert(exists, IsTrue, Commentf("Error get db info"))
-	tableInfo, err := info.TableByName(model.NewCIStr("test"), model.NewCIStr("t"))
-	c.Assert(err, IsNil, Commentf("Error get table info: %s", err))
-	table := utils.Table{
-		Schema: tableInfo.Meta(),
-		Db:     dbInfo,
-	}
-	// Get the next AutoIncID
-	idAlloc := autoid.NewAllocator(s.store, dbInfo.ID, false)
-	globalAutoID, err := idAlloc.NextGlobalAutoID(table.Schema.ID)
-	c.Assert(err, IsNil, Commentf("Error allocate next auto id"))
-	c.Assert(autoIncID, Equals, uint64(globalAutoID))
-	// Alter AutoIncID to the next AutoIncID + 100
-	table.Schema.AutoIncID = globalAutoID + 100
+	dbInfo, ok := s.dom.InfoSchema().SchemaByName(model.NewCIStr("test"))
+	c.Assert(ok, IsTrue)
+	table := utils.Table{Db: dbInfo, Schema: s.getTableInfo(c, "test", "t")}
+	// Restore the table with the AutoIncID + 100
+	table.Schema.AutoIncID = autoIncID + 100
+	tk.MustExec("drop table t;")
 	db, err := OpenDatabase(dbInfo.Name.String(), "root@tcp(127.0.0.1:4001)/")
 	c.Assert(err, IsNil, Commentf("Error open database"))
-	err = AlterAutoIncID(db, &table)
-	c.Assert(err, IsNil, Commentf("Error alter auto inc id: %s", err))
-	// Check if AutoIncID is altered successfully
-	autoIncID, err = strconv.ParseUint(tk.MustQuery("admin show t next_row_id").Rows()[0][3].(string), 10, 64)
+	defer db.Close()
+	c.Assert(CreateTable(db, &table), IsNil)
+	// Check if the row id allocator is restored
+	newAutoIncID, err := strconv.ParseInt(tk.MustQuery("admin show t next_row_id").Rows()[0][3].(string), 10, 64)
 	c.Assert(err, IsNil, Commentf("Error query auto inc id: %s", err))
-	c.Assert(autoIncID, Equals, uint64(globalAutoID+100))
+	c.Assert(newAutoIncID, Equals, autoIncID+100)
+	tk.MustExec("insert into t values (11);")
+	tk.MustQuery("select _tidb_rowid from t").Check(testkit.Rows(strconv.FormatInt(autoIncID+100, 10)))
+}
+
+// normalizeTableInfo clears the fields which are assigned by the cluster, so
+// that a table rebuilt from its DDL compares equal to the original.
+func normalizeTableInfo(c *C, t *model.TableInfo) string {
+	data, err := json.Marshal(t)
+	c.Assert(err, IsNil)
+	n := &model.TableInfo{}
+	c.Assert(json.Unmarshal(data, n), IsNil)
+	n.ID = 0
+	n.Name = model.CIStr{}
+	n.UpdateTS = 0
+	n.AutoIncID = 0
+	n.MaxColumnID = 0
+	n.MaxIndexID = 0
+	for _, col := range n.Columns {
+		// TiDB sets the flag only for the columns declared NOT NULL
+		// explicitly, but not for the primary key columns.
+		col.Flag &^= tmysql.NoDefaultValueFlag
+	}
+	for _, idx := range n.Indices {
+		idx.ID = 0
+	}
+	if n.Partition != nil {
+		for i := range n.Partition.Definitions {
+			n.Partition.Definitions[i].ID = 0
+		}
+	}
+	data, err = json.Marshal(n)
+	c.Assert(err, IsNil)
+	return string(data)
+}
+
+func (s *testRestoreSchemaSuite) TestCreateTableSQLRoundTrip(c *C) {
+	s.startServer(c)
+	defer s.stopServer(c)
+	tk := testkit.NewTestKit(c, s.store)
+	tk.MustExec("use test")
+	tk.MustExec("set @@tidb_enable_table_partition = 'on'")
+	ddls := []string{
+		"create table `t``1` (`a b` int primary key, c varchar(20) default 'x' comment 'col c', " +
+			"key `i``1` (`a b`, c(10)) using hash comment 'idx 1') comment 'table t1'",
+		"create table t2 (a bigint not null auto_increment, b decimal(10, 2), " +
+			"c timestamp(3) default current_timestamp(3) on update current_timestamp(3), " +
+			"d bit(4) default b'101', e decimal(11, 2) as (b + 1) virtual, " +
+			"f char(10) charset latin1 collate latin1_bin, " +
+			"primary key (a, b) using btree, unique key uk (b, c)) shard_row_id_bits = 4 pre_split_regions = 2",
+		"create table t3 (a int, b int, index ib (b)) partition by hash(a) partitions 3",
+		"create table t4 (a int, b datetime, unique key (a, b)) partition by range columns(b) (" +
+			"partition p0 values less than ('2020-01-01') comment 'old', " +
+			"partition `p 1` values less than (maxvalue))",
+		"create table t5 (a int, b int) partition by range (a + b) (" +
+			"partition p0 values less than (10), partition p1 values less than (100))",
+	}
+	for i, ddl := range ddls {
+		tk.MustExec(ddl)
+		name := []string{"t`1", "t2", "t3", "t4", "t5"}[i]
+		origin := s.getTableInfo(c, "test", name)
+
+		sql := GetCreateTableSQL(origin)
+		stmts, _, err := parser.New().Parse(sql, "", "")
+		c.Assert(err, IsNil, Commentf("sql: %s", sql))
+		c.Assert(stmts, HasLen, 1)
+		stmt, ok := stmts[0].(*ast.CreateTableStmt)
+		c.Assert(ok, IsTrue)
+		c.Assert(stmt.Table.Name.O, Equals, name)
+
+		renamed := origin.Clone()
+		renamed.Name = model.NewCIStr(name + "_rebuilt")
+		tk.MustExec(GetCreateTableSQL(renamed))
+		rebuilt := s.getTableInfo(c, "test", name+"_rebuilt")
+		c.Assert(normalizeTableInfo(c, rebuilt), DeepEquals, normalizeTableInfo(c, origin),
+			Commentf("sql: %s", sql))
+	}
+}
+
+func (s *testRestoreSchemaSuite) TestEmbeddedSession(c *C) {
+	s.startServer(c)
+	defer s.stopServer(c)
+	tk := testkit.NewTestKit(c, s.store)
+	tk.MustExec("drop database if exists src")
+	tk.MustExec("create database src")
+	tk.MustExec("create table src.t (a int primary key auto_increment, b varchar(10))")
+	tk.MustExec("use src")
+	// The definer is empty without a user, so use the invoker.
+	tk.MustExec("create sql security invoker view v as select b from t")
+	dbInfo, ok := s.dom.InfoSchema().SchemaByName(model.NewCIStr("src"))
+	c.Assert(ok, IsTrue)
+	table := &utils.Table{Db: dbInfo, Schema: s.getTableInfo(c, "src", "t")}
+	table.Schema.AutoIncID = 100
+	view := &utils.Table{Db: dbInfo, Schema: s.getTableInfo(c, "src", "v")}
+	tk.MustExec("drop database src")
+	tk.MustExec("use test")
+
+	rc := &Client{tikvCli: s.store.(tikv.Storage), embedded: true}
+	c.Assert(rc.CreateDatabase(dbInfo), IsNil)
+	db, err := rc.openDatabase("src")
+	c.Assert(err, IsNil)
+	defer db.Close()
+	c.Assert(CreateTable(db, table), IsNil)
+	c.Assert(CreateView(db, view), IsNil)
+	_, err = db.Exec("SELECT ?", 1)
+	c.Assert(err, ErrorMatches, "arguments are not supported.*")
+
+	tk.MustExec("insert into src.t (b) values ('x')")
+	tk.MustQuery("select a, b from src.t").Check(testkit.Rows("100 x"))
+	tk.MustExec("use src")
+	tk.MustQuery("select b from v").Check(testkit.Rows("x"))
+}
+
+func (s *testRestoreSchemaSuite) TestCreateTablesInBatches(c *C) {
+	s.startServer(c)
+	defer s.stopServer(c)
+	tk := testkit.NewTestKit(c, s.store)
+	tk.MustExec("drop database if exists src")
+	tk.MustExec("create database src")
+	count := defaultDDLConcurrency*2 + 1
+	for i := 0; i < count; i++ {
+		tk.MustExec(fmt.Sprintf("create table src.t%d (a int primary key auto_increment, b int)", i))
+	}
+	dbInfo, ok := s.dom.InfoSchema().SchemaByName(model.NewCIStr("src"))
+	c.Assert(ok, IsTrue)
+	tables := make([]*utils.Table, 0, count)
+	for i := 0; i < count; i++ {
+		table := &utils.Table{Db: dbInfo, Schema: s.getTableInfo(c, "src", fmt.Sprintf("t%d", i))}
+		table.Schema.AutoIncID = int64(100 + i)
+		tables = append(tables, table)
+	}
+	tk.MustExec("drop database src")
+	tk.MustExec("create database src")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rc := &Client{
+		ctx:      ctx,
+		cancel:   cancel,
+		pdClient: mocktikv.NewPDClient(s.cluster),
+		dom:      s.dom,
+		dbDSN:    "root@tcp(127.0.0.1:4001)/",
+	}
+	createdCh := make(chan *createdTable, count)
+	c.Assert(rc.createTablesInBatches(tables, createdCh), IsNil)
+	close(createdCh)
+	i := 0
+	for created := range createdCh {
+		c.Assert(created.table, Equals, tables[i])
+		c.Assert(created.newTable.Name.O, Equals, fmt.Sprintf("t%d", i))
+		c.Assert(created.newTable.ID, Equals, s.getTableInfo(c, "src", created.newTable.Name.O).ID)
+		c.Assert(created.rewriteRules.Table, HasLen, 2)
+		c.Assert(created.rewriteRules.Table[0].GetNewKeyPrefix(), DeepEquals,
+			[]byte(tablecodec.EncodeTablePrefix(created.newTable.ID)))
+		i++
+	}
+	c.Assert(i, Equals, count)
+	tk.MustExec("insert into src.t3 (b) values (1)")
+	tk.MustQuery("select a from src.t3").Check(testkit.Rows("103"))
+
+	// Tables which fail to be created are reported.
+	tk.MustExec("drop database src")
+	c.Assert(rc.createTablesInBatches(tables, make(chan *createdTable, count)), NotNil)
 }
 
 type configOverrider func(*mysql.Config)
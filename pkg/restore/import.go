@@ -1,7 +1,9 @@
 package restore
 
 import (
+	"bytes"
 	"context"
+	"sort"
 	"sync"
 	"time"
 
@@ -10,10 +12,13 @@ import (
 	"github.com/pingcap/kvproto/pkg/backup"
 	"github.com/pingcap/kvproto/pkg/import_sstpb"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/log"
 	restore_util "github.com/pingcap/tidb-tools/pkg/restore-util"
 	"go.uber.org/zap"
-	"google.golang.org/grpc"
+
+	"github.com/pingcap/br/pkg/backoff"
+	"github.com/pingcap/br/pkg/utils"
 )
 
 var (
@@ -25,36 +30,186 @@ var (
 
 const (
 	importScanResgionTime     = 10 * time.Second
-	importFileRetryTimes      = 16
-	importFileWaitInterval    = 10 * time.Millisecond
-	importFileMaxWaitInterval = 1 * time.Second
+	ingestNotLeaderRetryTimes = 4
+)
 
-	downloadSSTRetryTimes      = 8
-	downloadSSTWaitInterval    = 10 * time.Millisecond
-	downloadSSTMaxWaitInterval = 1 * time.Second
+var (
+	importFileBackoff = backoff.Register("import-file", backoff.Policy{
+		Attempts:  16,
+		BaseDelay: 20 * time.Millisecond,
+		MaxDelay:  time.Second,
+		Jitter:    0.2,
+	})
+	importRegionBackoff = backoff.Register("import-region", backoff.Policy{
+		Attempts:  8,
+		BaseDelay: 10 * time.Millisecond,
+		MaxDelay:  time.Second,
+	})
+	downloadSSTBackoff = backoff.Register("download-sst", backoff.Policy{
+		Attempts:  8,
+		BaseDelay: 20 * time.Millisecond,
+		MaxDelay:  time.Second,
+		Jitter:    0.2,
+	})
 )
 
+// classifyImportError classifies the errors of importing a file.
+func classifyImportError(err error) backoff.ErrorClass {
+	switch errors.Cause(err) {
+	case errRewriteRuleNotFound, errRangeIsEmpty:
+		// Scan regions may return some regions which cannot match any rewrite
+		// rule, like [t{tableID}, t{tableID}_r), those regions and the empty
+		// files should be skipped.
+		return backoff.Fatal
+	case errNotLeader, errEpochNotMatch:
+		return backoff.RegionError
+	default:
+		return backoff.Retryable
+	}
+}
+
+// storeLimiter limits the number of concurrent requests sent to each store.
+type storeLimiter struct {
+	mu     sync.Mutex
+	limit  uint
+	tokens map[uint64]chan struct{}
+}
+
+func newStoreLimiter(limit uint) *storeLimiter {
+	return &storeLimiter{
+		limit:  limit,
+		tokens: make(map[uint64]chan struct{}),
+	}
+}
+
+// acquire blocks until a request can be sent to the store. A zero limit
+// means no limit.
+func (l *storeLimiter) acquire(ctx context.Context, storeID uint64) error {
+	if l.limit == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	tokens, ok := l.tokens[storeID]
+	if !ok {
+		tokens = make(chan struct{}, l.limit)
+		l.tokens[storeID] = tokens
+	}
+	l.mu.Unlock()
+	select {
+	case tokens <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return errors.Trace(ctx.Err())
+	}
+}
+
+// release must be called after a successful acquire.
+func (l *storeLimiter) release(storeID uint64) {
+	if l.limit == 0 {
+		return
+	}
+	l.mu.Lock()
+	tokens := l.tokens[storeID]
+	l.mu.Unlock()
+	<-tokens
+}
+
 // FileImporter used to import a file to TiKV.
 type FileImporter struct {
-	mu            sync.Mutex
-	client        restore_util.Client
-	fileURL       string
-	importClients map[uint64]import_sstpb.ImportSSTClient
+	client  restore_util.Client
+	fileURL string
+	// getImportClient returns an import client to the store.
+	getImportClient func(storeID uint64) (import_sstpb.ImportSSTClient, error)
+	// rateLimit is the download speed limit of each store in bytes/s.
+	rateLimit    uint64
+	storeLimiter *storeLimiter
 
 	ctx    context.Context
 	cancel context.CancelFunc
 }
 
-// NewFileImporter returns a new file importer.
-func NewFileImporter(ctx context.Context, client restore_util.Client, fileURL string) FileImporter {
+// NewFileImporter returns a new file importer, which sends requests through
+// the connections to the stores.
+func NewFileImporter(
+	ctx context.Context, client restore_util.Client, fileURL string, conns *utils.StoreConns,
+) FileImporter {
 	ctx, cancel := context.WithCancel(ctx)
 	return FileImporter{
-		client:        client,
-		fileURL:       fileURL,
-		ctx:           ctx,
-		cancel:        cancel,
-		importClients: make(map[uint64]import_sstpb.ImportSSTClient),
+		client:  client,
+		fileURL: fileURL,
+		getImportClient: func(storeID uint64) (import_sstpb.ImportSSTClient, error) {
+			conn, err := conns.GetConn(storeID)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			return import_sstpb.NewImportSSTClient(conn), nil
+		},
+		ctx:          ctx,
+		cancel:       cancel,
+		storeLimiter: newStoreLimiter(0),
+	}
+}
+
+// SetRateLimit sets the download speed limit of each store in MB/s, zero
+// means no limit.
+func (importer *FileImporter) SetRateLimit(rateMBs uint64) {
+	// The unit of rate limit in protocol is bytes per second.
+	importer.rateLimit = rateMBs * 1024 * 1024
+}
+
+// SetStoreConcurrency sets the maximum number of concurrent downloads and
+// ingests on each store, zero means no limit.
+func (importer *FileImporter) SetStoreConcurrency(concurrency uint) {
+	importer.storeLimiter = newStoreLimiter(concurrency)
+}
+
+// keyRange is a range of encoded keys.
+type keyRange struct {
+	start []byte
+	end   []byte
+}
+
+// intersect returns the part of the range in the region.
+func (r keyRange) intersect(region *metapb.Region) keyRange {
+	start, end := r.start, r.end
+	if bytes.Compare(start, region.GetStartKey()) < 0 {
+		start = region.GetStartKey()
+	}
+	if len(region.GetEndKey()) > 0 && bytes.Compare(end, region.GetEndKey()) > 0 {
+		end = region.GetEndKey()
+	}
+	return keyRange{start: start, end: end}
+}
+
+// coveredBy checks whether the regions cover the whole range.
+func (r keyRange) coveredBy(regions []*metapb.Region) bool {
+	sorted := append([]*metapb.Region{}, regions...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].GetStartKey(), sorted[j].GetStartKey()) < 0
+	})
+	pos := r.start
+	for _, region := range sorted {
+		if bytes.Compare(pos, r.end) >= 0 {
+			return true
+		}
+		if bytes.Compare(region.GetStartKey(), pos) > 0 {
+			// There is a gap before the region.
+			return false
+		}
+		if len(region.GetEndKey()) == 0 {
+			return true
+		}
+		if bytes.Compare(region.GetEndKey(), pos) > 0 {
+			pos = region.GetEndKey()
+		}
 	}
+	return bytes.Compare(pos, r.end) >= 0
+}
+
+// overlaps checks whether two regions overlap.
+func overlaps(a, b *metapb.Region) bool {
+	return (len(a.GetEndKey()) == 0 || bytes.Compare(b.GetStartKey(), a.GetEndKey()) < 0) &&
+		(len(b.GetEndKey()) == 0 || bytes.Compare(a.GetStartKey(), b.GetEndKey()) < 0)
 }
 
 // Import tries to import a file.
@@ -71,96 +226,156 @@ func (importer *FileImporter) Import(file *backup.File, rewriteRules *restore_ut
 		log.Error("cannot find a rewrite rule for file end key", zap.Stringer("file", file))
 		return errRewriteRuleNotFound
 	}
-	err := withRetry(func() error {
-		ctx, cancel := context.WithTimeout(importer.ctx, importScanResgionTime)
-		defer cancel()
-		// Scan regions covered by the file range
-		regionInfos, err := importer.client.ScanRegions(ctx, scanStartKey, scanEndKey, 0)
-		if err != nil {
-			return errors.Trace(err)
-		}
-		// Try to download and ingest the file in every region
-		for _, regionInfo := range regionInfos {
-			var downloadMeta *import_sstpb.SSTMeta
-			info := regionInfo
-			// Try to download file.
-			err = withRetry(func() error {
-				var err error
-				var isEmpty bool
-				downloadMeta, isEmpty, err = importer.downloadSST(info, file, rewriteRules)
+	// The ranges of the file which are not imported yet, so that the regions
+	// which already succeeded are not redone on retry.
+	pending := []keyRange{{start: scanStartKey, end: scanEndKey}}
+	err := importFileBackoff.Retry(importer.ctx, classifyImportError, func() error {
+		remaining := make([]keyRange, 0)
+		var lastErr error
+		for _, r := range pending {
+			ctx, cancel := context.WithTimeout(importer.ctx, importScanResgionTime)
+			// Scan regions covered by the file range
+			regionInfos, err := importer.client.ScanRegions(ctx, r.start, r.end, 0)
+			cancel()
+			if err != nil {
+				remaining = append(remaining, r)
+				lastErr = errors.Trace(err)
+				continue
+			}
+			// Try to download and ingest the file in every region
+			for _, info := range regionInfos {
+				err = importer.importRegion(r, info, file, rewriteRules)
 				if err != nil {
-					if err != errRewriteRuleNotFound {
-						log.Warn("download file failed",
-							zap.Stringer("file", file),
-							zap.Stringer("region", info.Region),
-							zap.ByteString("scanStartKey", scanStartKey),
-							zap.ByteString("scanEndKey", scanEndKey),
-							zap.Error(err),
-						)
-					}
-					return err
-				}
-				if isEmpty {
-					log.Info(
-						"file don't have any key in this region, skip it",
+					log.Warn("import file to region failed",
 						zap.Stringer("file", file),
 						zap.Stringer("region", info.Region),
+						zap.Error(err),
 					)
-					return errRangeIsEmpty
+					remaining = append(remaining, r.intersect(info.Region))
+					lastErr = err
 				}
-				return nil
-			}, func(e error) bool {
-				// Scan regions may return some regions which cannot match any rewrite rule,
-				// like [t{tableID}, t{tableID}_r), those regions should be skipped
-				return e != errRewriteRuleNotFound &&
-					// Skip empty files
-					e != errRangeIsEmpty
-			}, downloadSSTRetryTimes, downloadSSTWaitInterval, downloadSSTMaxWaitInterval)
-			if err != nil {
-				if err == errRewriteRuleNotFound || err == errRangeIsEmpty {
-					// Skip this region
-					continue
+			}
+		}
+		pending = remaining
+		return lastErr
+	})
+	return err
+}
+
+// importRegion downloads and ingests the part of the file in fileRange into a
+// region. The region errors of ingest are handled here, so that only the
+// affected regions are redone.
+func (importer *FileImporter) importRegion(
+	fileRange keyRange,
+	info *restore_util.RegionInfo,
+	file *backup.File,
+	rewriteRules *restore_util.RewriteRules,
+) error {
+	regions := []*restore_util.RegionInfo{info}
+	bo := importRegionBackoff.NewBackoffer(importer.ctx, classifyImportError)
+	for len(regions) > 0 {
+		region := regions[0]
+		regions = regions[1:]
+		downloadMeta, err := importer.downloadRegion(region, file, rewriteRules)
+		if err != nil {
+			return err
+		}
+		if downloadMeta == nil {
+			// The file has no key in this region.
+			continue
+		}
+		currentRegions, err := importer.ingestSST(downloadMeta, region)
+		if err == nil {
+			continue
+		}
+		if err != errEpochNotMatch && err != errNotLeader {
+			return err
+		}
+		if boErr := bo.Backoff(err); boErr != nil {
+			return boErr
+		}
+		// The part of the file which should have been ingested.
+		need := fileRange.intersect(region.Region)
+		if err == errEpochNotMatch {
+			// Download the file again only into the current regions which
+			// overlap the stale one. TiKV returns at most the region and one
+			// sibling, so they may not cover the stale region after several
+			// splits.
+			affected := make([]*metapb.Region, 0, len(currentRegions))
+			for _, r := range currentRegions {
+				if overlaps(r, region.Region) {
+					affected = append(affected, r)
 				}
-				return err
 			}
-			err = importer.ingestSST(downloadMeta, info)
-			if err != nil {
-				log.Warn("ingest file failed",
+			if len(affected) > 0 && need.coveredBy(affected) {
+				log.Info("region epoch not match, import to the current regions",
+					zap.Stringer("region", region.Region),
+					zap.Int("current regions", len(affected)))
+				infos := make([]*restore_util.RegionInfo, 0, len(affected))
+				for _, r := range affected {
+					infos = append(infos, &restore_util.RegionInfo{Region: r})
+				}
+				regions = append(infos, regions...)
+				continue
+			}
+		}
+		// The leader or the current regions are unknown, scan the regions of
+		// the range from PD again. The region may have been split, so it is
+		// not got by ID, which returns only the shrunk region.
+		ctx, cancel := context.WithTimeout(importer.ctx, importScanResgionTime)
+		newRegions, err := importer.client.ScanRegions(ctx, need.start, need.end, 0)
+		cancel()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(newRegions) == 0 {
+			return errors.Errorf("no region found in [%x, %x)", need.start, need.end)
+		}
+		regions = append(newRegions, regions...)
+	}
+	return nil
+}
+
+// downloadRegion downloads the file into a region. It returns nil if the file
+// has no key in the region.
+func (importer *FileImporter) downloadRegion(
+	info *restore_util.RegionInfo,
+	file *backup.File,
+	rewriteRules *restore_util.RewriteRules,
+) (*import_sstpb.SSTMeta, error) {
+	var downloadMeta *import_sstpb.SSTMeta
+	err := downloadSSTBackoff.Retry(importer.ctx, classifyImportError, func() error {
+		var err error
+		var isEmpty bool
+		downloadMeta, isEmpty, err = importer.downloadSST(info, file, rewriteRules)
+		if err != nil {
+			if err != errRewriteRuleNotFound {
+				log.Warn("download file failed",
 					zap.Stringer("file", file),
-					zap.Stringer("range", downloadMeta.GetRange()),
 					zap.Stringer("region", info.Region),
 					zap.Error(err),
 				)
-				return err
 			}
+			return err
+		}
+		if isEmpty {
+			log.Info(
+				"file don't have any key in this region, skip it",
+				zap.Stringer("file", file),
+				zap.Stringer("region", info.Region),
+			)
+			return errRangeIsEmpty
 		}
 		return nil
-	}, func(e error) bool {
-		return true
-	}, importFileRetryTimes, importFileWaitInterval, importFileMaxWaitInterval)
-	return err
-}
-
-func (importer *FileImporter) getImportClient(
-	storeID uint64,
-) (import_sstpb.ImportSSTClient, error) {
-	importer.mu.Lock()
-	defer importer.mu.Unlock()
-	client, ok := importer.importClients[storeID]
-	if ok {
-		return client, nil
-	}
-	store, err := importer.client.GetStore(importer.ctx, storeID)
-	if err != nil {
-		return nil, errors.Trace(err)
+	})
+	if err == errRewriteRuleNotFound || err == errRangeIsEmpty {
+		// Skip this region
+		return nil, nil
 	}
-	conn, err := grpc.Dial(store.GetAddress(), grpc.WithInsecure())
 	if err != nil {
-		return nil, errors.Trace(err)
+		return nil, err
 	}
-	client = import_sstpb.NewImportSSTClient(conn)
-	importer.importClients[storeID] = client
-	return client, errors.Trace(err)
+	return downloadMeta, nil
 }
 
 func (importer *FileImporter) downloadSST(
@@ -184,14 +399,11 @@ func (importer *FileImporter) downloadSST(
 		Url:         importer.fileURL,
 		Name:        file.GetName(),
 		RewriteRule: *regionRule,
+		SpeedLimit:  importer.rateLimit,
 	}
 	var resp *import_sstpb.DownloadResponse
 	for _, peer := range regionInfo.Region.GetPeers() {
-		client, err := importer.getImportClient(peer.GetStoreId())
-		if err != nil {
-			return nil, true, err
-		}
-		resp, err = client.Download(importer.ctx, req)
+		resp, err = importer.download(peer.GetStoreId(), req)
 		if err != nil {
 			return nil, true, err
 		}
@@ -204,40 +416,72 @@ func (importer *FileImporter) downloadSST(
 	return &sstMeta, false, nil
 }
 
+func (importer *FileImporter) download(
+	storeID uint64,
+	req *import_sstpb.DownloadRequest,
+) (*import_sstpb.DownloadResponse, error) {
+	client, err := importer.getImportClient(storeID)
+	if err != nil {
+		return nil, err
+	}
+	if err = importer.storeLimiter.acquire(importer.ctx, storeID); err != nil {
+		return nil, err
+	}
+	defer importer.storeLimiter.release(storeID)
+	return client.Download(importer.ctx, req)
+}
+
+// ingestSST ingests the downloaded file into a region. If the leader changes,
+// it retries with the new leader, since the file is downloaded into all the
+// peers. If the region epoch does not match, it returns the current regions.
 func (importer *FileImporter) ingestSST(
 	fileMeta *import_sstpb.SSTMeta,
 	regionInfo *restore_util.RegionInfo,
-) error {
+) ([]*metapb.Region, error) {
 	leader := regionInfo.Leader
 	if leader == nil {
 		leader = regionInfo.Region.GetPeers()[0]
 	}
-	client, err := importer.getImportClient(leader.GetStoreId())
-	if err != nil {
-		return err
-	}
-	reqCtx := &kvrpcpb.Context{
-		RegionId:    regionInfo.Region.GetId(),
-		RegionEpoch: regionInfo.Region.GetRegionEpoch(),
-		Peer:        leader,
-	}
-	req := &import_sstpb.IngestRequest{
-		Context: reqCtx,
-		Sst:     fileMeta,
-	}
-	resp, err := client.Ingest(importer.ctx, req)
-	if err != nil {
-		return errors.Trace(err)
-	}
-	respErr := resp.GetError()
-	if respErr != nil {
-		if respErr.EpochNotMatch != nil {
-			return errEpochNotMatch
+	for i := 0; i < ingestNotLeaderRetryTimes; i++ {
+		client, err := importer.getImportClient(leader.GetStoreId())
+		if err != nil {
+			return nil, err
+		}
+		reqCtx := &kvrpcpb.Context{
+			RegionId:    regionInfo.Region.GetId(),
+			RegionEpoch: regionInfo.Region.GetRegionEpoch(),
+			Peer:        leader,
 		}
-		if respErr.NotLeader != nil {
-			return errNotLeader
+		req := &import_sstpb.IngestRequest{
+			Context: reqCtx,
+			Sst:     fileMeta,
+		}
+		if err = importer.storeLimiter.acquire(importer.ctx, leader.GetStoreId()); err != nil {
+			return nil, err
+		}
+		resp, err := client.Ingest(importer.ctx, req)
+		importer.storeLimiter.release(leader.GetStoreId())
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		respErr := resp.GetError()
+		switch {
+		case respErr == nil:
+			return nil, nil
+		case respErr.NotLeader != nil:
+			newLeader := respErr.NotLeader.GetLeader()
+			if newLeader == nil {
+				return nil, errNotLeader
+			}
+			log.Info("region leader changed, ingest to the new leader",
+				zap.Stringer("region", regionInfo.Region),
+				zap.Stringer("leader", newLeader))
+			leader = newLeader
+		case respErr.EpochNotMatch != nil:
+			return respErr.EpochNotMatch.GetCurrentRegions(), errEpochNotMatch
+		default:
+			return nil, errors.Errorf("ingest failed: %v", respErr)
 		}
-		return errors.Errorf("ingest failed: %v", respErr)
 	}
-	return nil
+	return nil, errNotLeader
 }
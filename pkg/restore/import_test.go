@@ -0,0 +1,223 @@
+package restore
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	restore_util "github.com/pingcap/tidb-tools/pkg/restore-util"
+	"github.com/pingcap/tidb/tablecodec"
+	"github.com/pingcap/tidb/util/codec"
+	"google.golang.org/grpc"
+)
+
+func (s *testRestoreSchemaSuite) TestStoreLimiter(c *C) {
+	ctx := context.Background()
+	limiter := newStoreLimiter(2)
+	c.Assert(limiter.acquire(ctx, 1), IsNil)
+	c.Assert(limiter.acquire(ctx, 1), IsNil)
+	// Other stores are not affected.
+	c.Assert(limiter.acquire(ctx, 2), IsNil)
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	c.Assert(limiter.acquire(timeoutCtx, 1), NotNil)
+
+	limiter.release(1)
+	c.Assert(limiter.acquire(ctx, 1), IsNil)
+
+	unlimited := newStoreLimiter(0)
+	for i := 0; i < 10; i++ {
+		c.Assert(unlimited.acquire(ctx, 1), IsNil)
+	}
+	unlimited.release(1)
+}
+
+// fakeRegionClient serves a fixed list of regions.
+type fakeRegionClient struct {
+	restore_util.Client
+	regions []*restore_util.RegionInfo
+}
+
+func (f *fakeRegionClient) ScanRegions(
+	ctx context.Context, key, endKey []byte, limit int,
+) ([]*restore_util.RegionInfo, error) {
+	regions := make([]*restore_util.RegionInfo, 0)
+	for _, r := range f.regions {
+		if bytes.Compare(r.Region.GetStartKey(), endKey) < 0 &&
+			(len(r.Region.GetEndKey()) == 0 || bytes.Compare(key, r.Region.GetEndKey()) < 0) {
+			regions = append(regions, r)
+		}
+	}
+	return regions, nil
+}
+
+func (f *fakeRegionClient) GetRegionByID(ctx context.Context, regionID uint64) (*restore_util.RegionInfo, error) {
+	for _, r := range f.regions {
+		if r.Region.GetId() == regionID {
+			return r, nil
+		}
+	}
+	return nil, nil
+}
+
+// mockImportClient records the requests, and answers the ingest requests
+// with the error returned by onIngest.
+type mockImportClient struct {
+	import_sstpb.ImportSSTClient
+	mu        sync.Mutex
+	downloads map[uint64]int
+	ingests   map[uint64][]uint64
+	onIngest  func(req *import_sstpb.IngestRequest) *errorpb.Error
+}
+
+func newMockImportClient(onIngest func(req *import_sstpb.IngestRequest) *errorpb.Error) *mockImportClient {
+	return &mockImportClient{
+		downloads: make(map[uint64]int),
+		ingests:   make(map[uint64][]uint64),
+		onIngest:  onIngest,
+	}
+}
+
+func (m *mockImportClient) Download(
+	ctx context.Context, req *import_sstpb.DownloadRequest, opts ...grpc.CallOption,
+) (*import_sstpb.DownloadResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.downloads[req.Sst.GetRegionId()]++
+	ts := make([]byte, 8)
+	return &import_sstpb.DownloadResponse{Range: import_sstpb.Range{
+		Start: append(append([]byte{}, req.Sst.Range.GetStart()...), ts...),
+		End:   append(append([]byte{}, req.Sst.Range.GetEnd()...), ts...),
+	}}, nil
+}
+
+func (m *mockImportClient) Ingest(
+	ctx context.Context, req *import_sstpb.IngestRequest, opts ...grpc.CallOption,
+) (*import_sstpb.IngestResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	regionID := req.Context.GetRegionId()
+	m.ingests[regionID] = append(m.ingests[regionID], req.Context.Peer.GetStoreId())
+	return &import_sstpb.IngestResponse{Error: m.onIngest(req)}, nil
+}
+
+func newRowRegion(id uint64, start, end int64) *restore_util.RegionInfo {
+	peers := []*metapb.Peer{{Id: id * 10, StoreId: 1}, {Id: id*10 + 1, StoreId: 2}}
+	return &restore_util.RegionInfo{
+		Region: &metapb.Region{
+			Id:          id,
+			StartKey:    codec.EncodeBytes(nil, tablecodec.EncodeRowKeyWithHandle(2, start)),
+			EndKey:      codec.EncodeBytes(nil, tablecodec.EncodeRowKeyWithHandle(2, end)),
+			RegionEpoch: &metapb.RegionEpoch{Version: 1, ConfVer: 1},
+			Peers:       peers,
+		},
+		Leader: peers[0],
+	}
+}
+
+func (s *testRestoreSchemaSuite) importWithMock(
+	c *C,
+	client *fakeRegionClient,
+	onIngest func(req *import_sstpb.IngestRequest) *errorpb.Error,
+) *mockImportClient {
+	importer := NewFileImporter(context.Background(), client, "", nil)
+	mock := newMockImportClient(onIngest)
+	importer.getImportClient = func(storeID uint64) (import_sstpb.ImportSSTClient, error) {
+		return mock, nil
+	}
+	rules := encodeRewriteRules(&restore_util.RewriteRules{
+		Data: []*import_sstpb.RewriteRule{{
+			OldKeyPrefix: tablecodec.GenTableRecordPrefix(1),
+			NewKeyPrefix: tablecodec.GenTableRecordPrefix(2),
+		}},
+	})
+	file := &backup.File{
+		Name:     "1_write.sst",
+		StartKey: tablecodec.EncodeRowKeyWithHandle(1, 0),
+		EndKey:   tablecodec.EncodeRowKeyWithHandle(1, 100),
+	}
+	c.Assert(importer.Import(file, rules), IsNil)
+	return mock
+}
+
+func (s *testRestoreSchemaSuite) TestImportNotLeader(c *C) {
+	r1, r2 := newRowRegion(1, 0, 50), newRowRegion(2, 50, 1000)
+	mock := s.importWithMock(c, &fakeRegionClient{regions: []*restore_util.RegionInfo{r1, r2}},
+		func(req *import_sstpb.IngestRequest) *errorpb.Error {
+			if req.Context.GetRegionId() == 1 && req.Context.Peer.GetStoreId() == 1 {
+				return &errorpb.Error{NotLeader: &errorpb.NotLeader{RegionId: 1, Leader: r1.Region.Peers[1]}}
+			}
+			return nil
+		})
+	// The file is ingested to the new leader without downloading it again.
+	c.Assert(mock.ingests[1], DeepEquals, []uint64{1, 2})
+	c.Assert(mock.ingests[2], DeepEquals, []uint64{1})
+	c.Assert(mock.downloads, DeepEquals, map[uint64]int{1: 2, 2: 2})
+}
+
+func (s *testRestoreSchemaSuite) TestImportEpochNotMatch(c *C) {
+	r1, r2 := newRowRegion(1, 0, 50), newRowRegion(2, 50, 1000)
+	r3, r4 := newRowRegion(3, 0, 25), newRowRegion(4, 25, 50)
+	mock := s.importWithMock(c, &fakeRegionClient{regions: []*restore_util.RegionInfo{r1, r2}},
+		func(req *import_sstpb.IngestRequest) *errorpb.Error {
+			if req.Context.GetRegionId() == 1 {
+				return &errorpb.Error{EpochNotMatch: &errorpb.EpochNotMatch{
+					CurrentRegions: []*metapb.Region{r3.Region, r4.Region, r2.Region},
+				}}
+			}
+			return nil
+		})
+	// Only the split regions are downloaded again.
+	c.Assert(mock.downloads, DeepEquals, map[uint64]int{1: 2, 2: 2, 3: 2, 4: 2})
+	c.Assert(mock.ingests[2], HasLen, 1)
+	c.Assert(mock.ingests[3], HasLen, 1)
+	c.Assert(mock.ingests[4], HasLen, 1)
+}
+
+func (s *testRestoreSchemaSuite) TestImportEpochNotMatchWithGap(c *C) {
+	r1, r2 := newRowRegion(1, 0, 50), newRowRegion(2, 50, 1000)
+	r3, r4, r5 := newRowRegion(3, 0, 20), newRowRegion(4, 20, 35), newRowRegion(5, 35, 50)
+	client := &fakeRegionClient{regions: []*restore_util.RegionInfo{r1, r2}}
+	mock := s.importWithMock(c, client,
+		func(req *import_sstpb.IngestRequest) *errorpb.Error {
+			if req.Context.GetRegionId() == 1 {
+				// Region 1 is split into 3 regions, but only the region and
+				// one sibling are returned.
+				client.regions = []*restore_util.RegionInfo{r3, r4, r5, r2}
+				return &errorpb.Error{EpochNotMatch: &errorpb.EpochNotMatch{
+					CurrentRegions: []*metapb.Region{r3.Region, r4.Region},
+				}}
+			}
+			return nil
+		})
+	// The regions of the stale range are scanned again, every one is ingested.
+	c.Assert(mock.downloads, DeepEquals, map[uint64]int{1: 2, 2: 2, 3: 2, 4: 2, 5: 2})
+	c.Assert(mock.ingests[2], HasLen, 1)
+	c.Assert(mock.ingests[3], HasLen, 1)
+	c.Assert(mock.ingests[4], HasLen, 1)
+	c.Assert(mock.ingests[5], HasLen, 1)
+}
+
+func (s *testRestoreSchemaSuite) TestImportRetryFailedRegion(c *C) {
+	r1, r2 := newRowRegion(1, 0, 50), newRowRegion(2, 50, 1000)
+	failed := false
+	mock := s.importWithMock(c, &fakeRegionClient{regions: []*restore_util.RegionInfo{r1, r2}},
+		func(req *import_sstpb.IngestRequest) *errorpb.Error {
+			if req.Context.GetRegionId() == 2 && !failed {
+				failed = true
+				return &errorpb.Error{Message: "server is busy"}
+			}
+			return nil
+		})
+	// The region which succeeded is not imported again.
+	c.Assert(mock.downloads, DeepEquals, map[uint64]int{1: 2, 2: 4})
+	c.Assert(mock.ingests[1], HasLen, 1)
+	c.Assert(mock.ingests[2], HasLen, 2)
+}
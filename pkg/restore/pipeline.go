@@ -0,0 +1,118 @@
+package restore
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser/model"
+	restore_util "github.com/pingcap/tidb-tools/pkg/restore-util"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/utils"
+)
+
+// createTableBatchSize is the number of tables created before they are
+// passed down the pipeline, their new schemas are resolved together.
+const createTableBatchSize = 128
+
+// createdTable is a table which is created and waits to be restored.
+type createdTable struct {
+	table        *utils.Table
+	newTable     *model.TableInfo
+	rewriteRules *restore_util.RewriteRules
+}
+
+// RestoreTables restores the tables in a pipeline. Tables are created in
+// batches, then every created table has its ranges split, its files imported
+// and its checksum validated without waiting for the other tables. A table
+// which fails does not stop the others, the failed tables are reported in the
+// returned error.
+func (rc *Client) RestoreTables(tables []*utils.Table, updateCh chan<- struct{}) error {
+	start := time.Now()
+	createdCh := make(chan *createdTable, createTableBatchSize)
+	createErrCh := make(chan error, 1)
+	go func() {
+		defer close(createdCh)
+		createErrCh <- rc.createTablesInBatches(tables, createdCh)
+	}()
+
+	var mu sync.Mutex
+	failed := make([]string, 0)
+	var wg sync.WaitGroup
+	for created := range createdCh {
+		wg.Add(1)
+		ct := created
+		rc.tableWorkerPool.Apply(func() {
+			defer wg.Done()
+			if err := rc.restoreCreatedTable(ct, updateCh); err != nil {
+				log.Error("restore table failed",
+					zap.Stringer("db", ct.table.Db.Name),
+					zap.Stringer("table", ct.table.Schema.Name),
+					zap.Error(err))
+				mu.Lock()
+				failed = append(failed, fmt.Sprintf("%s.%s", ct.table.Db.Name, ct.table.Schema.Name))
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	if err := <-createErrCh; err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("failed to restore %d tables: %s", len(failed), strings.Join(failed, ", "))
+	}
+	log.Info("restore tables", zap.Int("count", len(tables)), zap.Duration("take", time.Since(start)))
+	return nil
+}
+
+// createTablesInBatches creates the tables, and sends every batch of created
+// tables down the pipeline.
+func (rc *Client) createTablesInBatches(tables []*utils.Table, createdCh chan<- *createdTable) error {
+	for start := 0; start < len(tables); start += createTableBatchSize {
+		end := start + createTableBatchSize
+		if end > len(tables) {
+			end = len(tables)
+		}
+		batch := tables[start:end]
+		if err := rc.createTables(batch); err != nil {
+			return err
+		}
+		newTables, tableRules, err := rc.resolveTables(batch)
+		if err != nil {
+			return err
+		}
+		for i, table := range batch {
+			select {
+			case createdCh <- &createdTable{
+				table:        table,
+				newTable:     newTables[i],
+				rewriteRules: tableRules[i],
+			}:
+			case <-rc.ctx.Done():
+				return errors.Trace(rc.ctx.Err())
+			}
+		}
+	}
+	return nil
+}
+
+// restoreCreatedTable splits the ranges, imports the files and validates the
+// checksum of a created table.
+func (rc *Client) restoreCreatedTable(ct *createdTable, updateCh chan<- struct{}) error {
+	ranges := GetRanges(ct.table.Files)
+	if len(ranges) > 0 {
+		err := SplitRanges(rc.ctx, rc, ranges, ct.rewriteRules, updateCh)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err := rc.RestoreTable(ct.table, ct.rewriteRules, updateCh); err != nil {
+		return err
+	}
+	return rc.validateTableChecksum(ct.table, ct.newTable)
+}
@@ -0,0 +1,58 @@
+package restore
+
+import (
+	"context"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/tidb/store/mockstore/mocktikv"
+	"github.com/pingcap/tidb/store/tikv"
+	"github.com/pingcap/tidb/util/testkit"
+
+	"github.com/pingcap/br/pkg/utils"
+)
+
+func (s *testRestoreSchemaSuite) TestRestoreTables(c *C) {
+	s.startServer(c)
+	defer s.stopServer(c)
+	tk := testkit.NewTestKit(c, s.store)
+	tk.MustExec("drop database if exists src")
+	tk.MustExec("create database src")
+	tk.MustExec("create table src.ok (a int)")
+	tk.MustExec("create table src.bad (a int)")
+	dbInfo, ok := s.dom.InfoSchema().SchemaByName(model.NewCIStr("src"))
+	c.Assert(ok, IsTrue)
+	// The mock TiKV returns 1 for every field of a checksum request.
+	okTable := &utils.Table{
+		Db:         dbInfo,
+		Schema:     s.getTableInfo(c, "src", "ok"),
+		Crc64Xor:   1,
+		TotalKvs:   1,
+		TotalBytes: 1,
+	}
+	badTable := &utils.Table{Db: dbInfo, Schema: s.getTableInfo(c, "src", "bad")}
+	tk.MustExec("drop database src")
+	tk.MustExec("create database src")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rc := &Client{
+		ctx:             ctx,
+		cancel:          cancel,
+		pdClient:        mocktikv.NewPDClient(s.cluster),
+		tikvCli:         s.store.(tikv.Storage),
+		dom:             s.dom,
+		dbDSN:           "root@tcp(127.0.0.1:4001)/",
+		tableWorkerPool: utils.NewWorkerPool(4, "table"),
+	}
+	rc.SetConcurrency(4)
+	updateCh := make(chan struct{}, 16)
+	err := rc.RestoreTables([]*utils.Table{okTable, badTable}, updateCh)
+	c.Assert(err, ErrorMatches, "failed to restore 1 tables: src.bad")
+	// Both tables are created even though one of them fails.
+	s.getTableInfo(c, "src", "ok")
+	s.getTableInfo(c, "src", "bad")
+
+	err = rc.RestoreTables([]*utils.Table{okTable}, updateCh)
+	c.Assert(err, IsNil)
+}
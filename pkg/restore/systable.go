@@ -0,0 +1,181 @@
+package restore
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser/model"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/utils"
+)
+
+// temporarySystemDatabase is the database which the system tables are
+// restored into before merged into the system tables.
+const temporarySystemDatabase = "__TiDB_BR_Temporary_mysql"
+
+// ConflictPolicy decides what to do when a row of a restored system table
+// conflicts with an existing row.
+type ConflictPolicy string
+
+// Conflict policies.
+const (
+	ConflictSkip      ConflictPolicy = "skip"
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	ConflictError     ConflictPolicy = "error"
+)
+
+// ParseConflictPolicy parses a conflict policy.
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(strings.ToLower(s)); p {
+	case ConflictSkip, ConflictOverwrite, ConflictError:
+		return p, nil
+	default:
+		return "", errors.Errorf("invalid conflict policy %s, must be skip, overwrite or error", s)
+	}
+}
+
+// renameSystemDatabase makes the system tables restored into the temporary
+// database, so that they do not overwrite the system tables directly.
+func renameSystemDatabase(databases map[string]*utils.Database) {
+	db, ok := databases[utils.SystemDatabase]
+	if !ok {
+		return
+	}
+	delete(databases, utils.SystemDatabase)
+	schema := *db.Schema
+	schema.Name = model.NewCIStr(temporarySystemDatabase)
+	db.Schema = &schema
+	for _, table := range db.Tables {
+		table.Db = &schema
+	}
+	for _, view := range db.Views {
+		view.Db = &schema
+	}
+	databases[temporarySystemDatabase] = db
+}
+
+func keyCondition(keys []string, left, right string) string {
+	conds := make([]string, 0, len(keys))
+	for _, key := range keys {
+		conds = append(conds, fmt.Sprintf("%s.%s = %s.%s",
+			left, utils.EncloseName(key), right, utils.EncloseName(key)))
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// mergeSystemTable merges the rows of the restored system table into the
+// system table of the same name in a transaction.
+func mergeSystemTable(
+	db *sql.DB, name string, columns []string, policy ConflictPolicy,
+) error {
+	keys, ok := utils.SystemTables[name]
+	if !ok {
+		return errors.Errorf("system table %s is not supported", name)
+	}
+	target := fmt.Sprintf("%s.%s",
+		utils.EncloseName(utils.SystemDatabase), utils.EncloseName(name))
+	source := fmt.Sprintf("%s.%s",
+		utils.EncloseName(temporarySystemDatabase), utils.EncloseName(name))
+	cols := make([]string, 0, len(columns))
+	selects := make([]string, 0, len(columns))
+	for _, col := range columns {
+		cols = append(cols, utils.EncloseName(col))
+		// Bindings are reloaded by TiDB only if they are updated after the
+		// last load.
+		if name == "bind_info" && strings.EqualFold(col, "update_time") {
+			selects = append(selects, "NOW(3)")
+		} else {
+			selects = append(selects, "s."+utils.EncloseName(col))
+		}
+	}
+	insertSQL := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s s",
+		target, strings.Join(cols, ", "), strings.Join(selects, ", "), source)
+
+	txn, err := db.Begin()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer func() {
+		if err != nil {
+			_ = txn.Rollback()
+		}
+	}()
+	switch policy {
+	case ConflictSkip:
+		insertSQL += fmt.Sprintf(" WHERE NOT EXISTS (SELECT 1 FROM %s t WHERE %s)",
+			target, keyCondition(keys, "t", "s"))
+	case ConflictOverwrite:
+		deleteSQL := fmt.Sprintf("DELETE t FROM %s t JOIN %s s ON %s",
+			target, source, keyCondition(keys, "t", "s"))
+		if _, err = txn.Exec(deleteSQL); err != nil {
+			log.Error("merge system table failed", zap.String("SQL", deleteSQL), zap.Error(err))
+			return errors.Trace(err)
+		}
+	case ConflictError:
+		var count int
+		countSQL := fmt.Sprintf("SELECT COUNT(*) FROM %s t JOIN %s s ON %s",
+			target, source, keyCondition(keys, "t", "s"))
+		if err = txn.QueryRow(countSQL).Scan(&count); err != nil {
+			log.Error("merge system table failed", zap.String("SQL", countSQL), zap.Error(err))
+			return errors.Trace(err)
+		}
+		if count > 0 {
+			err = errors.Errorf("%d rows of system table %s conflict with existing rows", count, name)
+			return err
+		}
+	default:
+		err = errors.Errorf("invalid conflict policy %s", policy)
+		return err
+	}
+	if _, err = txn.Exec(insertSQL); err != nil {
+		log.Error("merge system table failed", zap.String("SQL", insertSQL), zap.Error(err))
+		return errors.Trace(err)
+	}
+	err = txn.Commit()
+	return errors.Trace(err)
+}
+
+// RestoreSystemTables merges the restored system tables into the system
+// tables, then reloads privileges and drops the temporary database.
+func (rc *Client) RestoreSystemTables(policy ConflictPolicy) error {
+	sysDB, ok := rc.databases[temporarySystemDatabase]
+	if !ok {
+		return nil
+	}
+	db, err := OpenDatabase(utils.SystemDatabase, rc.dbDSN)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer db.Close()
+	for _, table := range sysDB.Tables {
+		name := table.Schema.Name.L
+		targetInfo, err := rc.GetTableSchema(model.NewCIStr(utils.SystemDatabase), table.Schema.Name)
+		if err != nil {
+			log.Warn("system table does not exist in the cluster, skip it",
+				zap.String("table", name), zap.Error(err))
+			continue
+		}
+		// Only merge the columns both exist, the schema of system tables
+		// may change between versions.
+		columns := make([]string, 0, len(table.Schema.Columns))
+		for _, col := range table.Schema.Columns {
+			if model.FindColumnInfo(targetInfo.Columns, col.Name.L) != nil {
+				columns = append(columns, col.Name.O)
+			}
+		}
+		if err = mergeSystemTable(db, name, columns, policy); err != nil {
+			return errors.Annotatef(err, "merge system table %s", name)
+		}
+		log.Info("restore system table",
+			zap.String("table", name), zap.String("policy", string(policy)))
+	}
+	if _, err = db.Exec("FLUSH PRIVILEGES"); err != nil {
+		return errors.Trace(err)
+	}
+	_, err = db.Exec("DROP DATABASE IF EXISTS " + utils.EncloseName(temporarySystemDatabase))
+	return errors.Trace(err)
+}
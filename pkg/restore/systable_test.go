@@ -0,0 +1,72 @@
+package restore
+
+import (
+	"fmt"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/tidb/util/testkit"
+
+	"github.com/pingcap/br/pkg/utils"
+)
+
+func (s *testRestoreSchemaSuite) TestRenameSystemDatabase(c *C) {
+	sysDB := &model.DBInfo{Name: model.NewCIStr("mysql")}
+	databases := map[string]*utils.Database{
+		"mysql": {
+			Schema: sysDB,
+			Tables: []*utils.Table{{Db: sysDB, Schema: &model.TableInfo{Name: model.NewCIStr("user")}}},
+		},
+		"test": {Schema: &model.DBInfo{Name: model.NewCIStr("test")}},
+	}
+	renameSystemDatabase(databases)
+	c.Assert(databases, HasLen, 2)
+	c.Assert(databases["mysql"], IsNil)
+	db := databases[temporarySystemDatabase]
+	c.Assert(db.Schema.Name.O, Equals, temporarySystemDatabase)
+	c.Assert(db.Tables[0].Db.Name.O, Equals, temporarySystemDatabase)
+	// The original schema is not changed.
+	c.Assert(sysDB.Name.O, Equals, "mysql")
+}
+
+func (s *testRestoreSchemaSuite) TestParseConflictPolicy(c *C) {
+	p, err := ParseConflictPolicy("Overwrite")
+	c.Assert(err, IsNil)
+	c.Assert(p, Equals, ConflictOverwrite)
+	_, err = ParseConflictPolicy("ignore")
+	c.Assert(err, ErrorMatches, "invalid conflict policy ignore.*")
+}
+
+func (s *testRestoreSchemaSuite) TestMergeSystemTable(c *C) {
+	s.startServer(c)
+	defer s.stopServer(c)
+	tk := testkit.NewTestKit(c, s.store)
+	tk.MustExec(fmt.Sprintf("create database %s", temporarySystemDatabase))
+	tk.MustExec(fmt.Sprintf("create table %s.global_variables like mysql.global_variables",
+		temporarySystemDatabase))
+	tk.MustExec("insert into mysql.global_variables values ('br_a', 'old'), ('br_b', 'old')")
+	tk.MustExec(fmt.Sprintf("insert into %s.global_variables values ('br_b', 'new'), ('br_c', 'new')",
+		temporarySystemDatabase))
+
+	db, err := OpenDatabase("mysql", "root@tcp(127.0.0.1:4001)/")
+	c.Assert(err, IsNil)
+	defer db.Close()
+	columns := []string{"VARIABLE_NAME", "VARIABLE_VALUE"}
+	query := "select variable_name, variable_value from mysql.global_variables " +
+		"where variable_name like 'br\\_%' order by variable_name"
+
+	err = mergeSystemTable(db, "global_variables", columns, ConflictError)
+	c.Assert(err, ErrorMatches, "1 rows of system table global_variables conflict with existing rows")
+	tk.MustQuery(query).Check(testkit.Rows("br_a old", "br_b old"))
+
+	err = mergeSystemTable(db, "global_variables", columns, ConflictSkip)
+	c.Assert(err, IsNil)
+	tk.MustQuery(query).Check(testkit.Rows("br_a old", "br_b old", "br_c new"))
+
+	err = mergeSystemTable(db, "global_variables", columns, ConflictOverwrite)
+	c.Assert(err, IsNil)
+	tk.MustQuery(query).Check(testkit.Rows("br_a old", "br_b new", "br_c new"))
+
+	err = mergeSystemTable(db, "stats_meta", columns, ConflictOverwrite)
+	c.Assert(err, ErrorMatches, "system table stats_meta is not supported")
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	_ "github.com/go-sql-driver/mysql" // mysql driver
+	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/backup"
 	"github.com/pingcap/kvproto/pkg/import_sstpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
@@ -33,32 +34,89 @@ func (fs files) MarshalLogArray(arr zapcore.ArrayEncoder) error {
 	return nil
 }
 
+// physicalTable maps a physical table in the backup to the restored one.
+type physicalTable struct {
+	oldID int64
+	newID int64
+}
+
+// mapPhysicalTables maps the table and its partitions in the backup to the
+// restored table, partitions are matched by name.
+func mapPhysicalTables(newTable *model.TableInfo, oldTable *model.TableInfo) ([]physicalTable, error) {
+	tables := []physicalTable{{oldID: oldTable.ID, newID: newTable.ID}}
+	oldPart := oldTable.GetPartitionInfo()
+	newPart := newTable.GetPartitionInfo()
+	if oldPart == nil && newPart == nil {
+		return tables, nil
+	}
+	if oldPart == nil || newPart == nil {
+		return nil, errors.Errorf("table %s is partitioned in only one of the backup and the cluster",
+			oldTable.Name)
+	}
+	for _, oldDef := range oldPart.Definitions {
+		found := false
+		for _, newDef := range newPart.Definitions {
+			if oldDef.Name.L == newDef.Name.L {
+				tables = append(tables, physicalTable{oldID: oldDef.ID, newID: newDef.ID})
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("partition %s of table %s not found in the cluster",
+				oldDef.Name, oldTable.Name)
+		}
+	}
+	return tables, nil
+}
+
 // GetRewriteRules returns the rewrite rule of the new table and the old table.
-func GetRewriteRules(newTable *model.TableInfo, oldTable *model.TableInfo) *restore_util.RewriteRules {
-	tableRules := make([]*import_sstpb.RewriteRule, 0, 2)
-	tableRules = append(tableRules, &import_sstpb.RewriteRule{
-		OldKeyPrefix: tablecodec.EncodeTablePrefix(oldTable.ID),
-		NewKeyPrefix: tablecodec.EncodeTablePrefix(newTable.ID),
-	})
+func GetRewriteRules(
+	newTable *model.TableInfo, oldTable *model.TableInfo,
+) (*restore_util.RewriteRules, error) {
+	tables, err := mapPhysicalTables(newTable, oldTable)
+	if err != nil {
+		return nil, err
+	}
+	oldIDs := make(map[int64]bool, len(tables))
+	for _, t := range tables {
+		oldIDs[t.oldID] = true
+	}
+
+	tableRules := make([]*import_sstpb.RewriteRule, 0, 2*len(tables))
+	for _, t := range tables {
+		tableRules = append(tableRules, &import_sstpb.RewriteRule{
+			OldKeyPrefix: tablecodec.EncodeTablePrefix(t.oldID),
+			NewKeyPrefix: tablecodec.EncodeTablePrefix(t.newID),
+		})
+	}
 	// Backup range is [t{tableID}, t{tableID+1}), here is for covering the t{tableID+1} prefix.
-	tableRules = append(tableRules, &import_sstpb.RewriteRule{
-		OldKeyPrefix: tablecodec.EncodeTablePrefix(oldTable.ID + 1),
-		NewKeyPrefix: tablecodec.EncodeTablePrefix(newTable.ID + 1),
-	})
+	// Skip it if t{tableID+1} is a partition, which has its own rule.
+	for _, t := range tables {
+		if oldIDs[t.oldID+1] {
+			continue
+		}
+		tableRules = append(tableRules, &import_sstpb.RewriteRule{
+			OldKeyPrefix: tablecodec.EncodeTablePrefix(t.oldID + 1),
+			NewKeyPrefix: tablecodec.EncodeTablePrefix(t.newID + 1),
+		})
+	}
 
-	dataRules := make([]*import_sstpb.RewriteRule, 0, len(oldTable.Indices)+1)
-	dataRules = append(dataRules, &import_sstpb.RewriteRule{
-		OldKeyPrefix: append(tablecodec.EncodeTablePrefix(oldTable.ID), recordPrefixSep...),
-		NewKeyPrefix: append(tablecodec.EncodeTablePrefix(newTable.ID), recordPrefixSep...),
-	})
+	dataRules := make([]*import_sstpb.RewriteRule, 0, (len(oldTable.Indices)+1)*len(tables))
+	for _, t := range tables {
+		dataRules = append(dataRules, &import_sstpb.RewriteRule{
+			OldKeyPrefix: append(tablecodec.EncodeTablePrefix(t.oldID), recordPrefixSep...),
+			NewKeyPrefix: append(tablecodec.EncodeTablePrefix(t.newID), recordPrefixSep...),
+		})
 
-	for _, srcIndex := range oldTable.Indices {
-		for _, destIndex := range newTable.Indices {
-			if srcIndex.Name == destIndex.Name {
-				dataRules = append(dataRules, &import_sstpb.RewriteRule{
-					OldKeyPrefix: tablecodec.EncodeTableIndexPrefix(oldTable.ID, srcIndex.ID),
-					NewKeyPrefix: tablecodec.EncodeTableIndexPrefix(newTable.ID, destIndex.ID),
-				})
+		for _, srcIndex := range oldTable.Indices {
+			for _, destIndex := range newTable.Indices {
+				if srcIndex.Name == destIndex.Name {
+					dataRules = append(dataRules, &import_sstpb.RewriteRule{
+						OldKeyPrefix: tablecodec.EncodeTableIndexPrefix(t.oldID, srcIndex.ID),
+						NewKeyPrefix: tablecodec.EncodeTableIndexPrefix(t.newID, destIndex.ID),
+					})
+				}
 			}
 		}
 	}
@@ -66,7 +124,7 @@ func GetRewriteRules(newTable *model.TableInfo, oldTable *model.TableInfo) *rest
 	return &restore_util.RewriteRules{
 		Table: tableRules,
 		Data:  dataRules,
-	}
+	}, nil
 }
 
 // getSSTMetaFromFile compares the keys in file, region and rewrite rules, then returns a sst meta.
@@ -106,37 +164,6 @@ func getSSTMetaFromFile(
 	}
 }
 
-type retryableFunc func() error
-type continueFunc func(error) bool
-
-func withRetry(
-	retryableFunc retryableFunc,
-	continueFunc continueFunc,
-	attempts uint,
-	delayTime time.Duration,
-	maxDelayTime time.Duration,
-) error {
-	var lastErr error
-	for i := uint(0); i < attempts; i++ {
-		err := retryableFunc()
-		if err != nil {
-			lastErr = err
-			// If this is the last attempt, do not wait
-			if !continueFunc(err) || i == attempts-1 {
-				break
-			}
-			delayTime = 2 * delayTime
-			if delayTime > maxDelayTime {
-				delayTime = maxDelayTime
-			}
-			time.Sleep(delayTime)
-		} else {
-			return nil
-		}
-	}
-	return lastErr
-}
-
 // GetRanges returns the ranges of the files.
 func GetRanges(files []*backup.File) []restore_util.Range {
 	ranges := make([]restore_util.Range, 0, len(files))
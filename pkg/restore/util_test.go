@@ -0,0 +1,104 @@
+package restore
+
+import (
+	"math"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/tidb/tablecodec"
+	"github.com/pingcap/tidb/util/testkit"
+
+	"github.com/pingcap/br/pkg/utils"
+)
+
+func (s *testRestoreSchemaSuite) getTableInfo(c *C, db, table string) *model.TableInfo {
+	info, err := s.dom.GetSnapshotInfoSchema(math.MaxUint64)
+	c.Assert(err, IsNil)
+	t, err := info.TableByName(model.NewCIStr(db), model.NewCIStr(table))
+	c.Assert(err, IsNil)
+	return t.Meta()
+}
+
+func findRule(rules []*import_sstpb.RewriteRule, oldPrefix []byte) *import_sstpb.RewriteRule {
+	for _, rule := range rules {
+		if string(rule.OldKeyPrefix) == string(oldPrefix) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (s *testRestoreSchemaSuite) checkPartitionRules(c *C, oldTable, newTable *model.TableInfo) {
+	rules, err := GetRewriteRules(newTable, oldTable)
+	c.Assert(err, IsNil)
+	oldDefs := oldTable.GetPartitionInfo().Definitions
+	newDefs := newTable.GetPartitionInfo().Definitions
+	c.Assert(oldDefs, HasLen, len(newDefs))
+	for _, oldDef := range oldDefs {
+		var newID int64
+		for _, newDef := range newDefs {
+			if newDef.Name.L == oldDef.Name.L {
+				newID = newDef.ID
+			}
+		}
+		c.Assert(newID, Not(Equals), int64(0))
+		rule := findRule(rules.Table, tablecodec.EncodeTablePrefix(oldDef.ID))
+		c.Assert(rule, NotNil, Commentf("partition %s", oldDef.Name))
+		c.Assert(rule.NewKeyPrefix, DeepEquals, []byte(tablecodec.EncodeTablePrefix(newID)))
+		rule = findRule(rules.Data, tablecodec.GenTableRecordPrefix(oldDef.ID))
+		c.Assert(rule, NotNil, Commentf("partition %s", oldDef.Name))
+		c.Assert(rule.NewKeyPrefix, DeepEquals, []byte(tablecodec.GenTableRecordPrefix(newID)))
+		rule = findRule(rules.Data,
+			tablecodec.EncodeTableIndexPrefix(oldDef.ID, oldTable.Indices[0].ID))
+		c.Assert(rule, NotNil, Commentf("partition %s", oldDef.Name))
+		c.Assert(rule.NewKeyPrefix, DeepEquals,
+			[]byte(tablecodec.EncodeTableIndexPrefix(newID, newTable.Indices[0].ID)))
+	}
+	// The rule for t{tableID+1} must not shadow the next partition.
+	for _, oldDef := range oldDefs {
+		n := 0
+		for _, rule := range rules.Table {
+			if string(rule.OldKeyPrefix) == string(tablecodec.EncodeTablePrefix(oldDef.ID)) {
+				n++
+			}
+		}
+		c.Assert(n, Equals, 1)
+	}
+
+	reqs, err := buildChecksumRequest(newTable, &utils.Table{Schema: oldTable}, 1)
+	c.Assert(err, IsNil)
+	// (record + index) * (table + partitions)
+	c.Assert(reqs, HasLen, 2*(len(newDefs)+1))
+}
+
+func (s *testRestoreSchemaSuite) TestPartitionRewriteRules(c *C) {
+	s.startServer(c)
+	defer s.stopServer(c)
+	tk := testkit.NewTestKit(c, s.store)
+	tk.MustExec("use test")
+	tk.MustExec("set @@tidb_enable_table_partition = 1")
+	tk.MustExec("drop table if exists th1, th2, tr1, tr2")
+	// Tables created later have different partition IDs, as if they are
+	// created by restore.
+	tk.MustExec("create table th1 (a int, b int, index i(b)) partition by hash(a) partitions 4")
+	tk.MustExec("create table tr1 (a int, b int, index i(b)) partition by range(a) (" +
+		"partition p0 values less than (10), partition p1 values less than (20), " +
+		"partition p2 values less than maxvalue)")
+	tk.MustExec("create table th2 (a int, b int, index i(b)) partition by hash(a) partitions 4")
+	tk.MustExec("create table tr2 (a int, b int, index i(b)) partition by range(a) (" +
+		"partition p0 values less than (10), partition p1 values less than (20), " +
+		"partition p2 values less than maxvalue)")
+	s.checkPartitionRules(c, s.getTableInfo(c, "test", "th1"), s.getTableInfo(c, "test", "th2"))
+	s.checkPartitionRules(c, s.getTableInfo(c, "test", "tr1"), s.getTableInfo(c, "test", "tr2"))
+
+	tk.MustExec("drop table if exists tr3")
+	tk.MustExec("create table tr3 (a int, b int, index i(b)) partition by range(a) (" +
+		"partition p0 values less than (10), partition p3 values less than maxvalue)")
+	_, err := GetRewriteRules(s.getTableInfo(c, "test", "tr3"), s.getTableInfo(c, "test", "tr1"))
+	c.Assert(err, ErrorMatches, "partition p1 of table tr1 not found in the cluster")
+	tk.MustExec("drop table if exists t")
+	tk.MustExec("create table t (a int, b int, index i(b))")
+	_, err = GetRewriteRules(s.getTableInfo(c, "test", "t"), s.getTableInfo(c, "test", "tr1"))
+	c.Assert(err, ErrorMatches, "table tr1 is partitioned in only one of the backup and the cluster")
+}
@@ -0,0 +1,124 @@
+package restore
+
+import (
+	"fmt"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/utils"
+)
+
+// tableNameCollector collects the tables referred by a statement.
+type tableNameCollector struct {
+	defaultDB string
+	names     []string
+}
+
+func (c *tableNameCollector) Enter(in ast.Node) (ast.Node, bool) {
+	if t, ok := in.(*ast.TableName); ok {
+		db := t.Schema.L
+		if db == "" {
+			db = c.defaultDB
+		}
+		c.names = append(c.names, fmt.Sprintf("%s.%s", db, t.Name.L))
+	}
+	return in, false
+}
+
+func (c *tableNameCollector) Leave(in ast.Node) (ast.Node, bool) {
+	return in, true
+}
+
+func viewName(view *utils.Table) string {
+	return fmt.Sprintf("%s.%s", view.Db.Name.L, view.Schema.Name.L)
+}
+
+// sortViews sorts views so that a view is after the views it refers to.
+func sortViews(views []*utils.Table) ([]*utils.Table, error) {
+	byName := make(map[string]*utils.Table, len(views))
+	for _, view := range views {
+		byName[viewName(view)] = view
+	}
+	deps := make(map[string][]string, len(views))
+	p := parser.New()
+	for _, view := range views {
+		stmt, err := p.ParseOneStmt(view.Schema.View.SelectStmt, "", "")
+		if err != nil {
+			return nil, errors.Annotatef(err, "parse view %s", viewName(view))
+		}
+		collector := &tableNameCollector{defaultDB: view.Db.Name.L}
+		stmt.Accept(collector)
+		deps[viewName(view)] = collector.names
+	}
+
+	sorted := make([]*utils.Table, 0, len(views))
+	// 1 means visiting, 2 means visited.
+	state := make(map[string]int, len(views))
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case 1:
+			return errors.Errorf("view %s refers to itself", name)
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		for _, dep := range deps[name] {
+			if _, ok := byName[dep]; ok {
+				if err := visit(dep); err != nil {
+					return err
+				}
+			}
+		}
+		state[name] = 2
+		sorted = append(sorted, byName[name])
+		return nil
+	}
+	for _, view := range views {
+		if err := visit(viewName(view)); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+// CreateViews creates the views of the databases. It must be called after
+// all tables are created, since views refer to them.
+func (rc *Client) CreateViews(dbs []*utils.Database) error {
+	views := make([]*utils.Table, 0)
+	for _, db := range dbs {
+		views = append(views, db.Views...)
+	}
+	if len(views) == 0 {
+		return nil
+	}
+	views, err := sortViews(views)
+	if err != nil {
+		return err
+	}
+	openDBs := make(map[string]DB)
+	defer func() {
+		for _, db := range openDBs {
+			_ = db.Close()
+		}
+	}()
+	for _, view := range views {
+		db, ok := openDBs[view.Db.Name.String()]
+		if !ok {
+			db, err = rc.openDatabase(view.Db.Name.String())
+			if err != nil {
+				return err
+			}
+			openDBs[view.Db.Name.String()] = db
+		}
+		if err = CreateView(db, view); err != nil {
+			return err
+		}
+		log.Info("create view", zap.String("view", viewName(view)))
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package restore
+
+import (
+	"math"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/tidb/util/testkit"
+
+	"github.com/pingcap/br/pkg/utils"
+)
+
+func (s *testRestoreSchemaSuite) TestCreateViews(c *C) {
+	s.startServer(c)
+	defer s.stopServer(c)
+	tk := testkit.NewTestKit(c, s.store)
+	tk.MustExec("use test")
+	tk.MustExec("drop view if exists v1, v2")
+	tk.MustExec("drop table if exists t")
+	tk.MustExec("create table t (a int, b int)")
+	tk.MustExec("create sql security invoker view v1 (x, y) as select a, b from t where a > 1 with local check option")
+	tk.MustExec("create view v2 as select x from v1")
+	// Charset and collation of views follow the session creating them, so
+	// only compare the definitions.
+	showCreateView := func(name string) interface{} {
+		return tk.MustQuery("show create view " + name).Rows()[0][1]
+	}
+	showV1 := showCreateView("v1")
+	showV2 := showCreateView("v2")
+
+	info, err := s.dom.GetSnapshotInfoSchema(math.MaxUint64)
+	c.Assert(err, IsNil)
+	dbInfo, ok := info.SchemaByName(model.NewCIStr("test"))
+	c.Assert(ok, IsTrue)
+	views := make([]*utils.Table, 0, 2)
+	// Put the dependent view first.
+	for _, name := range []string{"v2", "v1"} {
+		view, err := info.TableByName(model.NewCIStr("test"), model.NewCIStr(name))
+		c.Assert(err, IsNil)
+		views = append(views, &utils.Table{Db: dbInfo, Schema: view.Meta()})
+	}
+	c.Assert(GetCreateViewSQL(views[1].Schema), Matches,
+		"CREATE OR REPLACE ALGORITHM=UNDEFINED DEFINER=.* SQL SECURITY INVOKER "+
+			"VIEW `v1` \\(`x`, `y`\\) AS .* WITH LOCAL CHECK OPTION;")
+
+	sorted, err := sortViews(views)
+	c.Assert(err, IsNil)
+	c.Assert(sorted, HasLen, 2)
+	c.Assert(sorted[0].Schema.Name.L, Equals, "v1")
+	c.Assert(sorted[1].Schema.Name.L, Equals, "v2")
+
+	tk.MustExec("drop view v2, v1")
+	rc := &Client{dbDSN: "root@tcp(127.0.0.1:4001)/"}
+	err = rc.CreateViews([]*utils.Database{{Schema: dbInfo, Views: views}})
+	c.Assert(err, IsNil)
+	c.Assert(showCreateView("v1"), Equals, showV1)
+	c.Assert(showCreateView("v2"), Equals, showV2)
+}
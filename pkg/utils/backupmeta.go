@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// The backupmeta starts with a header, so that readers can reject a torn
+// file instead of restoring garbage. The header is:
+// magic | version | length of payload (big endian uint64) | sha256 of payload.
+const (
+	metaMagic     = "BRMETA"
+	metaVersion   = 1
+	metaHeaderLen = len(metaMagic) + 1 + 8 + sha256.Size
+)
+
+func encodeMetaHeader(payload []byte) []byte {
+	header := make([]byte, 0, metaHeaderLen)
+	header = append(header, metaMagic...)
+	header = append(header, metaVersion)
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], uint64(len(payload)))
+	header = append(header, length[:]...)
+	sum := sha256.Sum256(payload)
+	return append(header, sum[:]...)
+}
+
+// decodeMetaPayload checks the header and returns the payload of a
+// backupmeta. Backupmeta written by an old BR has no header.
+func decodeMetaPayload(name string, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(metaMagic)) {
+		log.Warn("backupmeta has no header, it can not be checked",
+			zap.String("name", name))
+		return data, nil
+	}
+	if len(data) < metaHeaderLen {
+		return nil, errors.Errorf("%s is torn: incomplete header", name)
+	}
+	if v := data[len(metaMagic)]; v != metaVersion {
+		return nil, errors.Errorf("%s has an unknown version %d", name, v)
+	}
+	length := binary.BigEndian.Uint64(data[len(metaMagic)+1:])
+	payload := data[metaHeaderLen:]
+	if uint64(len(payload)) != length {
+		return nil, errors.Errorf("%s is torn: expect %d bytes, got %d bytes",
+			name, length, len(payload))
+	}
+	sum := sha256.Sum256(payload)
+	if !bytes.Equal(sum[:], data[metaHeaderLen-sha256.Size:metaHeaderLen]) {
+		return nil, errors.Errorf("%s is corrupted: checksum mismatch", name)
+	}
+	return payload, nil
+}
+
+// ReadBackupMeta reads and decodes the backupmeta from the storage.
+func ReadBackupMeta(storage ExternalStorage) (*backup.BackupMeta, error) {
+	return readBackupMeta(storage, MetaFile)
+}
+
+func readBackupMeta(storage ExternalStorage, name string) (*backup.BackupMeta, error) {
+	size, err := storage.Size(name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	reader, err := storage.Open(name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer reader.Close()
+	// Read into an exactly sized buffer, so the raw data is not copied
+	// while growing.
+	data := make([]byte, size)
+	if _, err = io.ReadFull(reader, data); err != nil {
+		return nil, errors.Annotatef(err, "read %s failed", name)
+	}
+	// Reach the end of the file, so that an authenticated reader can
+	// verify the whole file.
+	if _, err = io.ReadFull(reader, make([]byte, 1)); err != io.EOF {
+		return nil, errors.Errorf("read %s failed: file size mismatch or %v", name, err)
+	}
+	if IsEncrypted(data) {
+		return nil, errors.Errorf("%s is encrypted, please specify the crypter key", name)
+	}
+	payload, err := decodeMetaPayload(name, data)
+	if err != nil {
+		return nil, err
+	}
+	backupMeta := &backup.BackupMeta{}
+	if err = backupMeta.Unmarshal(payload); err != nil {
+		return nil, errors.Annotatef(err, "invalid %s", name)
+	}
+	return backupMeta, nil
+}
+
+// WriteBackupMeta encodes and writes the backupmeta to the storage.
+func WriteBackupMeta(storage ExternalStorage, backupMeta *backup.BackupMeta) error {
+	data, err := backupMeta.Marshal()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	writer, err := storage.Create(MetaFile)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err = writer.Write(encodeMetaHeader(data)); err != nil {
+		_ = writer.Close()
+		return errors.Trace(err)
+	}
+	if _, err = writer.Write(data); err != nil {
+		_ = writer.Close()
+		return errors.Trace(err)
+	}
+	return errors.Trace(writer.Close())
+}
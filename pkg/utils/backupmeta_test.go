@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"fmt"
+
+	"github.com/gogo/protobuf/proto"
+	. "github.com/pingcap/check"
+	"github.com/pingcap/kvproto/pkg/backup"
+)
+
+type testBackupMetaSuite struct{}
+
+var _ = Suite(&testBackupMetaSuite{})
+
+func (r *testBackupMetaSuite) TestTornBackupMeta(c *C) {
+	s, err := CreateStorage(fmt.Sprintf("local://%s", c.MkDir()))
+	c.Assert(err, IsNil)
+	meta := &backup.BackupMeta{
+		ClusterId: 1,
+		Files:     []*backup.File{{Name: "1.sst", StartKey: []byte("a"), EndKey: []byte("b")}},
+	}
+	c.Assert(WriteBackupMeta(s, meta), IsNil)
+	read, err := ReadBackupMeta(s)
+	c.Assert(err, IsNil)
+	c.Assert(read.Files, HasLen, 1)
+
+	data, err := s.Read(MetaFile)
+	c.Assert(err, IsNil)
+
+	c.Assert(s.Write(MetaFile, data[:len(data)-3]), IsNil)
+	_, err = ReadBackupMeta(s)
+	c.Assert(err, ErrorMatches, "backupmeta is torn: .*")
+
+	c.Assert(s.Write(MetaFile, data[:10]), IsNil)
+	_, err = ReadBackupMeta(s)
+	c.Assert(err, ErrorMatches, "backupmeta is torn: incomplete header")
+
+	changed := append([]byte{}, data...)
+	changed[len(changed)-1] ^= 1
+	c.Assert(s.Write(MetaFile, changed), IsNil)
+	_, err = ReadBackupMeta(s)
+	c.Assert(err, ErrorMatches, "backupmeta is corrupted: checksum mismatch")
+
+	// Backupmeta written by an old BR.
+	legacy, err := proto.Marshal(meta)
+	c.Assert(err, IsNil)
+	c.Assert(s.Write(MetaFile, legacy), IsNil)
+	read, err = ReadBackupMeta(s)
+	c.Assert(err, IsNil)
+	c.Assert(read.ClusterId, Equals, uint64(1))
+}
@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pingcap/errors"
+)
+
+const (
+	// MetaExtFile represents file name of the extended backup meta.
+	MetaExtFile = "backupmeta.ext"
+)
+
+// BackupType is the kind of a backup.
+type BackupType string
+
+// Backup types.
+const (
+	FullBackup        BackupType = "full"
+	TableBackup       BackupType = "table"
+	IncrementalBackup BackupType = "incremental"
+)
+
+// VerifyStatus is the result of verifying a backup.
+type VerifyStatus string
+
+// Verify statuses.
+const (
+	VerifyUnknown VerifyStatus = "unknown"
+	VerifySkipped VerifyStatus = "skipped"
+	VerifyPassed  VerifyStatus = "passed"
+	VerifyFailed  VerifyStatus = "failed"
+)
+
+// BackupTSForm is the form in which the backup ts is specified.
+type BackupTSForm string
+
+// Backup ts forms.
+const (
+	BackupTSNow     BackupTSForm = "now"
+	BackupTSTimeAgo BackupTSForm = "timeago"
+	BackupTSTSO     BackupTSForm = "tso"
+	BackupTSTime    BackupTSForm = "time"
+)
+
+// BackupExtMeta records the information of a backup that the BackupMeta
+// protocol can not carry. It is saved as JSON next to the backupmeta.
+type BackupExtMeta struct {
+	Type   BackupType   `json:"type"`
+	Verify VerifyStatus `json:"verify"`
+	// BackupTSForm is empty if the backup is written by an old BR.
+	BackupTSForm BackupTSForm `json:"backup_ts_form,omitempty"`
+}
+
+// SaveBackupExtMeta writes the extended backup meta to the storage.
+func SaveBackupExtMeta(storage ExternalStorage, ext *BackupExtMeta) error {
+	data, err := json.Marshal(ext)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return storage.Write(MetaExtFile, data)
+}
+
+// LoadBackupExtMeta reads the extended backup meta from the storage.
+// It returns nil if the backup is written by an old BR without it.
+func LoadBackupExtMeta(storage ExternalStorage) (*BackupExtMeta, error) {
+	return loadBackupExtMeta(storage, MetaExtFile)
+}
+
+func loadBackupExtMeta(storage ExternalStorage, name string) (*BackupExtMeta, error) {
+	if !storage.FileExists(name) {
+		return nil, nil
+	}
+	data, err := storage.Read(name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	ext := &BackupExtMeta{}
+	if err = json.Unmarshal(data, ext); err != nil {
+		return nil, errors.Annotatef(err, "invalid %s", name)
+	}
+	return ext, nil
+}
+
+// CatalogEntry describes a backup found under a storage root.
+type CatalogEntry struct {
+	// Path is the directory of the backup relative to the storage root.
+	Path         string       `json:"path"`
+	Type         BackupType   `json:"type"`
+	StartVersion uint64       `json:"start_version"`
+	EndVersion   uint64       `json:"end_version"`
+	Size         int64        `json:"size"`
+	TableCount   int          `json:"table_count"`
+	Verify       VerifyStatus `json:"verify"`
+}
+
+// LoadCatalog discovers all backups under the storage root. Every
+// directory that holds a backupmeta is regarded as a backup.
+func LoadCatalog(storage ExternalStorage) ([]*CatalogEntry, error) {
+	sizes := make(map[string]int64)
+	dirs := make([]string, 0)
+	files := make(map[string]int64)
+	err := storage.WalkDir(func(p string, size int64) error {
+		files[p] = size
+		if path.Base(p) == MetaFile {
+			dirs = append(dirs, path.Dir(p))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// Longest directory first, so that nested backups own their files.
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+	for p, size := range files {
+		for _, dir := range dirs {
+			if dir == "." || strings.HasPrefix(p, dir+"/") {
+				sizes[dir] += size
+				break
+			}
+		}
+	}
+
+	entries := make([]*CatalogEntry, 0, len(dirs))
+	for _, dir := range dirs {
+		backupMeta, err := readBackupMeta(storage, path.Join(dir, MetaFile))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		ext, err := loadBackupExtMeta(storage, path.Join(dir, MetaExtFile))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		entry := &CatalogEntry{
+			Path:         dir,
+			StartVersion: backupMeta.StartVersion,
+			EndVersion:   backupMeta.EndVersion,
+			Size:         sizes[dir],
+			TableCount:   len(backupMeta.Schemas),
+			Type:         FullBackup,
+			Verify:       VerifyUnknown,
+		}
+		if backupMeta.StartVersion != backupMeta.EndVersion {
+			entry.Type = IncrementalBackup
+		}
+		if ext != nil {
+			entry.Type = ext.Type
+			entry.Verify = ext.Verify
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].EndVersion != entries[j].EndVersion {
+			return entries[i].EndVersion < entries[j].EndVersion
+		}
+		return entries[i].Path < entries[j].Path
+	})
+	return entries, nil
+}
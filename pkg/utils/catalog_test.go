@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"fmt"
+
+	"github.com/gogo/protobuf/proto"
+	. "github.com/pingcap/check"
+	"github.com/pingcap/kvproto/pkg/backup"
+)
+
+type testCatalogSuite struct{}
+
+var _ = Suite(&testCatalogSuite{})
+
+func (r *testCatalogSuite) TestLoadCatalog(c *C) {
+	root, err := CreateStorage(fmt.Sprintf("local://%s", c.MkDir()))
+	c.Assert(err, IsNil)
+
+	saveMeta := func(dir string, meta *backup.BackupMeta) {
+		data, err := proto.Marshal(meta)
+		c.Assert(err, IsNil)
+		s, err := CreateStorage(fmt.Sprintf("local://%s", dir))
+		c.Assert(err, IsNil)
+		c.Assert(s.Write(MetaFile, data), IsNil)
+		c.Assert(s.Write("1.sst", make([]byte, 100)), IsNil)
+	}
+	base := root.(*LocalStorage).base
+
+	// A full backup written by an old BR, without extended meta.
+	saveMeta(base+"/full", &backup.BackupMeta{
+		StartVersion: 10,
+		EndVersion:   10,
+		Schemas:      []*backup.Schema{{}, {}},
+	})
+	// A table backup with extended meta.
+	saveMeta(base+"/db/table", &backup.BackupMeta{
+		StartVersion: 20,
+		EndVersion:   20,
+		Schemas:      []*backup.Schema{{}},
+	})
+	tblStorage, err := CreateStorage(fmt.Sprintf("local://%s/db/table", base))
+	c.Assert(err, IsNil)
+	err = SaveBackupExtMeta(tblStorage, &BackupExtMeta{Type: TableBackup, Verify: VerifyPassed})
+	c.Assert(err, IsNil)
+	// An incremental backup.
+	saveMeta(base+"/inc", &backup.BackupMeta{
+		StartVersion: 10,
+		EndVersion:   30,
+	})
+	// Files which do not belong to any backup.
+	c.Assert(root.Write("garbage", []byte("garbage")), IsNil)
+
+	entries, err := LoadCatalog(root)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 3)
+
+	c.Assert(entries[0].Path, Equals, "full")
+	c.Assert(entries[0].Type, Equals, FullBackup)
+	c.Assert(entries[0].Verify, Equals, VerifyUnknown)
+	c.Assert(entries[0].TableCount, Equals, 2)
+
+	c.Assert(entries[1].Path, Equals, "db/table")
+	c.Assert(entries[1].Type, Equals, TableBackup)
+	c.Assert(entries[1].Verify, Equals, VerifyPassed)
+	c.Assert(entries[1].TableCount, Equals, 1)
+
+	c.Assert(entries[2].Path, Equals, "inc")
+	c.Assert(entries[2].Type, Equals, IncrementalBackup)
+	c.Assert(entries[2].StartVersion, Equals, uint64(10))
+	c.Assert(entries[2].EndVersion, Equals, uint64(30))
+
+	for _, e := range entries {
+		c.Assert(e.Size, Greater, int64(100))
+	}
+}
@@ -0,0 +1,221 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+)
+
+const (
+	dialTimeout      = 5 * time.Second
+	keepAlive        = 10 * time.Second
+	keepAliveTimeout = 3 * time.Second
+	backoffMaxDelay  = 3 * time.Second
+)
+
+// SecurityConfig is the paths of the certificates for TLS connections.
+type SecurityConfig struct {
+	CA   string
+	Cert string
+	Key  string
+}
+
+// ToTLSConfig loads the certificates, it returns nil if TLS is not enabled.
+func (s SecurityConfig) ToTLSConfig() (*tls.Config, error) {
+	if len(s.CA) == 0 {
+		return nil, nil
+	}
+	certPool := x509.NewCertPool()
+	ca, err := ioutil.ReadFile(s.CA)
+	if err != nil {
+		return nil, errors.Annotatef(err, "read CA %s", s.CA)
+	}
+	if !certPool.AppendCertsFromPEM(ca) {
+		return nil, errors.Errorf("failed to append CA %s", s.CA)
+	}
+	tlsConf := &tls.Config{RootCAs: certPool}
+	if len(s.Cert) != 0 || len(s.Key) != 0 {
+		cert, err := tls.LoadX509KeyPair(s.Cert, s.Key)
+		if err != nil {
+			return nil, errors.Annotatef(err, "load key pair %s %s", s.Cert, s.Key)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConf, nil
+}
+
+// StoreGetter gets the store by id, it is implemented by the PD client.
+type StoreGetter interface {
+	GetStore(ctx context.Context, storeID uint64) (*metapb.Store, error)
+}
+
+// StoreConns manages the gRPC connections to the stores. Every store has a
+// fixed number of connections which are used in turn, a connection which
+// fails is dialed again on the next use.
+type StoreConns struct {
+	ctx           context.Context
+	stores        StoreGetter
+	tlsConf       *tls.Config
+	connsPerStore int
+
+	mu    sync.Mutex
+	conns map[uint64]*storeConns
+}
+
+// storeConns are the connections to a store. Dialing a store holds only its
+// own lock, so that a slow store or PD does not block the others.
+type storeConns struct {
+	mu    sync.Mutex
+	conns []*grpc.ClientConn
+	next  int
+	// closed is set when the connections are reset, the entry is replaced by
+	// a new one then.
+	closed bool
+}
+
+// NewStoreConns returns a new StoreConns, tlsConf is nil if TLS is not
+// enabled.
+func NewStoreConns(
+	ctx context.Context, stores StoreGetter, tlsConf *tls.Config, connsPerStore int,
+) *StoreConns {
+	if connsPerStore < 1 {
+		connsPerStore = 1
+	}
+	return &StoreConns{
+		ctx:           ctx,
+		stores:        stores,
+		tlsConf:       tlsConf,
+		connsPerStore: connsPerStore,
+		conns:         make(map[uint64]*storeConns),
+	}
+}
+
+func (s *StoreConns) getStoreConns(storeID uint64) *storeConns {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sc, ok := s.conns[storeID]
+	if !ok {
+		sc = &storeConns{conns: make([]*grpc.ClientConn, s.connsPerStore)}
+		s.conns[storeID] = sc
+	}
+	return sc
+}
+
+// GetConn returns a connection to the store.
+func (s *StoreConns) GetConn(storeID uint64) (*grpc.ClientConn, error) {
+	for {
+		sc := s.getStoreConns(storeID)
+		sc.mu.Lock()
+		if sc.closed {
+			// Reset concurrently, use the new entry.
+			sc.mu.Unlock()
+			continue
+		}
+		conn, err := s.getConn(storeID, sc)
+		sc.mu.Unlock()
+		return conn, err
+	}
+}
+
+func (s *StoreConns) getConn(storeID uint64, sc *storeConns) (*grpc.ClientConn, error) {
+	i := sc.next
+	sc.next = (i + 1) % len(sc.conns)
+	if conn := sc.conns[i]; conn != nil {
+		state := conn.GetState()
+		if state != connectivity.TransientFailure && state != connectivity.Shutdown {
+			return conn, nil
+		}
+		log.Info("reset unhealthy connection",
+			zap.Uint64("store", storeID), zap.Stringer("state", state))
+		if err := conn.Close(); err != nil {
+			log.Warn("close connection failed", zap.Uint64("store", storeID), zap.Error(err))
+		}
+		sc.conns[i] = nil
+	}
+	conn, err := s.dial(storeID)
+	if err != nil {
+		return nil, err
+	}
+	sc.conns[i] = conn
+	return conn, nil
+}
+
+func (s *StoreConns) dial(storeID uint64) (*grpc.ClientConn, error) {
+	store, err := s.stores.GetStore(s.ctx, storeID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	opt := grpc.WithInsecure()
+	if s.tlsConf != nil {
+		opt = grpc.WithTransportCredentials(credentials.NewTLS(s.tlsConf))
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, dialTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(
+		ctx,
+		store.GetAddress(),
+		opt,
+		grpc.WithBackoffMaxDelay(backoffMaxDelay),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                keepAlive,
+			Timeout:             keepAliveTimeout,
+			PermitWithoutStream: true,
+		}),
+	)
+	if err != nil {
+		return nil, errors.Annotatef(err, "dial store %d %s", storeID, store.GetAddress())
+	}
+	return conn, nil
+}
+
+// ResetConns closes all the connections to the store, they are dialed again
+// on the next use.
+func (s *StoreConns) ResetConns(storeID uint64) error {
+	s.mu.Lock()
+	sc, ok := s.conns[storeID]
+	delete(s.conns, storeID)
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.closed = true
+	var firstErr error
+	for _, conn := range sc.conns {
+		if conn == nil {
+			continue
+		}
+		if err := conn.Close(); err != nil && firstErr == nil {
+			firstErr = errors.Trace(err)
+		}
+	}
+	return firstErr
+}
+
+// Close closes all the connections.
+func (s *StoreConns) Close() {
+	s.mu.Lock()
+	storeIDs := make([]uint64, 0, len(s.conns))
+	for storeID := range s.conns {
+		storeIDs = append(storeIDs, storeID)
+	}
+	s.mu.Unlock()
+	for _, storeID := range storeIDs {
+		if err := s.ResetConns(storeID); err != nil {
+			log.Warn("close connection failed", zap.Uint64("store", storeID), zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"context"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/metapb"
+)
+
+type testConnSuite struct{}
+
+var _ = Suite(&testConnSuite{})
+
+type fakeStores map[uint64]string
+
+func (f fakeStores) GetStore(ctx context.Context, storeID uint64) (*metapb.Store, error) {
+	addr, ok := f[storeID]
+	if !ok {
+		return nil, errors.Errorf("store %d not found", storeID)
+	}
+	return &metapb.Store{Id: storeID, Address: addr}, nil
+}
+
+func (r *testConnSuite) TestStoreConns(c *C) {
+	stores := fakeStores{1: "127.0.0.1:20160", 2: "127.0.0.1:20161"}
+	conns := NewStoreConns(context.Background(), stores, nil, 2)
+	defer conns.Close()
+
+	// The connections of a store are used in turn.
+	conn1, err := conns.GetConn(1)
+	c.Assert(err, IsNil)
+	conn2, err := conns.GetConn(1)
+	c.Assert(err, IsNil)
+	c.Assert(conn1, Not(Equals), conn2)
+	conn, err := conns.GetConn(1)
+	c.Assert(err, IsNil)
+	c.Assert(conn, Equals, conn1)
+	conn, err = conns.GetConn(2)
+	c.Assert(err, IsNil)
+	c.Assert(conn, Not(Equals), conn1)
+	c.Assert(conn, Not(Equals), conn2)
+
+	// A closed connection is dialed again.
+	c.Assert(conn2.Close(), IsNil)
+	conn, err = conns.GetConn(1)
+	c.Assert(err, IsNil)
+	c.Assert(conn, Not(Equals), conn2)
+
+	c.Assert(conns.ResetConns(1), IsNil)
+	conn, err = conns.GetConn(1)
+	c.Assert(err, IsNil)
+	c.Assert(conn, Not(Equals), conn1)
+
+	_, err = conns.GetConn(3)
+	c.Assert(err, ErrorMatches, "store 3 not found")
+}
+
+// blockingStores blocks getting the blocked store until unblock is closed.
+type blockingStores struct {
+	fakeStores
+	blocked uint64
+	entered chan struct{}
+	unblock chan struct{}
+}
+
+func (b *blockingStores) GetStore(ctx context.Context, storeID uint64) (*metapb.Store, error) {
+	if storeID == b.blocked {
+		close(b.entered)
+		<-b.unblock
+	}
+	return b.fakeStores.GetStore(ctx, storeID)
+}
+
+func (r *testConnSuite) TestSlowStoreNotBlockOthers(c *C) {
+	stores := &blockingStores{
+		fakeStores: fakeStores{1: "127.0.0.1:20160", 2: "127.0.0.1:20161"},
+		blocked:    2,
+		entered:    make(chan struct{}),
+		unblock:    make(chan struct{}),
+	}
+	conns := NewStoreConns(context.Background(), stores, nil, 1)
+	defer conns.Close()
+
+	slowCh := make(chan error, 1)
+	go func() {
+		_, err := conns.GetConn(2)
+		slowCh <- err
+	}()
+	<-stores.entered
+
+	fastCh := make(chan error, 1)
+	go func() {
+		_, err := conns.GetConn(1)
+		fastCh <- err
+	}()
+	select {
+	case err := <-fastCh:
+		c.Assert(err, IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatal("getting a connection is blocked by another store")
+	}
+	close(stores.unblock)
+	c.Assert(<-slowCh, IsNil)
+}
+
+func (r *testConnSuite) TestSecurityConfig(c *C) {
+	tlsConf, err := SecurityConfig{}.ToTLSConfig()
+	c.Assert(err, IsNil)
+	c.Assert(tlsConf, IsNil)
+
+	_, err = SecurityConfig{CA: "/not/exist/ca.pem"}.ToTLSConfig()
+	c.Assert(err, ErrorMatches, "read CA .*")
+}
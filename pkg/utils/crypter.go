@@ -0,0 +1,475 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pingcap/errors"
+)
+
+// CrypterMethod is the cipher used to encrypt files written by BR.
+type CrypterMethod string
+
+// Crypter methods.
+const (
+	CrypterPlaintext CrypterMethod = ""
+	CrypterAES256CTR CrypterMethod = "aes256-ctr"
+	CrypterAES256GCM CrypterMethod = "aes256-gcm"
+)
+
+const (
+	crypterKeyLen = 32
+	// The header of an encrypted file is: magic | version | method | nonce.
+	crypterMagic   = "BRCRPT"
+	crypterVersion = 1
+	crypterCTRID   = 1
+	crypterGCMID   = 2
+	ctrNonceLen    = aes.BlockSize
+	gcmNonceLen    = 12
+	// CTR files end with a HMAC-SHA256 over the header and the ciphertext.
+	ctrMacLen = sha256.Size
+	// GCM files are sealed in segments, so they can be streamed.
+	gcmSegmentLen = 64 * 1024
+	gcmTagLen     = 16
+)
+
+// plaintextSuffixes are files written by TiKV rather than BR, they are
+// read as is.
+var plaintextSuffixes = []string{".sst"}
+
+// ParseCrypterMethod checks the name of a crypter method.
+func ParseCrypterMethod(name string) (CrypterMethod, error) {
+	switch m := CrypterMethod(strings.ToLower(name)); m {
+	case CrypterPlaintext, CrypterAES256CTR, CrypterAES256GCM:
+		return m, nil
+	default:
+		return "", errors.Errorf("crypter method %s not support yet", name)
+	}
+}
+
+// LoadCrypterKey reads a 256 bits key from a file. The key is either 32 raw
+// bytes or 64 hex characters.
+func LoadCrypterKey(keyFile string) ([]byte, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == hex.EncodedLen(crypterKeyLen) {
+		key := make([]byte, crypterKeyLen)
+		if _, err = hex.Decode(key, trimmed); err == nil {
+			return key, nil
+		}
+	}
+	if len(data) != crypterKeyLen {
+		return nil, errors.Errorf("crypter key in %s must be %d bytes or %d hex characters",
+			keyFile, crypterKeyLen, hex.EncodedLen(crypterKeyLen))
+	}
+	return data, nil
+}
+
+// IsEncrypted checks whether data starts with the header of an encrypted file.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(crypterMagic))
+}
+
+// EncryptedStorage encrypts every file written by BR with an authenticated
+// header, and decrypts them transparently on read.
+type EncryptedStorage struct {
+	ExternalStorage
+	method CrypterMethod
+	encKey []byte
+	macKey []byte
+}
+
+// NewEncryptedStorage wraps the storage with the given crypter. It returns
+// the storage as is if the method is plaintext.
+func NewEncryptedStorage(
+	storage ExternalStorage, method CrypterMethod, key []byte,
+) (ExternalStorage, error) {
+	if method == CrypterPlaintext {
+		return storage, nil
+	}
+	if len(key) != crypterKeyLen {
+		return nil, errors.Errorf("crypter key must be %d bytes", crypterKeyLen)
+	}
+	return &EncryptedStorage{
+		ExternalStorage: storage,
+		method:          method,
+		encKey:          deriveKey(key, "br-encryption"),
+		macKey:          deriveKey(key, "br-authentication"),
+	}, nil
+}
+
+func deriveKey(key []byte, label string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(label))
+	return h.Sum(nil)
+}
+
+func isPlaintextFile(name string) bool {
+	for _, suffix := range plaintextSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Write implement ExternalStorage.Write
+func (s *EncryptedStorage) Write(name string, data []byte) error {
+	w, err := s.Create(name)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err = w.Write(data); err != nil {
+		_ = w.Close()
+		return errors.Trace(err)
+	}
+	return errors.Trace(w.Close())
+}
+
+// Read implement ExternalStorage.Read
+func (s *EncryptedStorage) Read(name string) ([]byte, error) {
+	r, err := s.Open(name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	return data, errors.Trace(err)
+}
+
+// Create implement ExternalStorage.Create
+func (s *EncryptedStorage) Create(name string) (io.WriteCloser, error) {
+	if isPlaintextFile(name) {
+		return s.ExternalStorage.Create(name)
+	}
+	w, err := s.ExternalStorage.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.newWriter(w)
+}
+
+// WriteExclusive implement ExternalStorage.WriteExclusive
+func (s *EncryptedStorage) WriteExclusive(name string, data []byte) error {
+	if isPlaintextFile(name) {
+		return s.ExternalStorage.WriteExclusive(name, data)
+	}
+	buf := &bufferCloser{}
+	w, err := s.newWriter(buf)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		return errors.Trace(err)
+	}
+	if err = w.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	return s.ExternalStorage.WriteExclusive(name, buf.Bytes())
+}
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error {
+	return nil
+}
+
+// newWriter writes the crypter header to w, and returns a writer which
+// encrypts data into w.
+func (s *EncryptedStorage) newWriter(w io.WriteCloser) (io.WriteCloser, error) {
+	var methodID byte
+	var nonce []byte
+	switch s.method {
+	case CrypterAES256CTR:
+		methodID, nonce = crypterCTRID, make([]byte, ctrNonceLen)
+	case CrypterAES256GCM:
+		methodID, nonce = crypterGCMID, make([]byte, gcmNonceLen)
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		_ = w.Close()
+		return nil, errors.Trace(err)
+	}
+	header := append([]byte(crypterMagic), crypterVersion, methodID)
+	header = append(header, nonce...)
+	if _, err := w.Write(header); err != nil {
+		_ = w.Close()
+		return nil, errors.Trace(err)
+	}
+	block, err := aes.NewCipher(s.encKey)
+	if err != nil {
+		_ = w.Close()
+		return nil, errors.Trace(err)
+	}
+	if s.method == CrypterAES256CTR {
+		mac := hmac.New(sha256.New, s.macKey)
+		_, _ = mac.Write(header)
+		return &ctrWriter{w: w, stream: cipher.NewCTR(block, nonce), mac: mac}, nil
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		_ = w.Close()
+		return nil, errors.Trace(err)
+	}
+	return &gcmWriter{w: w, aead: aead, nonce: nonce, header: header}, nil
+}
+
+// Open implement ExternalStorage.Open
+func (s *EncryptedStorage) Open(name string) (io.ReadCloser, error) {
+	r, err := s.ExternalStorage.Open(name)
+	if err != nil || isPlaintextFile(name) {
+		return r, err
+	}
+	header := make([]byte, len(crypterMagic)+2)
+	if _, err = io.ReadFull(r, header); err != nil || !IsEncrypted(header) {
+		_ = r.Close()
+		return nil, errors.Errorf("%s is not encrypted by BR", name)
+	}
+	if header[len(crypterMagic)] != crypterVersion {
+		_ = r.Close()
+		return nil, errors.Errorf("%s is encrypted by an unknown version %d",
+			name, header[len(crypterMagic)])
+	}
+	methodID := header[len(crypterMagic)+1]
+	nonceLen := ctrNonceLen
+	if methodID == crypterGCMID {
+		nonceLen = gcmNonceLen
+	} else if methodID != crypterCTRID {
+		_ = r.Close()
+		return nil, errors.Errorf("%s is encrypted by an unknown method %d", name, methodID)
+	}
+	nonce := make([]byte, nonceLen)
+	if _, err = io.ReadFull(r, nonce); err != nil {
+		_ = r.Close()
+		return nil, errors.Annotatef(err, "%s has a torn crypter header", name)
+	}
+	header = append(header, nonce...)
+	block, err := aes.NewCipher(s.encKey)
+	if err != nil {
+		_ = r.Close()
+		return nil, errors.Trace(err)
+	}
+	if methodID == crypterCTRID {
+		mac := hmac.New(sha256.New, s.macKey)
+		_, _ = mac.Write(header)
+		return &ctrReader{name: name, r: r, stream: cipher.NewCTR(block, nonce), mac: mac}, nil
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		_ = r.Close()
+		return nil, errors.Trace(err)
+	}
+	return &gcmReader{name: name, r: r, aead: aead, nonce: nonce, header: header}, nil
+}
+
+// OpenRange implement ExternalStorage.OpenRange
+func (s *EncryptedStorage) OpenRange(name string, offset, length int64) (io.ReadCloser, error) {
+	if isPlaintextFile(name) {
+		return s.ExternalStorage.OpenRange(name, offset, length)
+	}
+	return nil, errors.Errorf("range read on encrypted file %s is not supported", name)
+}
+
+// Size implement ExternalStorage.Size, it returns the size of the plaintext.
+func (s *EncryptedStorage) Size(name string) (int64, error) {
+	size, err := s.ExternalStorage.Size(name)
+	if err != nil || isPlaintextFile(name) {
+		return size, err
+	}
+	r, err := s.ExternalStorage.OpenRange(name, 0, int64(len(crypterMagic)+2))
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	header := make([]byte, len(crypterMagic)+2)
+	if _, err = io.ReadFull(r, header); err != nil || !IsEncrypted(header) {
+		return 0, errors.Errorf("%s is not encrypted by BR", name)
+	}
+	if header[len(crypterMagic)+1] == crypterCTRID {
+		return size - int64(len(header)+ctrNonceLen+ctrMacLen), nil
+	}
+	sealed := size - int64(len(header)+gcmNonceLen)
+	segments := sealed/(gcmSegmentLen+gcmTagLen) + 1
+	return sealed - segments*gcmTagLen, nil
+}
+
+type ctrWriter struct {
+	w      io.WriteCloser
+	stream cipher.Stream
+	mac    hash.Hash
+}
+
+func (cw *ctrWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, len(p))
+	cw.stream.XORKeyStream(buf, p)
+	_, _ = cw.mac.Write(buf)
+	n, err := cw.w.Write(buf)
+	return n, errors.Trace(err)
+}
+
+func (cw *ctrWriter) Close() error {
+	if _, err := cw.w.Write(cw.mac.Sum(nil)); err != nil {
+		_ = cw.w.Close()
+		return errors.Trace(err)
+	}
+	return cw.w.Close()
+}
+
+type ctrReader struct {
+	name   string
+	r      io.ReadCloser
+	stream cipher.Stream
+	mac    hash.Hash
+	// tail holds the bytes which may be the trailing MAC.
+	tail []byte
+	eof  bool
+}
+
+func (cr *ctrReader) Read(p []byte) (int, error) {
+	for !cr.eof && len(cr.tail) <= ctrMacLen {
+		buf := make([]byte, len(p)+ctrMacLen)
+		n, err := cr.r.Read(buf)
+		cr.tail = append(cr.tail, buf[:n]...)
+		if err == io.EOF {
+			cr.eof = true
+		} else if err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+	if len(cr.tail) < ctrMacLen {
+		return 0, errors.Errorf("%s is torn, the crypter MAC is missing", cr.name)
+	}
+	avail := len(cr.tail) - ctrMacLen
+	if avail == 0 {
+		if !hmac.Equal(cr.mac.Sum(nil), cr.tail) {
+			return 0, errors.Errorf("%s failed crypter authentication, it may be changed or torn", cr.name)
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, cr.tail[:avail])
+	_, _ = cr.mac.Write(cr.tail[:n])
+	cr.stream.XORKeyStream(p[:n], cr.tail[:n])
+	cr.tail = cr.tail[n:]
+	return n, nil
+}
+
+func (cr *ctrReader) Close() error {
+	return cr.r.Close()
+}
+
+func gcmSegmentNonce(nonce []byte, counter uint64) []byte {
+	n := append([]byte{}, nonce...)
+	var c [8]byte
+	binary.BigEndian.PutUint64(c[:], counter)
+	for i := range c {
+		n[len(n)-8+i] ^= c[i]
+	}
+	return n
+}
+
+func gcmSegmentAAD(header []byte, final bool) []byte {
+	aad := append([]byte{}, header...)
+	if final {
+		return append(aad, 1)
+	}
+	return append(aad, 0)
+}
+
+type gcmWriter struct {
+	w       io.WriteCloser
+	aead    cipher.AEAD
+	nonce   []byte
+	header  []byte
+	counter uint64
+	buf     []byte
+}
+
+func (gw *gcmWriter) seal(final bool) error {
+	sealed := gw.aead.Seal(nil,
+		gcmSegmentNonce(gw.nonce, gw.counter), gw.buf, gcmSegmentAAD(gw.header, final))
+	gw.counter++
+	gw.buf = gw.buf[:0]
+	_, err := gw.w.Write(sealed)
+	return errors.Trace(err)
+}
+
+func (gw *gcmWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := gcmSegmentLen - len(gw.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		gw.buf = append(gw.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(gw.buf) == gcmSegmentLen {
+			if err := gw.seal(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (gw *gcmWriter) Close() error {
+	// The last segment is always shorter than a full one, it may be empty.
+	if err := gw.seal(true); err != nil {
+		_ = gw.w.Close()
+		return err
+	}
+	return gw.w.Close()
+}
+
+type gcmReader struct {
+	name    string
+	r       io.ReadCloser
+	aead    cipher.AEAD
+	nonce   []byte
+	header  []byte
+	counter uint64
+	plain   []byte
+	final   bool
+}
+
+func (gr *gcmReader) Read(p []byte) (int, error) {
+	for len(gr.plain) == 0 {
+		if gr.final {
+			return 0, io.EOF
+		}
+		sealed := make([]byte, gcmSegmentLen+gcmTagLen)
+		n, err := io.ReadFull(gr.r, sealed)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			gr.final = true
+		} else if err != nil {
+			return 0, errors.Trace(err)
+		}
+		plain, err := gr.aead.Open(nil,
+			gcmSegmentNonce(gr.nonce, gr.counter), sealed[:n], gcmSegmentAAD(gr.header, gr.final))
+		if err != nil {
+			return 0, errors.Errorf("%s failed crypter authentication, it may be changed or torn", gr.name)
+		}
+		gr.counter++
+		gr.plain = plain
+	}
+	n := copy(p, gr.plain)
+	gr.plain = gr.plain[n:]
+	return n, nil
+}
+
+func (gr *gcmReader) Close() error {
+	return gr.r.Close()
+}
@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/kvproto/pkg/backup"
+)
+
+type testCrypterSuite struct{}
+
+var _ = Suite(&testCrypterSuite{})
+
+func (r *testCrypterSuite) newStorage(c *C, method CrypterMethod) (*LocalStorage, ExternalStorage) {
+	local, err := CreateStorage(fmt.Sprintf("local://%s", c.MkDir()))
+	c.Assert(err, IsNil)
+	key := make([]byte, crypterKeyLen)
+	rand.Read(key)
+	s, err := NewEncryptedStorage(local, method, key)
+	c.Assert(err, IsNil)
+	return local.(*LocalStorage), s
+}
+
+func (r *testCrypterSuite) TestRoundTrip(c *C) {
+	for _, method := range []CrypterMethod{CrypterAES256CTR, CrypterAES256GCM} {
+		local, s := r.newStorage(c, method)
+		for _, size := range []int{0, 1, gcmSegmentLen - 1, gcmSegmentLen, gcmSegmentLen + 1, 3*gcmSegmentLen + 7} {
+			c.Log(method, size)
+			data := make([]byte, size)
+			rand.Read(data)
+			c.Assert(s.Write("file", data), IsNil)
+
+			raw, err := local.Read("file")
+			c.Assert(err, IsNil)
+			c.Assert(IsEncrypted(raw), IsTrue)
+			if size > 16 {
+				c.Assert(bytes.Contains(raw, data), IsFalse)
+			}
+
+			plain, err := s.Read("file")
+			c.Assert(err, IsNil)
+			c.Assert(plain, DeepEquals, data)
+			n, err := s.Size("file")
+			c.Assert(err, IsNil)
+			c.Assert(n, Equals, int64(size))
+		}
+	}
+}
+
+func (r *testCrypterSuite) TestTamper(c *C) {
+	for _, method := range []CrypterMethod{CrypterAES256CTR, CrypterAES256GCM} {
+		local, s := r.newStorage(c, method)
+		data := make([]byte, 2*gcmSegmentLen)
+		rand.Read(data)
+		c.Assert(s.Write("file", data), IsNil)
+		raw, err := local.Read("file")
+		c.Assert(err, IsNil)
+
+		// Flip a bit.
+		changed := append([]byte{}, raw...)
+		changed[len(changed)/2] ^= 1
+		c.Assert(local.Write("file", changed), IsNil)
+		_, err = s.Read("file")
+		c.Assert(err, ErrorMatches, ".*failed crypter authentication.*")
+
+		// Truncate at a segment boundary.
+		c.Assert(local.Write("file", raw[:len(raw)-gcmTagLen]), IsNil)
+		_, err = s.Read("file")
+		c.Assert(err, NotNil)
+
+		// Plaintext file.
+		c.Assert(local.Write("file", data), IsNil)
+		_, err = s.Read("file")
+		c.Assert(err, ErrorMatches, "file is not encrypted by BR")
+	}
+}
+
+func (r *testCrypterSuite) TestPlaintextFiles(c *C) {
+	local, s := r.newStorage(c, CrypterAES256GCM)
+	c.Assert(local.Write("1_write.sst", []byte("sst")), IsNil)
+	data, err := s.Read("1_write.sst")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "sst")
+}
+
+func (r *testCrypterSuite) TestEncryptedBackupMeta(c *C) {
+	local, s := r.newStorage(c, CrypterAES256CTR)
+	meta := &backup.BackupMeta{ClusterId: 1, Path: "local:///tmp"}
+	c.Assert(WriteBackupMeta(s, meta), IsNil)
+
+	read, err := ReadBackupMeta(s)
+	c.Assert(err, IsNil)
+	c.Assert(read.ClusterId, Equals, uint64(1))
+
+	_, err = ReadBackupMeta(local)
+	c.Assert(err, ErrorMatches, ".*encrypted, please specify the crypter key")
+}
+
+func (r *testCrypterSuite) TestLoadCrypterKey(c *C) {
+	dir := c.MkDir()
+	hexKey := path.Join(dir, "hex")
+	err := ioutil.WriteFile(hexKey, []byte(
+		"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n"), os.ModePerm)
+	c.Assert(err, IsNil)
+	key, err := LoadCrypterKey(hexKey)
+	c.Assert(err, IsNil)
+	c.Assert(key, HasLen, crypterKeyLen)
+	c.Assert(key[31], Equals, byte(0x1f))
+
+	shortKey := path.Join(dir, "short")
+	c.Assert(ioutil.WriteFile(shortKey, []byte("short"), os.ModePerm), IsNil)
+	_, err = LoadCrypterKey(shortKey)
+	c.Assert(err, NotNil)
+
+	_, err = ParseCrypterMethod("des")
+	c.Assert(err, ErrorMatches, "crypter method des not support yet")
+}
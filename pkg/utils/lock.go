@@ -0,0 +1,219 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	// LockFile represents file name of the lock on a backup destination.
+	LockFile = "br.lock"
+	// DefaultLockTTL is the TTL of a lock, it is refreshed every third of
+	// the TTL while the lock is held.
+	DefaultLockTTL = 5 * time.Minute
+)
+
+// LockInfo describes the holder of a lock.
+type LockInfo struct {
+	Token      string    `json:"token"`
+	Host       string    `json:"host"`
+	PID        int       `json:"pid"`
+	Command    string    `json:"command"`
+	StartTime  time.Time `json:"start_time"`
+	ExpireTime time.Time `json:"expire_time"`
+}
+
+// IsExpired checks whether the holder stopped refreshing the lock.
+func (info *LockInfo) IsExpired(now time.Time) bool {
+	return now.After(info.ExpireTime)
+}
+
+func (info *LockInfo) String() string {
+	return fmt.Sprintf("held by %q on host %s (pid %d) since %s, expires at %s",
+		info.Command, info.Host, info.PID,
+		info.StartTime.Format(time.RFC3339), info.ExpireTime.Format(time.RFC3339))
+}
+
+// ErrLockLost is returned when the lock is removed or taken by others while
+// it is held.
+var ErrLockLost = errors.New("the storage lock is lost")
+
+// StorageLock is an exclusive lock on a storage.
+type StorageLock struct {
+	storage ExternalStorage
+	ttl     time.Duration
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	lost    chan struct{}
+
+	mu      sync.Mutex
+	info    LockInfo
+	lostErr error
+}
+
+// LockStorage creates the lock object on the storage, it fails fast if the
+// storage is locked by others. The lock is refreshed until Unlock.
+func LockStorage(
+	ctx context.Context, storage ExternalStorage, command string, ttl time.Duration,
+) (*StorageLock, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	now := time.Now()
+	l := &StorageLock{
+		storage: storage,
+		ttl:     ttl,
+		lost:    make(chan struct{}),
+		info: LockInfo{
+			Token:      uuid.New().String(),
+			Host:       host,
+			PID:        os.Getpid(),
+			Command:    command,
+			StartTime:  now,
+			ExpireTime: now.Add(ttl),
+		},
+	}
+	data, err := json.Marshal(&l.info)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	err = storage.WriteExclusive(LockFile, data)
+	if errors.Cause(err) == ErrFileExists {
+		holder, err1 := ReadStorageLock(storage)
+		if err1 != nil {
+			return nil, errors.Annotate(err1, "the storage is locked")
+		}
+		if holder.IsExpired(now) {
+			return nil, errors.Errorf(
+				"the storage is locked by a stale lock %s, run `br unlock` if no br is running on it",
+				holder)
+		}
+		return nil, errors.Errorf("the storage is locked, %s", holder)
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	log.Info("lock storage", zap.String("token", l.info.Token))
+
+	ctx, l.cancel = context.WithCancel(ctx)
+	l.wg.Add(1)
+	go l.refreshLoop(ctx)
+	return l, nil
+}
+
+func (l *StorageLock) refreshLoop(ctx context.Context) {
+	defer l.wg.Done()
+	t := time.NewTicker(l.ttl / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			err := l.refresh()
+			if errors.Cause(err) == ErrLockLost {
+				log.Error("storage lock is lost", zap.Error(err))
+				l.mu.Lock()
+				l.lostErr = err
+				l.mu.Unlock()
+				close(l.lost)
+				return
+			}
+			if err != nil {
+				// Ignore the error since it retries every tick.
+				log.Warn("refresh storage lock failed", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (l *StorageLock) refresh() error {
+	if !l.storage.FileExists(LockFile) {
+		return errors.Annotate(ErrLockLost, "the lock is removed")
+	}
+	holder, err := ReadStorageLock(l.storage)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if holder.Token != l.info.Token {
+		return errors.Annotatef(ErrLockLost, "the lock is taken away, it is %s", holder)
+	}
+	l.info.ExpireTime = time.Now().Add(l.ttl)
+	data, err := json.Marshal(&l.info)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return l.storage.Write(LockFile, data)
+}
+
+// Lost returns a channel which is closed when the lock is lost, the holder
+// must stop writing the storage then.
+func (l *StorageLock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Err returns why the lock is lost, it is nil if the lock is held.
+func (l *StorageLock) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lostErr
+}
+
+// Unlock stops refreshing and removes the lock if it is still held.
+func (l *StorageLock) Unlock() error {
+	l.cancel()
+	l.wg.Wait()
+	holder, err := ReadStorageLock(l.storage)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if holder.Token != l.info.Token {
+		return errors.Errorf("the lock is taken away, it is %s", holder)
+	}
+	log.Info("unlock storage", zap.String("token", l.info.Token))
+	return errors.Trace(l.storage.Delete(LockFile))
+}
+
+// RemoveStorageLock removes the lock on the storage and returns its holder,
+// which is nil if the lock is unreadable. A lock which is not expired or
+// unreadable may be held by a running br, it is removed only if force is set.
+func RemoveStorageLock(storage ExternalStorage, force bool) (*LockInfo, error) {
+	holder, err := ReadStorageLock(storage)
+	if err != nil {
+		if !force {
+			return nil, errors.Annotate(err, "can not tell whether the lock is held, use --force to remove it")
+		}
+		log.Warn("remove an unreadable storage lock", zap.Error(err))
+		holder = nil
+	} else if !holder.IsExpired(time.Now()) && !force {
+		return holder, errors.Errorf(
+			"the lock is not expired, %s, use --force to remove it if no br is running on the storage",
+			holder)
+	}
+	return holder, errors.Trace(storage.Delete(LockFile))
+}
+
+// ReadStorageLock reads the lock of the storage.
+func ReadStorageLock(storage ExternalStorage) (*LockInfo, error) {
+	data, err := storage.Read(LockFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	info := &LockInfo{}
+	if err = json.Unmarshal(data, info); err != nil {
+		return nil, errors.Annotatef(err, "invalid %s", LockFile)
+	}
+	return info, nil
+}
@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "github.com/pingcap/check"
+)
+
+type testLockSuite struct{}
+
+var _ = Suite(&testLockSuite{})
+
+func (r *testLockSuite) TestLockStorage(c *C) {
+	s, err := CreateStorage(fmt.Sprintf("local://%s", c.MkDir()))
+	c.Assert(err, IsNil)
+	ctx := context.Background()
+
+	lock, err := LockStorage(ctx, s, "br backup full", time.Minute)
+	c.Assert(err, IsNil)
+	_, err = LockStorage(ctx, s, "br restore full", time.Minute)
+	c.Assert(err, ErrorMatches, `the storage is locked, held by "br backup full".*`)
+
+	c.Assert(lock.Unlock(), IsNil)
+	c.Assert(s.FileExists(LockFile), IsFalse)
+
+	lock, err = LockStorage(ctx, s, "br restore full", time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(lock.Unlock(), IsNil)
+}
+
+func (r *testLockSuite) TestRefreshAndStaleLock(c *C) {
+	s, err := CreateStorage(fmt.Sprintf("local://%s", c.MkDir()))
+	c.Assert(err, IsNil)
+	ctx := context.Background()
+
+	lock, err := LockStorage(ctx, s, "br backup full", 300*time.Millisecond)
+	c.Assert(err, IsNil)
+	first, err := ReadStorageLock(s)
+	c.Assert(err, IsNil)
+	time.Sleep(500 * time.Millisecond)
+	refreshed, err := ReadStorageLock(s)
+	c.Assert(err, IsNil)
+	c.Assert(refreshed.ExpireTime.After(first.ExpireTime), IsTrue)
+
+	// Stop refreshing without removing the lock, as if br crashed.
+	lock.cancel()
+	lock.wg.Wait()
+	time.Sleep(400 * time.Millisecond)
+	_, err = LockStorage(ctx, s, "br backup full", time.Minute)
+	c.Assert(err, ErrorMatches, "the storage is locked by a stale lock.*")
+
+	c.Assert(s.Delete(LockFile), IsNil)
+	lock, err = LockStorage(ctx, s, "br backup full", time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(lock.Unlock(), IsNil)
+}
+
+func (r *testLockSuite) TestRemoveStorageLock(c *C) {
+	s, err := CreateStorage(fmt.Sprintf("local://%s", c.MkDir()))
+	c.Assert(err, IsNil)
+	ctx := context.Background()
+
+	// A live lock is not removed without force.
+	lock, err := LockStorage(ctx, s, "br backup full", time.Minute)
+	c.Assert(err, IsNil)
+	holder, err := RemoveStorageLock(s, false)
+	c.Assert(err, ErrorMatches, `the lock is not expired, held by "br backup full" on host .* \(pid \d+\).*`)
+	c.Assert(holder.PID, Equals, lock.info.PID)
+	c.Assert(s.FileExists(LockFile), IsTrue)
+	holder, err = RemoveStorageLock(s, true)
+	c.Assert(err, IsNil)
+	c.Assert(holder.Token, Equals, lock.info.Token)
+	c.Assert(s.FileExists(LockFile), IsFalse)
+	lock.cancel()
+	lock.wg.Wait()
+
+	// An expired lock is removed.
+	lock, err = LockStorage(ctx, s, "br restore full", 300*time.Millisecond)
+	c.Assert(err, IsNil)
+	lock.cancel()
+	lock.wg.Wait()
+	time.Sleep(400 * time.Millisecond)
+	holder, err = RemoveStorageLock(s, false)
+	c.Assert(err, IsNil)
+	c.Assert(holder.Command, Equals, "br restore full")
+	c.Assert(s.FileExists(LockFile), IsFalse)
+
+	// An unreadable lock is removed only with force.
+	c.Assert(s.Write(LockFile, []byte("torn")), IsNil)
+	_, err = RemoveStorageLock(s, false)
+	c.Assert(err, ErrorMatches, "can not tell whether the lock is held.*")
+	holder, err = RemoveStorageLock(s, true)
+	c.Assert(err, IsNil)
+	c.Assert(holder, IsNil)
+	c.Assert(s.FileExists(LockFile), IsFalse)
+}
+
+func (r *testLockSuite) TestLockLost(c *C) {
+	s, err := CreateStorage(fmt.Sprintf("local://%s", c.MkDir()))
+	c.Assert(err, IsNil)
+	ctx := context.Background()
+
+	lock, err := LockStorage(ctx, s, "br backup full", 300*time.Millisecond)
+	c.Assert(err, IsNil)
+	c.Assert(lock.Err(), IsNil)
+	// Another br removes the lock and takes it.
+	c.Assert(s.Delete(LockFile), IsNil)
+	other, err := LockStorage(ctx, s, "br restore full", time.Minute)
+	c.Assert(err, IsNil)
+	select {
+	case <-lock.Lost():
+	case <-time.After(5 * time.Second):
+		c.Fatal("the lost lock is not detected")
+	}
+	c.Assert(lock.Err(), ErrorMatches, "the lock is taken away.*")
+	c.Assert(lock.Unlock(), NotNil)
+	c.Assert(other.Unlock(), IsNil)
+
+	lock, err = LockStorage(ctx, s, "br backup full", 300*time.Millisecond)
+	c.Assert(err, IsNil)
+	c.Assert(s.Delete(LockFile), IsNil)
+	select {
+	case <-lock.Lost():
+	case <-time.After(5 * time.Second):
+		c.Fatal("the removed lock is not detected")
+	}
+	c.Assert(lock.Err(), ErrorMatches, "the lock is removed.*")
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"sort"
 	"strings"
 
 	"github.com/pingcap/errors"
@@ -17,8 +18,39 @@ import (
 const (
 	// MetaFile represents file name
 	MetaFile = "backupmeta"
+	// SystemDatabase is the database of TiDB's system tables.
+	SystemDatabase = "mysql"
 )
 
+// SystemTables are the system tables that can be backed up, mapped to the
+// columns which identify a row.
+var SystemTables = map[string][]string{
+	"user":             {"Host", "User"},
+	"db":               {"Host", "DB", "User"},
+	"tables_priv":      {"Host", "DB", "User", "Table_name"},
+	"columns_priv":     {"Host", "DB", "User", "Table_name", "Column_name"},
+	"role_edges":       {"FROM_HOST", "FROM_USER", "TO_HOST", "TO_USER"},
+	"default_roles":    {"HOST", "USER", "DEFAULT_ROLE_HOST", "DEFAULT_ROLE_USER"},
+	"global_variables": {"VARIABLE_NAME"},
+	"bind_info":        {"original_sql", "default_db"},
+}
+
+// CheckSystemTables checks whether the system tables can be backed up.
+func CheckSystemTables(names []string) error {
+	for _, name := range names {
+		if _, ok := SystemTables[strings.ToLower(name)]; !ok {
+			supported := make([]string, 0, len(SystemTables))
+			for t := range SystemTables {
+				supported = append(supported, t)
+			}
+			sort.Strings(supported)
+			return errors.Errorf("system table %s is not supported, supported tables are %s",
+				name, strings.Join(supported, ", "))
+		}
+	}
+	return nil
+}
+
 // Table wraps the schema and files of a table.
 type Table struct {
 	Db         *model.DBInfo
@@ -33,6 +65,8 @@ type Table struct {
 type Database struct {
 	Schema *model.DBInfo
 	Tables []*Table
+	// Views have no data, so they are not in Tables.
+	Views []*Table
 }
 
 // GetTable returns a table of the database by name.
@@ -45,6 +79,16 @@ func (db *Database) GetTable(name string) *Table {
 	return nil
 }
 
+// GetView returns a view of the database by name.
+func (db *Database) GetView(name string) *Table {
+	for _, view := range db.Views {
+		if view.Schema.Name.String() == name {
+			return view
+		}
+	}
+	return nil
+}
+
 // LoadBackupTables loads schemas from BackupMeta.
 func LoadBackupTables(meta *backup.BackupMeta) (map[string]*Database, error) {
 	databases := make(map[string]*Database)
@@ -70,6 +114,17 @@ func LoadBackupTables(meta *backup.BackupMeta) (map[string]*Database, error) {
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
+		if tableInfo.IsView() {
+			db.Views = append(db.Views, &Table{Db: dbInfo, Schema: tableInfo})
+			continue
+		}
+		// The data of a partitioned table is stored in its partitions.
+		physicalIDs := map[int64]bool{tableInfo.ID: true}
+		if pi := tableInfo.GetPartitionInfo(); pi != nil {
+			for _, def := range pi.Definitions {
+				physicalIDs[def.ID] = true
+			}
+		}
 		// Find the files belong to the table
 		tableFiles := make([]*backup.File, 0)
 		for _, file := range meta.Files {
@@ -80,7 +135,7 @@ func LoadBackupTables(meta *backup.BackupMeta) (map[string]*Database, error) {
 			}
 			startTableID := tablecodec.DecodeTableID(file.GetStartKey())
 			// If the file contains a part of the data of the table, append it to the slice.
-			if startTableID == tableInfo.ID {
+			if physicalIDs[startTableID] {
 				tableFiles = append(tableFiles, file)
 			}
 		}
@@ -69,3 +69,80 @@ func (r *testSchemaSuite) TestLoadBackupMeta(c *C) {
 	c.Assert(tbl.Files, HasLen, 1)
 	c.Assert(tbl.Files[0].Name, Equals, "1.sst")
 }
+
+func (r *testSchemaSuite) TestLoadPartitionedBackupMeta(c *C) {
+	tblName := model.NewCIStr("t1")
+	dbName := model.NewCIStr("test")
+	tblID := int64(100)
+	mockTbl := &model.TableInfo{
+		ID:   tblID,
+		Name: tblName,
+		Partition: &model.PartitionInfo{
+			Type:   model.PartitionTypeHash,
+			Enable: true,
+			Definitions: []model.PartitionDefinition{
+				{ID: 101, Name: model.NewCIStr("p0")},
+				{ID: 102, Name: model.NewCIStr("p1")},
+			},
+		},
+	}
+	dbBytes, err := json.Marshal(model.DBInfo{ID: 1, Name: dbName})
+	c.Assert(err, IsNil)
+	tblBytes, err := json.Marshal(mockTbl)
+	c.Assert(err, IsNil)
+
+	mockFiles := []*backup.File{
+		{
+			Name:     "p0.sst",
+			StartKey: tablecodec.EncodeRowKey(101, []byte("a")),
+			EndKey:   tablecodec.EncodeRowKey(102, []byte("a")),
+		},
+		{
+			Name:     "p1.sst",
+			StartKey: tablecodec.EncodeRowKey(102, []byte("a")),
+			EndKey:   tablecodec.EncodeRowKey(103, []byte("a")),
+		},
+		// shouldn't include other.sst
+		{
+			Name:     "other.sst",
+			StartKey: tablecodec.EncodeRowKey(103, []byte("a")),
+			EndKey:   tablecodec.EncodeRowKey(104, []byte("a")),
+		},
+	}
+	meta := mockBackupMeta([]*backup.Schema{{Db: dbBytes, Table: tblBytes}}, mockFiles)
+	dbs, err := LoadBackupTables(meta)
+	c.Assert(err, IsNil)
+	tbl := dbs[dbName.String()].GetTable(tblName.String())
+	c.Assert(tbl.Files, HasLen, 2)
+	c.Assert(tbl.Files[0].Name, Equals, "p0.sst")
+	c.Assert(tbl.Files[1].Name, Equals, "p1.sst")
+}
+
+func (r *testSchemaSuite) TestLoadViewBackupMeta(c *C) {
+	dbName := model.NewCIStr("test")
+	dbBytes, err := json.Marshal(model.DBInfo{ID: 1, Name: dbName})
+	c.Assert(err, IsNil)
+	tblBytes, err := json.Marshal(&model.TableInfo{ID: 10, Name: model.NewCIStr("t")})
+	c.Assert(err, IsNil)
+	viewBytes, err := json.Marshal(&model.TableInfo{
+		ID:   11,
+		Name: model.NewCIStr("v"),
+		View: &model.ViewInfo{SelectStmt: "SELECT * FROM `test`.`t`"},
+	})
+	c.Assert(err, IsNil)
+
+	meta := mockBackupMeta([]*backup.Schema{
+		{Db: dbBytes, Table: tblBytes},
+		{Db: dbBytes, Table: viewBytes},
+	}, nil)
+	dbs, err := LoadBackupTables(meta)
+	c.Assert(err, IsNil)
+	db := dbs[dbName.String()]
+	c.Assert(db.Tables, HasLen, 1)
+	c.Assert(db.Tables[0].Schema.Name.L, Equals, "t")
+	c.Assert(db.Views, HasLen, 1)
+	c.Assert(db.Views[0].Schema.Name.L, Equals, "v")
+	c.Assert(db.GetTable("v"), IsNil)
+	c.Assert(db.GetView("v"), Equals, db.Views[0])
+	c.Assert(db.GetView("t"), IsNil)
+}
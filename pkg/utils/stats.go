@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/statistics/handle"
+)
+
+// StatsFile returns the file name of the statistics of a table. Table ID is
+// used instead of table name, since it is unique and safe as a file name.
+func StatsFile(tableID int64) string {
+	return fmt.Sprintf("stats/%d.json", tableID)
+}
+
+// SaveTableStats writes the statistics of a table in TiDB's JSON format.
+func SaveTableStats(storage ExternalStorage, tableID int64, stats *handle.JSONTable) error {
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return storage.Write(StatsFile(tableID), data)
+}
+
+// LoadTableStats reads the statistics of a table. It returns nil if the
+// table has no statistics in the backup.
+func LoadTableStats(storage ExternalStorage, tableID int64) (*handle.JSONTable, error) {
+	name := StatsFile(tableID)
+	if !storage.FileExists(name) {
+		return nil, nil
+	}
+	data, err := storage.Read(name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	stats := &handle.JSONTable{}
+	if err = json.Unmarshal(data, stats); err != nil {
+		return nil, errors.Annotatef(err, "invalid %s", name)
+	}
+	return stats, nil
+}
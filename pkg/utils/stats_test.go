@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"fmt"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/statistics/handle"
+)
+
+type testStatsSuite struct{}
+
+var _ = Suite(&testStatsSuite{})
+
+func (r *testStatsSuite) TestTableStats(c *C) {
+	storage, err := CreateStorage(fmt.Sprintf("local://%s", c.MkDir()))
+	c.Assert(err, IsNil)
+
+	stats, err := LoadTableStats(storage, 42)
+	c.Assert(err, IsNil)
+	c.Assert(stats, IsNil)
+
+	err = SaveTableStats(storage, 42, &handle.JSONTable{
+		DatabaseName: "test",
+		TableName:    "t",
+		Count:        100,
+		ModifyCount:  3,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(storage.FileExists("stats/42.json"), IsTrue)
+	stats, err = LoadTableStats(storage, 42)
+	c.Assert(err, IsNil)
+	c.Assert(stats.DatabaseName, Equals, "test")
+	c.Assert(stats.TableName, Equals, "t")
+	c.Assert(stats.Count, Equals, int64(100))
+	c.Assert(stats.ModifyCount, Equals, int64(3))
+
+	c.Assert(storage.Write(StatsFile(43), []byte("{")), IsNil)
+	_, err = LoadTableStats(storage, 43)
+	c.Assert(err, ErrorMatches, "invalid stats/43.json.*")
+}
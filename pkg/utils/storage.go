@@ -1,10 +1,12 @@
 package utils
 
 import (
+	"io"
 	"io/ioutil"
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"syscall"
 
 	"github.com/pingcap/errors"
@@ -18,6 +20,41 @@ type ExternalStorage interface {
 	Read(name string) ([]byte, error)
 	// FileExists return true if file exists
 	FileExists(name string) bool
+	// Open opens a storage file for streaming read
+	Open(name string) (io.ReadCloser, error)
+	// OpenRange opens a storage file and reads at most length bytes
+	// starting from offset
+	OpenRange(name string, offset, length int64) (io.ReadCloser, error)
+	// Create creates a storage file for streaming write
+	Create(name string) (io.WriteCloser, error)
+	// Size returns the size of a storage file
+	Size(name string) (int64, error)
+	// Delete deletes a storage file
+	Delete(name string) error
+	// WriteExclusive writes file to storage only if it does not exist,
+	// otherwise ErrFileExists is returned
+	WriteExclusive(name string, data []byte) error
+	// WalkDir traverses all files in storage, fn is called with the path
+	// relative to the storage root and the size of every file.
+	WalkDir(fn func(path string, size int64) error) error
+}
+
+// ErrFileExists is returned when writing exclusively to an existing file.
+var ErrFileExists = errors.New("file exists")
+
+// probeFile is written and deleted to check a storage is writable.
+const probeFile = "br.probe"
+
+// CheckWritable checks the storage is writable by writing and deleting a
+// probe file.
+func CheckWritable(storage ExternalStorage) error {
+	if err := storage.Write(probeFile, []byte("probe")); err != nil {
+		return errors.Annotate(err, "storage is not writable")
+	}
+	if err := storage.Delete(probeFile); err != nil {
+		return errors.Annotate(err, "storage is not writable")
+	}
+	return nil
 }
 
 // CreateStorage create ExternalStorage
@@ -40,9 +77,18 @@ type LocalStorage struct {
 	base string
 }
 
+// Write writes the data to a temporary file, and then renames it to name,
+// so that a crash never leaves a torn file.
 func (l *LocalStorage) Write(name string, data []byte) error {
-	filepath := path.Join(l.base, name)
-	return ioutil.WriteFile(filepath, data, 0644)
+	w, err := l.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		_ = w.Close()
+		return errors.Trace(err)
+	}
+	return w.Close()
 }
 
 func (l *LocalStorage) Read(name string) ([]byte, error) {
@@ -50,12 +96,166 @@ func (l *LocalStorage) Read(name string) ([]byte, error) {
 	return ioutil.ReadFile(filepath)
 }
 
+// WriteExclusive implement ExternalStorage.WriteExclusive, it links a
+// temporary file to name, which fails atomically if name exists.
+func (l *LocalStorage) WriteExclusive(name string, data []byte) error {
+	filepath := path.Join(l.base, name)
+	dir := path.Dir(filepath)
+	f, err := ioutil.TempFile(dir, "."+path.Base(filepath)+".tmp")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = os.Link(f.Name(), filepath); err != nil {
+		if os.IsExist(err) {
+			return ErrFileExists
+		}
+		return errors.Trace(err)
+	}
+	return syncDir(dir)
+}
+
+// Open implement ExternalStorage.Open
+func (l *LocalStorage) Open(name string) (io.ReadCloser, error) {
+	return os.Open(path.Join(l.base, name))
+}
+
+// OpenRange implement ExternalStorage.OpenRange
+func (l *LocalStorage) OpenRange(name string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(path.Join(l.base, name))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		_ = f.Close()
+		return nil, errors.Trace(err)
+	}
+	return &limitedReadCloser{Reader: io.LimitReader(f, length), Closer: f}, nil
+}
+
+// Create implement ExternalStorage.Create, the file is atomically visible
+// after Close succeeds.
+func (l *LocalStorage) Create(name string) (io.WriteCloser, error) {
+	filepath := path.Join(l.base, name)
+	dir := path.Dir(filepath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+	f, err := ioutil.TempFile(dir, "."+path.Base(filepath)+".tmp")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &atomicFile{File: f, target: filepath}, nil
+}
+
+// Size implement ExternalStorage.Size
+func (l *LocalStorage) Size(name string) (int64, error) {
+	f, err := os.Stat(path.Join(l.base, name))
+	if err != nil {
+		return 0, err
+	}
+	return f.Size(), nil
+}
+
+// Delete implement ExternalStorage.Delete
+func (l *LocalStorage) Delete(name string) error {
+	return os.Remove(path.Join(l.base, name))
+}
+
+// atomicFile is a temporary file which is renamed to the target on Close.
+// It is discarded if any write fails.
+type atomicFile struct {
+	*os.File
+	target string
+	err    error
+}
+
+func (f *atomicFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	if err != nil && f.err == nil {
+		f.err = err
+	}
+	return n, err
+}
+
+func (f *atomicFile) abort() {
+	_ = f.File.Close()
+	_ = os.Remove(f.Name())
+}
+
+// Close syncs the temporary file, renames it to the target and syncs the
+// directory to persist the rename.
+func (f *atomicFile) Close() error {
+	if f.err != nil {
+		f.abort()
+		return errors.Annotate(f.err, "discard the torn file")
+	}
+	if err := f.File.Chmod(0644); err != nil {
+		f.abort()
+		return errors.Trace(err)
+	}
+	if err := f.File.Sync(); err != nil {
+		f.abort()
+		return errors.Trace(err)
+	}
+	if err := f.File.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return errors.Trace(err)
+	}
+	if err := os.Rename(f.Name(), f.target); err != nil {
+		_ = os.Remove(f.Name())
+		return errors.Trace(err)
+	}
+	return syncDir(path.Dir(f.target))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer d.Close()
+	return errors.Trace(d.Sync())
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
 // FileExists implement ExternalStorage.FileExists
 func (l *LocalStorage) FileExists(name string) bool {
 	filepath := path.Join(l.base, name)
 	return pathExists(filepath)
 }
 
+// WalkDir implement ExternalStorage.WalkDir
+func (l *LocalStorage) WalkDir(fn func(string, int64) error) error {
+	return filepath.Walk(l.base, func(p string, f os.FileInfo, err error) error {
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if f.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(l.base, p)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		return fn(filepath.ToSlash(rel), f.Size())
+	})
+}
+
 func pathExists(_path string) bool {
 	_, err := os.Stat(_path)
 	if err != nil && os.IsNotExist(err) {
@@ -2,6 +2,8 @@ package utils
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"testing"
 
 	. "github.com/pingcap/check"
@@ -30,3 +32,74 @@ func (r *testStorageSuite) TestCreateStorage(c *C) {
 	_, err = CreateStorage(rawURL)
 	c.Assert(err, IsNil)
 }
+
+func (r *testStorageSuite) TestLocalStorageStream(c *C) {
+	s, err := CreateStorage(fmt.Sprintf("local://%s", c.MkDir()))
+	c.Assert(err, IsNil)
+
+	w, err := s.Create("dir/file")
+	c.Assert(err, IsNil)
+	_, err = w.Write([]byte("0123456789"))
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), IsNil)
+
+	size, err := s.Size("dir/file")
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, int64(10))
+
+	rd, err := s.Open("dir/file")
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(rd)
+	c.Assert(err, IsNil)
+	c.Assert(rd.Close(), IsNil)
+	c.Assert(string(data), Equals, "0123456789")
+
+	rd, err = s.OpenRange("dir/file", 3, 4)
+	c.Assert(err, IsNil)
+	data, err = ioutil.ReadAll(rd)
+	c.Assert(err, IsNil)
+	c.Assert(rd.Close(), IsNil)
+	c.Assert(string(data), Equals, "3456")
+
+	c.Assert(s.Delete("dir/file"), IsNil)
+	c.Assert(s.FileExists("dir/file"), IsFalse)
+}
+
+func (r *testStorageSuite) TestLocalStorageAtomicWrite(c *C) {
+	dir := c.MkDir()
+	s, err := CreateStorage(fmt.Sprintf("local://%s", dir))
+	c.Assert(err, IsNil)
+
+	c.Assert(s.Write("file", []byte("old")), IsNil)
+	w, err := s.Create("file")
+	c.Assert(err, IsNil)
+	_, err = w.Write([]byte("new"))
+	c.Assert(err, IsNil)
+	// The file is not changed before Close.
+	data, err := s.Read("file")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "old")
+	c.Assert(w.Close(), IsNil)
+	data, err = s.Read("file")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "new")
+
+	// No temporary file is left.
+	files, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 1)
+}
+
+func (r *testStorageSuite) TestCheckWritable(c *C) {
+	dir := c.MkDir()
+	s, err := CreateStorage(fmt.Sprintf("local://%s", dir))
+	c.Assert(err, IsNil)
+	c.Assert(CheckWritable(s), IsNil)
+	c.Assert(s.FileExists(probeFile), IsFalse)
+
+	c.Assert(os.Chmod(dir, 0500), IsNil)
+	defer func() { _ = os.Chmod(dir, 0700) }()
+	if os.Geteuid() != 0 {
+		c.Assert(CheckWritable(s), ErrorMatches, "storage is not writable.*")
+	}
+}